@@ -0,0 +1,74 @@
+package eirinistaging
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+var archiveSignatures = []struct {
+	magic     []byte
+	extractor Extractor
+}{
+	{magic: []byte("PK\x03\x04"), extractor: &Unzipper{}},
+	{magic: []byte("PK\x05\x06"), extractor: &Unzipper{}},
+	{magic: []byte{0x1f, 0x8b}, extractor: &TarGzipExtractor{}},
+	{magic: []byte("BZh"), extractor: &TarBzip2Extractor{}},
+	{magic: []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, extractor: &TarXzExtractor{}},
+	{magic: zstdMagic, extractor: &TarZstdExtractor{}},
+}
+
+// ArchiveExtractor picks the Extractor matching the content of the archive,
+// regardless of its file name.
+type ArchiveExtractor struct{}
+
+func (a *ArchiveExtractor) Extract(ctx context.Context, src, targetDir string) error {
+	extractor, err := sniffExtractor(src)
+	if err != nil {
+		return err
+	}
+
+	return extractor.Extract(ctx, src, targetDir)
+}
+
+func sniffExtractor(src string) (Extractor, error) {
+	file, err := os.Open(filepath.Clean(src))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	header := make([]byte, 8)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	header = header[:n]
+
+	for _, signature := range archiveSignatures {
+		if bytes.HasPrefix(header, signature.magic) {
+			return signature.extractor, nil
+		}
+	}
+
+	return nil, UnsupportedArchiveError{}
+}
+
+// contextReader fails reads once ctx is done, which interrupts copies that
+// would otherwise run to the end of their input.
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return c.reader.Read(p)
+}
@@ -0,0 +1,206 @@
+package eirinistaging_test
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "code.cloudfoundry.org/eirini-staging"
+)
+
+var _ = Describe("ArchiveExtractor", func() {
+
+	var (
+		targetDir string
+		src       string
+		err       error
+		extractor Extractor
+		ctx       context.Context
+	)
+
+	BeforeEach(func() {
+		targetDir, err = ioutil.TempDir("", "archive")
+		Expect(err).NotTo(HaveOccurred())
+		ctx = context.Background()
+	})
+
+	JustBeforeEach(func() {
+		extractor = &ArchiveExtractor{}
+		err = extractor.Extract(ctx, src, targetDir)
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(targetDir)).To(Succeed())
+	})
+
+	fileContents := map[string]string{
+		"file1":                       "this is the content of test file 1",
+		"innerDir/file2":              "this is the content of test file 2",
+		"innerDir/innermostDir/file3": "this is the content of test file 3",
+	}
+
+	filePermissions := map[string]os.FileMode{
+		"file1":                       0742,
+		"innerDir/file2":              0651,
+		"innerDir/innermostDir/file3": 0777,
+	}
+
+	assertExtractedSuccessfully := func() {
+		It("should not fail", func() {
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("should extract the file contents", func() {
+			for file, expectedContent := range fileContents {
+				content, readErr := ioutil.ReadFile(filepath.Join(targetDir, file))
+				Expect(readErr).ToNot(HaveOccurred())
+				Expect(string(content)).To(Equal(expectedContent))
+			}
+		})
+
+		It("should keep the file permissions", func() {
+			for file, expectedPermissions := range filePermissions {
+				fileInfo, statErr := os.Stat(filepath.Join(targetDir, file))
+				Expect(statErr).ToNot(HaveOccurred())
+				Expect(fileInfo.Mode()).To(Equal(expectedPermissions))
+			}
+		})
+	}
+
+	Context("when the archive is a zip file", func() {
+		BeforeEach(func() {
+			src = "testdata/unzip_me.zip"
+		})
+
+		assertExtractedSuccessfully()
+	})
+
+	Context("when the archive is a gzipped tarball", func() {
+		BeforeEach(func() {
+			src = "testdata/untar_me.tar.gz"
+		})
+
+		assertExtractedSuccessfully()
+	})
+
+	Context("when the extraction is cancelled", func() {
+		BeforeEach(func() {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithCancel(context.Background())
+			cancel()
+		})
+
+		for _, archive := range []string{"testdata/unzip_me.zip", "testdata/untar_me.tar.gz", "testdata/untar_me.tar.xz"} {
+			archive := archive
+
+			Context("and the archive is "+archive, func() {
+				BeforeEach(func() {
+					src = archive
+				})
+
+				It("should stop extracting", func() {
+					Expect(err).To(MatchError(context.Canceled))
+					Expect(filepath.Join(targetDir, "file1")).NotTo(BeAnExistingFile())
+				})
+			})
+		}
+	})
+
+	Context("when the archive is a bzip2 compressed tarball", func() {
+		BeforeEach(func() {
+			src = "testdata/untar_me.tar.bz2"
+		})
+
+		assertExtractedSuccessfully()
+	})
+
+	Context("when the archive is a xz compressed tarball", func() {
+		BeforeEach(func() {
+			src = "testdata/untar_me.tar.xz"
+		})
+
+		assertExtractedSuccessfully()
+	})
+
+	Context("when the archive is a zstd compressed tarball", func() {
+		BeforeEach(func() {
+			src = "testdata/untar_me.tar.zst"
+		})
+
+		assertExtractedSuccessfully()
+	})
+
+	Context("when the file extension does not match the content", func() {
+		BeforeEach(func() {
+			src = "testdata/untar_me_disguised.zip"
+		})
+
+		assertExtractedSuccessfully()
+	})
+
+	Context("when the file is not a supported archive", func() {
+		BeforeEach(func() {
+			src = "testdata/file.notzip"
+		})
+
+		It("should return an unsupported archive error", func() {
+			Expect(err).To(Equal(UnsupportedArchiveError{}))
+		})
+	})
+
+	Context("when the file is empty", func() {
+		BeforeEach(func() {
+			src = "testdata/file"
+		})
+
+		It("should return an unsupported archive error", func() {
+			Expect(err).To(Equal(UnsupportedArchiveError{}))
+		})
+	})
+
+	Context("when a tarball symlink goes up through a symlink created after it", func() {
+		BeforeEach(func() {
+			archive, createErr := ioutil.TempFile("", "malicious.tar.gz")
+			Expect(createErr).NotTo(HaveOccurred())
+			defer archive.Close()
+			src = archive.Name()
+
+			gzipWriter := gzip.NewWriter(archive)
+			tarWriter := tar.NewWriter(gzipWriter)
+			for _, header := range []*tar.Header{
+				{Name: "sub/", Typeflag: tar.TypeDir, Mode: 0755},
+				{Name: "l", Typeflag: tar.TypeSymlink, Linkname: "sub/x/../..", Mode: 0777},
+				{Name: "sub/x", Typeflag: tar.TypeSymlink, Linkname: ".", Mode: 0777},
+			} {
+				Expect(tarWriter.WriteHeader(header)).To(Succeed())
+			}
+			Expect(tarWriter.Close()).To(Succeed())
+			Expect(gzipWriter.Close()).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(os.Remove(src)).To(Succeed())
+		})
+
+		It("should fail with a symlink escape error", func() {
+			Expect(err).To(Equal(SymlinkEscapeError{Entry: "l", Target: "sub/x/../.."}))
+		})
+	})
+
+	Context("when the archive does not exist", func() {
+		BeforeEach(func() {
+			src = "testdata/non-existent"
+		})
+
+		It("should fail", func() {
+			Expect(err).To(HaveOccurred())
+			Expect(err).NotTo(Equal(UnsupportedArchiveError{}))
+		})
+	})
+})
@@ -0,0 +1,145 @@
+package builder
+
+import (
+	"bytes"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// CertBundleName is the name of the bundle of trusted certificates buildpack
+// scripts get through SSL_CERT_FILE and friends.
+const CertBundleName = "ca-certificates.crt"
+
+// systemCertBundles are the locations of the bundle of publicly trusted
+// certificates on the stacks we know about. The first one that exists is
+// included in the bundle, so that extra certificates add to the public ones.
+var systemCertBundles = []string{
+	"/etc/ssl/certs/ca-certificates.crt",
+	"/etc/pki/tls/certs/ca-bundle.crt",
+	"/etc/ssl/cert.pem",
+}
+
+// setUpTrustedCerts makes the certificates in the trusted certs dir available
+// to buildpack scripts the way Diego does: each certificate is placed in the
+// directory CF_SYSTEM_CERT_PATH points to and they are all appended to the
+// system bundle the usual TLS variables point to. Files that hold no
+// certificate are skipped.
+func (runner *Runner) setUpTrustedCerts() error {
+	if runner.config.TrustedCertsDir == "" {
+		return nil
+	}
+
+	files, err := ioutil.ReadDir(runner.config.TrustedCertsDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	runner.certsDir, err = ioutil.TempDir("", "certs")
+	if err != nil {
+		return err
+	}
+
+	systemCertsDir := filepath.Join(runner.certsDir, "system-certs")
+	if err = os.Mkdir(systemCertsDir, 0755); err != nil {
+		return err
+	}
+
+	bundle := new(bytes.Buffer)
+	if err = appendSystemCertBundle(bundle); err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if file.IsDir() || isHiddenFile(file.Name()) {
+			continue
+		}
+
+		contents, err := ioutil.ReadFile(filepath.Join(runner.config.TrustedCertsDir, file.Name()))
+		if err != nil {
+			return err
+		}
+
+		if !containsCertificate(contents) {
+			logError(fmt.Sprintf("Skipping %s: it does not contain a PEM encoded certificate", file.Name()))
+			continue
+		}
+
+		if err = ioutil.WriteFile(filepath.Join(systemCertsDir, file.Name()), contents, 0644); err != nil {
+			return err
+		}
+
+		appendPEM(bundle, contents)
+	}
+
+	bundlePath := filepath.Join(runner.certsDir, CertBundleName)
+	if err = ioutil.WriteFile(bundlePath, bundle.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	runner.platformEnv["CF_SYSTEM_CERT_PATH"] = systemCertsDir
+	for _, name := range []string{"SSL_CERT_FILE", "CURL_CA_BUNDLE", "GIT_SSL_CAINFO", "NODE_EXTRA_CA_CERTS", "REQUESTS_CA_BUNDLE"} {
+		runner.platformEnv[name] = bundlePath
+	}
+
+	return nil
+}
+
+// WithSystemCertBundle returns the system bundle followed by certs, for tools
+// that trust a single bundle.
+func WithSystemCertBundle(certs []byte) ([]byte, error) {
+	bundle := new(bytes.Buffer)
+	if err := appendSystemCertBundle(bundle); err != nil {
+		return nil, err
+	}
+
+	appendPEM(bundle, certs)
+	return bundle.Bytes(), nil
+}
+
+func appendSystemCertBundle(bundle *bytes.Buffer) error {
+	for _, path := range systemCertBundles {
+		contents, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		appendPEM(bundle, contents)
+		return nil
+	}
+
+	logError("No system certificate bundle found, only the trusted certificates will be trusted")
+	return nil
+}
+
+func appendPEM(bundle *bytes.Buffer, contents []byte) {
+	bundle.Write(contents)
+	if !bytes.HasSuffix(contents, []byte("\n")) {
+		bundle.WriteString("\n")
+	}
+}
+
+func containsCertificate(contents []byte) bool {
+	for {
+		var block *pem.Block
+		block, contents = pem.Decode(contents)
+		if block == nil {
+			return false
+		}
+		if block.Type == "CERTIFICATE" {
+			return true
+		}
+	}
+}
+
+func isHiddenFile(name string) bool {
+	return len(name) > 0 && name[0] == '.'
+}
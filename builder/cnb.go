@@ -0,0 +1,550 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	LifecycleTypeBuildpack = "buildpack"
+	LifecycleTypeCNB       = "cnb"
+
+	// cnbDetectFailCode is what bin/detect exits with when the buildpack does
+	// not apply to the app, as opposed to failing.
+	cnbDetectFailCode = 100
+	// cnbAnyStack is the stack id of buildpacks that run on any stack.
+	cnbAnyStack = "*"
+)
+
+// Lifecycle stages an app into a droplet.
+type Lifecycle interface {
+	Run(ctx context.Context) error
+	RecordSteps(steps ...StepReport)
+	CleanUp()
+}
+
+// NewLifecycle returns the lifecycle that stages with the kind of buildpacks
+// the config asks for, v2 buildpacks by default.
+func NewLifecycle(config *Config) (Lifecycle, error) {
+	switch config.LifecycleType {
+	case "", LifecycleTypeBuildpack:
+		return NewRunner(config), nil
+	case LifecycleTypeCNB:
+		return NewCNBRunner(config), nil
+	default:
+		return nil, fmt.Errorf("unsupported lifecycle type %q: expected %s or %s", config.LifecycleType, LifecycleTypeBuildpack, LifecycleTypeCNB)
+	}
+}
+
+// CNBRunner stages apps with Cloud Native Buildpacks. The buildpacks are
+// detected and built with the directory layout of the buildpack API and the
+// droplet holds the app next to the layers the buildpacks marked for launch.
+type CNBRunner struct {
+	*Runner
+	workDir     string
+	platformDir string
+	layersDir   string
+}
+
+type cnbBuildpack struct {
+	key     string
+	path    string
+	id      string
+	version string
+	name    string
+	stacks  []string
+}
+
+type cnbGroupEntry struct {
+	buildpack cnbBuildpack
+	optional  bool
+}
+
+func NewCNBRunner(config *Config) *CNBRunner {
+	runner := NewRunner(config)
+	runner.lifecycleType = LifecycleTypeCNB
+	return &CNBRunner{Runner: runner}
+}
+
+// Run stages the app like Runner.Run does, with Cloud Native Buildpacks.
+func (runner *CNBRunner) Run(ctx context.Context) error {
+	if runner.config.StagingTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, runner.config.StagingTimeout)
+		defer cancel()
+	}
+
+	err := runner.makeDirectories()
+	if err != nil {
+		return errors.Wrap(err, "Failed to set up filesystem when generating droplet")
+	}
+
+	err = runner.setUpTrustedCerts()
+	if err != nil {
+		return errors.Wrap(err, "Failed to set up trusted certificates")
+	}
+
+	if stack := runner.config.Stack(); stack != "" {
+		runner.platformEnv["CNB_STACK_ID"] = stack
+	}
+
+	order, err := runner.loadOrder()
+	if err != nil {
+		// loadOrder returns custom errors
+		return err
+	}
+
+	log.Println("Detecting buildpacks")
+	group, err := runner.detect(ctx, order)
+	if err != nil {
+		return err
+	}
+
+	for _, buildpack := range group {
+		log.Printf("Building with %s %s", buildpack.id, buildpack.version)
+		if err = runner.build(ctx, buildpack); err != nil {
+			return err
+		}
+	}
+
+	processes, err := runner.processTypes(group)
+	if err != nil {
+		return NewReleaseFailError(errors.Wrap(err, "Failed to read the launch processes"))
+	}
+
+	if err = runner.removeNonLaunchLayers(group); err != nil {
+		return errors.Wrap(err, "Failed to remove build layers")
+	}
+
+	return runner.createDroplet(ctx, runner.buildpacksMetadata(group), Release{DefaultProcessTypes: processes})
+}
+
+func (runner *CNBRunner) CleanUp() {
+	runner.Runner.CleanUp()
+	if runner.workDir != "" {
+		os.RemoveAll(runner.workDir)
+	}
+}
+
+func (runner *CNBRunner) makeDirectories() error {
+	for _, dir := range []string{
+		filepath.Dir(runner.config.OutputDropletLocation),
+		filepath.Dir(runner.config.OutputMetadataLocation),
+		runner.config.BuildArtifactsCacheDir(),
+	} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	runner.contentsDir, err = ioutil.TempDir("", "contents")
+	if err != nil {
+		return err
+	}
+
+	runner.layersDir = filepath.Join(runner.contentsDir, "layers")
+	if err = os.Mkdir(runner.layersDir, 0755); err != nil {
+		return err
+	}
+
+	runner.workDir, err = ioutil.TempDir("", "cnb")
+	if err != nil {
+		return err
+	}
+
+	runner.platformDir = filepath.Join(runner.workDir, "platform")
+	if err = os.MkdirAll(filepath.Join(runner.platformDir, "env"), 0755); err != nil {
+		return err
+	}
+
+	// buildpacks read the app environment from the platform dir, one file per
+	// variable
+	for name, value := range runner.config.StagingEnv.Environment {
+		if name == "" || name == "." || name == ".." || strings.ContainsRune(name, filepath.Separator) {
+			return fmt.Errorf("environment variable name %q cannot be a file name in the platform dir", name)
+		}
+		if err = ioutil.WriteFile(filepath.Join(runner.platformDir, "env", name), []byte(value), 0644); err != nil {
+			return err
+		}
+	}
+
+	return os.MkdirAll(filepath.Join(runner.workDir, "plans"), 0755)
+}
+
+// loadOrder reads the buildpack.toml of every buildpack and writes the
+// order.toml detection follows: a group per buildpack, of which the first one
+// that passes is used, or a single group when detection is skipped.
+func (runner *CNBRunner) loadOrder() ([][]cnbGroupEntry, error) {
+	var buildpacks []cnbBuildpack
+	for _, key := range runner.config.BuildpackOrder {
+		buildpack, err := runner.readBuildpack(key)
+		if err != nil {
+			logError(err.Error())
+			if runner.config.SkipDetect {
+				return nil, NewCompileFailError(err)
+			}
+			continue
+		}
+
+		if err = buildpack.checkStack(runner.config.Stack()); err != nil {
+			if runner.config.SkipDetect {
+				return nil, NewStackFailError(fmt.Errorf("buildpack %s cannot be used: %s", key, err.Error()))
+			}
+			log.Printf("Skipping buildpack %s: %s", key, err.Error())
+			continue
+		}
+
+		buildpacks = append(buildpacks, buildpack)
+	}
+
+	groups := [][]cnbBuildpack{buildpacks}
+	if !runner.config.SkipDetect {
+		groups = nil
+		for _, buildpack := range buildpacks {
+			groups = append(groups, []cnbBuildpack{buildpack})
+		}
+	}
+
+	orderPath := filepath.Join(runner.workDir, "order.toml")
+	if err := writeOrder(orderPath, groups); err != nil {
+		return nil, errors.Wrap(err, "Failed to write order.toml")
+	}
+
+	order, err := readOrder(orderPath, buildpacks)
+	return order, errors.Wrap(err, "Failed to read order.toml")
+}
+
+func (runner *CNBRunner) readBuildpack(key string) (cnbBuildpack, error) {
+	path, err := runner.buildpackPath(key)
+	if err != nil {
+		return cnbBuildpack{}, err
+	}
+
+	contents, err := ioutil.ReadFile(filepath.Join(path, "buildpack.toml"))
+	if err != nil {
+		return cnbBuildpack{}, errors.Wrapf(err, "buildpack %s is not a Cloud Native Buildpack", key)
+	}
+
+	descriptor, err := parseTOML(string(contents))
+	if err != nil {
+		return cnbBuildpack{}, errors.Wrapf(err, "invalid buildpack.toml in buildpack %s", key)
+	}
+
+	info := tomlTable(descriptor, "buildpack")
+	if tomlString(info, "id") == "" {
+		return cnbBuildpack{}, fmt.Errorf("buildpack.toml of buildpack %s has no id", key)
+	}
+	if len(tomlTables(descriptor, "order")) > 0 {
+		return cnbBuildpack{}, fmt.Errorf("buildpack %s is a meta-buildpack, which is not supported", key)
+	}
+
+	buildpack := cnbBuildpack{
+		key:     key,
+		path:    path,
+		id:      tomlString(info, "id"),
+		version: tomlString(info, "version"),
+		name:    tomlString(info, "name"),
+	}
+	for _, stack := range tomlTables(descriptor, "stacks") {
+		buildpack.stacks = append(buildpack.stacks, tomlString(stack, "id"))
+	}
+
+	return buildpack, nil
+}
+
+func (b cnbBuildpack) checkStack(stack string) error {
+	if stack == "" || len(b.stacks) == 0 {
+		return nil
+	}
+
+	for _, id := range b.stacks {
+		if id == stack || id == cnbAnyStack {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("it only supports stacks %s, not %s", strings.Join(b.stacks, ", "), stack)
+}
+
+// escapedID is the name of the directories of the buildpack in the layers
+// and plans dirs.
+func (b cnbBuildpack) escapedID() string {
+	return strings.Replace(b.id, "/", "_", -1)
+}
+
+func writeOrder(path string, groups [][]cnbBuildpack) error {
+	order := new(bytes.Buffer)
+	for _, group := range groups {
+		order.WriteString("[[order]]\n")
+		for _, buildpack := range group {
+			fmt.Fprintf(order, "\n  [[order.group]]\n  id = %s\n  version = %s\n", tomlQuote(buildpack.id), tomlQuote(buildpack.version))
+		}
+		order.WriteString("\n")
+	}
+
+	return ioutil.WriteFile(path, order.Bytes(), 0644)
+}
+
+func readOrder(path string, buildpacks []cnbBuildpack) ([][]cnbGroupEntry, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	order, err := parseTOML(string(contents))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid order.toml")
+	}
+
+	var groups [][]cnbGroupEntry
+	for _, orderEntry := range tomlTables(order, "order") {
+		var group []cnbGroupEntry
+		for _, groupEntry := range tomlTables(orderEntry, "group") {
+			buildpack, ok := findBuildpack(buildpacks, tomlString(groupEntry, "id"), tomlString(groupEntry, "version"))
+			if !ok {
+				return nil, fmt.Errorf("buildpack %s of order.toml is not installed", tomlString(groupEntry, "id"))
+			}
+			group = append(group, cnbGroupEntry{buildpack: buildpack, optional: tomlBool(groupEntry, "optional")})
+		}
+		groups = append(groups, group)
+	}
+
+	return groups, nil
+}
+
+func findBuildpack(buildpacks []cnbBuildpack, id, version string) (cnbBuildpack, bool) {
+	for _, buildpack := range buildpacks {
+		if buildpack.id == id && (version == "" || buildpack.version == version) {
+			return buildpack, true
+		}
+	}
+	return cnbBuildpack{}, false
+}
+
+// detect returns the buildpacks of the first group whose required buildpacks
+// all pass detection.
+func (runner *CNBRunner) detect(ctx context.Context, order [][]cnbGroupEntry) ([]cnbBuildpack, error) {
+	for _, group := range order {
+		var passed []cnbBuildpack
+		for _, entry := range group {
+			pass, err := runner.detectBuildpack(ctx, entry.buildpack)
+			if err != nil {
+				return nil, err
+			}
+
+			if pass {
+				passed = append(passed, entry.buildpack)
+			} else if !entry.optional {
+				passed = nil
+				break
+			}
+		}
+
+		if len(passed) > 0 {
+			return passed, nil
+		}
+	}
+
+	return nil, DetectFailErr
+}
+
+func (runner *CNBRunner) detectBuildpack(ctx context.Context, buildpack cnbBuildpack) (bool, error) {
+	cmd := exec.Command(filepath.Join(buildpack.path, "bin", "detect"), runner.platformDir, runner.planPath(buildpack, "detect"))
+	cmd.Dir = runner.config.BuildDir
+
+	err := runner.run(ctx, PhaseDetect, buildpack.key, cmd)
+	if isInterruption(err) {
+		return false, err
+	}
+	if err != nil && cmd.ProcessState != nil && cmd.ProcessState.ExitCode() != cnbDetectFailCode {
+		logError(fmt.Sprintf("detect script of %s failed %s", buildpack.id, err.Error()))
+	}
+
+	return err == nil, nil
+}
+
+func (runner *CNBRunner) build(ctx context.Context, buildpack cnbBuildpack) error {
+	layersDir := filepath.Join(runner.layersDir, buildpack.escapedID())
+	if err := os.MkdirAll(layersDir, 0755); err != nil {
+		return NewCompileFailError(err)
+	}
+
+	planPath, err := runner.writeBuildpackPlan(buildpack)
+	if err != nil {
+		return NewCompileFailError(err)
+	}
+
+	cmd := exec.Command(filepath.Join(buildpack.path, "bin", "build"), layersDir, runner.platformDir, planPath)
+	cmd.Dir = runner.config.BuildDir
+
+	err = runner.run(ctx, PhaseBuild, buildpack.key, cmd)
+	if isInterruption(err) {
+		return err
+	}
+	if err != nil {
+		logError(fmt.Sprintf("build script failed %s", err.Error()))
+		return NewCompileFailError(errors.Wrapf(err, "failed to build with %s", buildpack.id))
+	}
+
+	return nil
+}
+
+func (runner *CNBRunner) planPath(buildpack cnbBuildpack, phase string) string {
+	return filepath.Join(runner.workDir, "plans", buildpack.escapedID()+"."+phase+".toml")
+}
+
+// writeBuildpackPlan turns what the buildpack required during detection into
+// the entries of its buildpack plan.
+func (runner *CNBRunner) writeBuildpackPlan(buildpack cnbBuildpack) (string, error) {
+	plan := new(bytes.Buffer)
+
+	contents, err := ioutil.ReadFile(runner.planPath(buildpack, "detect"))
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	detectPlan, err := parseTOML(string(contents))
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid build plan of %s", buildpack.id)
+	}
+
+	for _, require := range tomlTables(detectPlan, "requires") {
+		fmt.Fprintf(plan, "[[entries]]\nname = %s\n", tomlQuote(tomlString(require, "name")))
+		if version := tomlString(require, "version"); version != "" {
+			fmt.Fprintf(plan, "version = %s\n", tomlQuote(version))
+		}
+		plan.WriteString("\n")
+	}
+
+	planPath := runner.planPath(buildpack, "build")
+	return planPath, ioutil.WriteFile(planPath, plan.Bytes(), 0644)
+}
+
+// processTypes reads the processes the buildpacks declared in their
+// launch.toml, later buildpacks overriding earlier ones, and the ones of the
+// app's Procfile.
+func (runner *CNBRunner) processTypes(group []cnbBuildpack) (ProcessTypes, error) {
+	processes := ProcessTypes{}
+	for _, buildpack := range group {
+		contents, err := ioutil.ReadFile(filepath.Join(runner.layersDir, buildpack.escapedID(), "launch.toml"))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		launch, err := parseTOML(string(contents))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid launch.toml of %s", buildpack.id)
+		}
+
+		for _, process := range tomlTables(launch, "processes") {
+			command := []string{tomlString(process, "command")}
+			for _, arg := range tomlStrings(process, "args") {
+				command = append(command, shellQuote(arg))
+			}
+			processes[tomlString(process, "type")] = strings.Join(command, " ")
+		}
+	}
+
+	procfile, err := runner.readProcfile()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read command from Procfile")
+	}
+	for processType, command := range procfile {
+		processes[processType] = command
+	}
+
+	if processes["web"] == "" {
+		logError("No start command specified by buildpack or via Procfile.")
+		logError("App will not start unless a command is provided at runtime.")
+	}
+
+	return processes, nil
+}
+
+// removeNonLaunchLayers leaves the droplet with the layers the app needs at
+// runtime. Layers without metadata are not used by anything.
+func (runner *CNBRunner) removeNonLaunchLayers(group []cnbBuildpack) error {
+	for _, buildpack := range group {
+		layersDir := filepath.Join(runner.layersDir, buildpack.escapedID())
+		entries, err := ioutil.ReadDir(layersDir)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+
+			metadataPath := filepath.Join(layersDir, entry.Name()+".toml")
+			contents, err := ioutil.ReadFile(metadataPath)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+
+			metadata, err := parseTOML(string(contents))
+			if err != nil {
+				return errors.Wrapf(err, "invalid metadata of layer %s of %s", entry.Name(), buildpack.id)
+			}
+
+			// newer buildpack APIs declare the layer types in a table
+			if tomlBool(metadata, "launch") || tomlBool(tomlTable(metadata, "types"), "launch") {
+				continue
+			}
+
+			if err = os.RemoveAll(filepath.Join(layersDir, entry.Name())); err != nil {
+				return err
+			}
+			if err = os.RemoveAll(metadataPath); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (runner *CNBRunner) buildpacksMetadata(group []cnbBuildpack) []BuildpackMetadata {
+	revisions := runner.buildpackRevisions()
+
+	metadata := make([]BuildpackMetadata, len(group))
+	for i, buildpack := range group {
+		name := buildpack.name
+		if name == "" {
+			name = buildpack.id
+		}
+
+		metadata[i] = BuildpackMetadata{
+			Key:      buildpack.key,
+			Name:     name,
+			Version:  buildpack.version,
+			Revision: revisions[buildpack.key],
+		}
+	}
+
+	return metadata
+}
+
+// shellQuote quotes an argument of a start command, which is run by a shell,
+// unless it only holds characters the shell leaves alone.
+func shellQuote(arg string) string {
+	if arg != "" && strings.IndexFunc(arg, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./=:,+@%", r))
+	}) < 0 {
+		return arg
+	}
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
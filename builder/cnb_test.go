@@ -0,0 +1,269 @@
+package builder_test
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/eirini-staging/builder"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+)
+
+var _ = Describe("Building with Cloud Native Buildpacks", func() {
+	var (
+		tmpDir         string
+		buildDir       string
+		buildpacksDir  string
+		outputDroplet  string
+		outputMetadata string
+		buildpackOrder string
+		skipDetect     bool
+		stagingEnv     builder.StagingEnvironment
+
+		lifecycle builder.Lifecycle
+		logOut    *gbytes.Buffer
+		stageErr  error
+
+		buildpackFixtures = filepath.Join("fixtures", "buildpacks", "unix")
+		appFixtures       = filepath.Join("fixtures", "apps")
+	)
+
+	cpBuildpack := func(buildpack string) {
+		hash := fmt.Sprintf("%x", md5.Sum([]byte(buildpack)))
+		cp(filepath.Join(buildpackFixtures, buildpack), filepath.Join(buildpacksDir, hash))
+	}
+
+	stagingResult := func() builder.StagingResult {
+		contents, err := ioutil.ReadFile(outputMetadata)
+		Expect(err).NotTo(HaveOccurred())
+
+		var result builder.StagingResult
+		Expect(json.Unmarshal(contents, &result)).To(Succeed())
+		return result
+	}
+
+	dropletFiles := func() []string {
+		listing, err := exec.Command("tar", "-tzf", outputDroplet).Output()
+		Expect(err).NotTo(HaveOccurred())
+		return strings.Split(strings.TrimSpace(string(listing)), "\n")
+	}
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "cnb-building")
+		Expect(err).NotTo(HaveOccurred())
+
+		buildDir = filepath.Join(tmpDir, "app")
+		buildpacksDir = filepath.Join(tmpDir, "buildpacks")
+		for _, dir := range []string{buildDir, buildpacksDir} {
+			Expect(os.MkdirAll(dir, 0755)).To(Succeed())
+		}
+		outputDroplet = filepath.Join(tmpDir, "out", "droplet.tgz")
+		outputMetadata = filepath.Join(tmpDir, "out", "result.json")
+
+		cp(filepath.Join(appFixtures, "bash-app", "app.sh"), buildDir)
+		buildpackOrder = "cnb-never-detects,cnb-hello"
+		skipDetect = false
+		stagingEnv = builder.StagingEnvironment{}
+
+		logOut = gbytes.NewBuffer()
+		log.SetOutput(logOut)
+	})
+
+	JustBeforeEach(func() {
+		for _, buildpack := range strings.Split(buildpackOrder, ",") {
+			cpBuildpack(buildpack)
+		}
+
+		conf := builder.Config{
+			BuildDir:                  buildDir,
+			BuildpacksDir:             buildpacksDir,
+			OutputDropletLocation:     outputDroplet,
+			OutputBuildArtifactsCache: filepath.Join(tmpDir, "cache", "cache.tgz"),
+			OutputMetadataLocation:    outputMetadata,
+			BuildpackOrder:            strings.Split(buildpackOrder, ","),
+			BuildArtifactsCache:       filepath.Join(tmpDir, "cache-dir"),
+			SkipDetect:                skipDetect,
+			StagingEnv:                stagingEnv,
+			LifecycleType:             builder.LifecycleTypeCNB,
+		}
+
+		var err error
+		lifecycle, err = builder.NewLifecycle(&conf)
+		Expect(err).NotTo(HaveOccurred())
+
+		runner := lifecycle.(*builder.CNBRunner)
+		runner.BuildpackOut = GinkgoWriter
+		runner.BuildpackErr = GinkgoWriter
+		stageErr = lifecycle.Run(context.Background())
+	})
+
+	AfterEach(func() {
+		lifecycle.CleanUp()
+		log.SetOutput(os.Stderr)
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	It("reports a cnb staging of the buildpack that detected", func() {
+		Expect(stageErr).NotTo(HaveOccurred())
+
+		result := stagingResult()
+		Expect(result.LifecycleType).To(Equal("cnb"))
+		Expect(result.LifecycleMetadata.DetectedBuildpack).To(Equal("Hello CNB"))
+		Expect(result.LifecycleMetadata.Buildpacks).To(Equal([]builder.BuildpackMetadata{
+			{Key: "cnb-hello", Name: "Hello CNB", Version: "1.2.3"},
+		}))
+	})
+
+	It("uses the processes of launch.toml", func() {
+		Expect(stagingResult().ProcessTypes).To(Equal(builder.ProcessTypes{
+			"web":    "bash app.sh",
+			"worker": `bash worker.sh --verbose --name 'it'\''s a $HOME'`,
+		}))
+	})
+
+	It("keeps only the launch layers in the droplet", func() {
+		files := dropletFiles()
+		Expect(files).To(ContainElement("./app/app.sh"))
+		Expect(files).To(ContainElement("./layers/org.example_hello/launch.toml"))
+		Expect(files).To(ContainElement("./layers/org.example_hello/runtime.toml"))
+		Expect(files).To(ContainElement("./layers/org.example_hello/runtime/bin/hello"))
+		Expect(files).To(ContainElement("./layers/org.example_hello/config/file"))
+		Expect(files).NotTo(ContainElement(ContainSubstring("tools")))
+		Expect(files).NotTo(ContainElement(ContainSubstring("scratch")))
+	})
+
+	It("records the start command in the staging info", func() {
+		stagingInfo, err := exec.Command("tar", "-xzf", outputDroplet, "-O", "./staging_info.yml").Output()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stagingInfo).To(MatchJSON(`{"detected_buildpack":"Hello CNB","start_command":"bash app.sh"}`))
+	})
+
+	It("passes what the buildpack required during detection as its plan", func() {
+		plan, err := ioutil.ReadFile(filepath.Join(buildDir, "buildpack-plan.toml"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(plan)).To(Equal("[[entries]]\nname = \"hello\"\nversion = \"1.0.0\"\n\n"))
+	})
+
+	Context("with a staging environment", func() {
+		BeforeEach(func() {
+			stagingEnv = builder.StagingEnvironment{
+				Environment: map[string]string{"BP_DEBUG": "true"},
+				Stack:       "io.buildpacks.stacks.bionic",
+			}
+		})
+
+		It("places the app environment in the platform dir", func() {
+			platformEnv, err := ioutil.ReadFile(filepath.Join(buildDir, "platform-env"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(platformEnv)).To(Equal("BP_DEBUG\n"))
+		})
+
+		Context("and a variable name is a path", func() {
+			BeforeEach(func() {
+				stagingEnv.Environment["../../../escaped"] = "true"
+			})
+
+			It("fails without writing outside the platform dir", func() {
+				Expect(stageErr).To(MatchError(ContainSubstring(`environment variable name "../../../escaped" cannot be a file name`)))
+				Expect(filepath.Join(os.TempDir(), "escaped")).NotTo(BeAnExistingFile())
+			})
+		})
+
+		It("sets the stack id", func() {
+			stackID, err := ioutil.ReadFile(filepath.Join(buildDir, "stack-id"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(stackID)).To(Equal("io.buildpacks.stacks.bionic\n"))
+		})
+	})
+
+	Context("when no buildpack detects", func() {
+		BeforeEach(func() {
+			buildpackOrder = "cnb-never-detects"
+		})
+
+		It("fails to detect", func() {
+			Expect(stageErr).To(Equal(builder.DetectFailErr))
+		})
+	})
+
+	Context("when a buildpack is a v2 buildpack", func() {
+		BeforeEach(func() {
+			buildpackOrder = "always-detects"
+		})
+
+		It("skips it", func() {
+			Expect(stageErr).To(Equal(builder.DetectFailErr))
+			Expect(logOut).To(gbytes.Say("buildpack always-detects is not a Cloud Native Buildpack"))
+		})
+	})
+
+	Context("when the build fails", func() {
+		BeforeEach(func() {
+			buildpackOrder = "cnb-fails-build"
+		})
+
+		It("fails to compile", func() {
+			Expect(stageErr.(builder.DescriptiveError).ExitCode).To(Equal(builder.CompileFailCode))
+		})
+	})
+
+	Context("when a buildpack does not support the stack", func() {
+		BeforeEach(func() {
+			buildpackOrder = "cnb-bionic-only,cnb-hello"
+			stagingEnv.Stack = "cflinuxfs3"
+		})
+
+		It("skips it during detection", func() {
+			Expect(stageErr).NotTo(HaveOccurred())
+			Expect(logOut).To(gbytes.Say("Skipping buildpack cnb-bionic-only: it only supports stacks io.buildpacks.stacks.bionic, not cflinuxfs3"))
+			Expect(stagingResult().LifecycleMetadata.BuildpackKey).To(Equal("cnb-hello"))
+		})
+
+		Context("and detection is skipped", func() {
+			BeforeEach(func() {
+				skipDetect = true
+			})
+
+			It("fails with a stack mismatch", func() {
+				Expect(stageErr.(builder.DescriptiveError).ExitCode).To(Equal(builder.StackFailCode))
+			})
+		})
+	})
+
+	Context("when detection is skipped", func() {
+		BeforeEach(func() {
+			buildpackOrder = "cnb-hello,cnb-bionic-only"
+			skipDetect = true
+		})
+
+		It("builds with every buildpack", func() {
+			Expect(stageErr).NotTo(HaveOccurred())
+			Expect(stagingResult().LifecycleMetadata.Buildpacks).To(HaveLen(2))
+			Expect(stagingResult().LifecycleMetadata.BuildpackKey).To(Equal("cnb-bionic-only"))
+		})
+	})
+})
+
+var _ = Describe("NewLifecycle", func() {
+	It("stages with v2 buildpacks by default", func() {
+		lifecycle, err := builder.NewLifecycle(&builder.Config{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lifecycle).To(BeAssignableToTypeOf(&builder.Runner{}))
+	})
+
+	It("rejects unknown lifecycle types", func() {
+		_, err := builder.NewLifecycle(&builder.Config{LifecycleType: "docker"})
+		Expect(err).To(MatchError(ContainSubstring(`unsupported lifecycle type "docker"`)))
+	})
+})
@@ -0,0 +1,214 @@
+package builder
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"runtime"
+)
+
+type Compression string
+
+const (
+	CompressionGzip Compression = "gzip"
+	// CompressionZstd relies on the zstd binary. It is only meant for the
+	// build artifacts cache, which nothing but the staging pipeline reads.
+	CompressionZstd Compression = "zstd"
+
+	// zstdMaxLevel is the highest level zstd accepts without --ultra.
+	zstdMaxLevel = 19
+
+	// gzipBlockSize is the amount of uncompressed data each worker compresses
+	// at a time. Smaller blocks cost compression ratio, bigger ones memory.
+	gzipBlockSize = 1 << 20
+)
+
+func ParseCompression(name string) (Compression, error) {
+	switch compression := Compression(name); compression {
+	case CompressionGzip, CompressionZstd:
+		return compression, nil
+	default:
+		return "", fmt.Errorf("unsupported compression %q: expected %s or %s", name, CompressionGzip, CompressionZstd)
+	}
+}
+
+// CheckCompressionLevel returns an error when the compressor does not
+// support level.
+func CheckCompressionLevel(compression Compression, level int) error {
+	if compression == CompressionZstd {
+		if level < 1 || level > zstdMaxLevel {
+			return fmt.Errorf("zstd compression levels range from 1 to %d, not %d", zstdMaxLevel, level)
+		}
+		return nil
+	}
+
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		return fmt.Errorf("gzip compression levels range from %d to %d, not %d", gzip.HuffmanOnly, gzip.BestCompression, level)
+	}
+	return nil
+}
+
+// newCompressor wraps out with the requested compression. A nil level selects
+// the default of the compressor and workers below one default to the number
+// of CPUs.
+func newCompressor(out io.Writer, compression Compression, level *int, workers int) (io.WriteCloser, error) {
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+
+	if compression == CompressionZstd {
+		if level != nil {
+			if err := CheckCompressionLevel(CompressionZstd, *level); err != nil {
+				return nil, err
+			}
+		}
+
+		zstdPath, err := exec.LookPath("zstd")
+		if err == nil {
+			return newZstdWriter(zstdPath, out, level, workers)
+		}
+
+		log.Println("warning: zstd is not available, compressing with gzip instead")
+		if level != nil && CheckCompressionLevel(CompressionGzip, *level) != nil {
+			log.Printf("warning: using the default gzip compression level instead of %d", *level)
+			level = nil
+		}
+	}
+
+	gzipLevel := gzip.DefaultCompression
+	if level != nil {
+		gzipLevel = *level
+	}
+	if err := CheckCompressionLevel(CompressionGzip, gzipLevel); err != nil {
+		return nil, err
+	}
+
+	return newParallelGzipWriter(out, gzipLevel, workers), nil
+}
+
+type compressedBlock struct {
+	data []byte
+	err  error
+}
+
+// parallelGzipWriter compresses fixed size blocks concurrently and writes
+// them as consecutive gzip members, which every gzip reader accepts as a
+// single stream. The block boundaries only depend on the input, so the output
+// is as reproducible as the one of a plain gzip.Writer.
+type parallelGzipWriter struct {
+	level   int
+	buf     []byte
+	blocks  int
+	pending chan chan compressedBlock
+	done    chan error
+}
+
+func newParallelGzipWriter(out io.Writer, level, workers int) *parallelGzipWriter {
+	w := &parallelGzipWriter{
+		level:   level,
+		buf:     make([]byte, 0, gzipBlockSize),
+		pending: make(chan chan compressedBlock, workers),
+		done:    make(chan error, 1),
+	}
+
+	go func() {
+		var err error
+		for result := range w.pending {
+			block := <-result
+			if err != nil {
+				continue
+			}
+			if err = block.err; err == nil {
+				_, err = out.Write(block.data)
+			}
+		}
+		w.done <- err
+	}()
+
+	return w
+}
+
+func (w *parallelGzipWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+
+		if len(w.buf) == cap(w.buf) {
+			w.flushBlock()
+		}
+	}
+
+	return written, nil
+}
+
+func (w *parallelGzipWriter) Close() error {
+	// an empty input still needs one member to be a valid gzip stream
+	if len(w.buf) > 0 || w.blocks == 0 {
+		w.flushBlock()
+	}
+	close(w.pending)
+
+	return <-w.done
+}
+
+func (w *parallelGzipWriter) flushBlock() {
+	block := w.buf
+	w.buf = make([]byte, 0, gzipBlockSize)
+	w.blocks++
+
+	result := make(chan compressedBlock, 1)
+	// blocks once as many blocks as there are workers are in flight
+	w.pending <- result
+
+	go func() {
+		var compressed bytes.Buffer
+		gzipWriter, err := gzip.NewWriterLevel(&compressed, w.level)
+		if err == nil {
+			if _, err = gzipWriter.Write(block); err == nil {
+				err = gzipWriter.Close()
+			}
+		}
+		result <- compressedBlock{data: compressed.Bytes(), err: err}
+	}()
+}
+
+// zstdWriter pipes everything written to it through the zstd binary.
+type zstdWriter struct {
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+func newZstdWriter(zstdPath string, out io.Writer, level *int, workers int) (io.WriteCloser, error) {
+	args := []string{"--quiet", "--stdout", fmt.Sprintf("-T%d", workers)}
+	if level != nil {
+		args = append(args, fmt.Sprintf("-%d", *level))
+	}
+
+	cmd := exec.Command(zstdPath, args...)
+	cmd.Stdout = out
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	return &zstdWriter{WriteCloser: stdin, cmd: cmd}, nil
+}
+
+func (z *zstdWriter) Close() error {
+	if err := z.WriteCloser.Close(); err != nil {
+		z.cmd.Wait()
+		return err
+	}
+
+	return z.cmd.Wait()
+}
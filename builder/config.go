@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"math"
+	"time"
 )
 
 type Config struct {
@@ -15,8 +16,41 @@ type Config struct {
 	BuildpackOrder            []string
 	SkipDetect                bool
 	BuildArtifactsCache       string
+	ReproducibleArchives      bool
+	CompressionLevel          *int
+	CacheCompression          Compression
+	StagingTimeout            time.Duration
+	PhaseTimeouts             map[Phase]time.Duration
+	KillGracePeriod           time.Duration
+	StagingEnv                StagingEnvironment
+	TrustedCertsDir           string
+	LifecycleType             string
+	OutputFormat              string
+	OutputImageLocation       string
+	OutputLayersLocation      string
+	StackLayer                *StackLayer
 }
 
+// The output formats of a staging: a droplet.tgz, an OCI image layout or a
+// droplet split into content-addressed layers.
+const (
+	OutputFormatDroplet = "droplet"
+	OutputFormatOCI     = "oci"
+	OutputFormatLayered = "layered"
+)
+
+type Phase string
+
+const (
+	PhaseDetect   Phase = "detect"
+	PhaseSupply   Phase = "supply"
+	PhaseFinalize Phase = "finalize"
+	PhaseCompile  Phase = "compile"
+	PhaseRelease  Phase = "release"
+	// PhaseBuild is the build of a Cloud Native Buildpack.
+	PhaseBuild Phase = "build"
+)
+
 func NewConfig(
 	buildDir string,
 	buildpacksDir string,
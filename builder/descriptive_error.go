@@ -16,6 +16,9 @@ const (
 	NoSupplyScriptFailMsg  = "Error: one of the buildpacks chosen to supply dependencies does not support multi-buildpack apps"
 	MissingFinalizeWarnMsg = "Warning: the last buildpack is not compatible with multi-buildpack apps and cannot make use of any dependencies supplied by the buildpacks specified before it"
 	FinalizeFailMsg        = "Failed to run finalize script"
+	TimeoutFailMsg         = "StagingTimedOut"
+	CancelFailMsg          = "StagingCancelled"
+	StackFailMsg           = "BuildpackStackMismatch"
 
 	SystemFailCode   = 1
 	DetectFailCode   = 222
@@ -23,6 +26,9 @@ const (
 	ReleaseFailCode  = 224
 	SupplyFailCode   = 225
 	FinalizeFailCode = 227
+	TimeoutFailCode  = 228
+	CancelFailCode   = 229
+	StackFailCode    = 230
 )
 
 type DescriptiveError struct {
@@ -59,3 +65,22 @@ func NewFinalizeFailError(err error) error {
 func NewNoSupplyScriptFailError(err error) error {
 	return DescriptiveError{Message: NoSupplyScriptFailMsg, ExitCode: SupplyFailCode, InnerError: err}
 }
+
+func NewTimeoutError(phase Phase, err error) error {
+	return DescriptiveError{Message: TimeoutFailMsg, ExitCode: TimeoutFailCode, InnerError: fmt.Errorf("%s did not finish in time: %s", phase, err.Error())}
+}
+
+func NewCancelledError(err error) error {
+	return DescriptiveError{Message: CancelFailMsg, ExitCode: CancelFailCode, InnerError: err}
+}
+
+func NewStackFailError(err error) error {
+	return DescriptiveError{Message: StackFailMsg, ExitCode: StackFailCode, InnerError: err}
+}
+
+// isInterruption reports whether a buildpack script was stopped by a timeout
+// or a cancellation, rather than failing on its own.
+func isInterruption(err error) bool {
+	descriptiveErr, ok := err.(DescriptiveError)
+	return ok && (descriptiveErr.ExitCode == TimeoutFailCode || descriptiveErr.ExitCode == CancelFailCode)
+}
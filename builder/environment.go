@@ -0,0 +1,107 @@
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+)
+
+// inheritedEnv lists the variables of the executor's own environment that
+// buildpack scripts get. Everything else, credentials in particular, stays
+// with the executor.
+var inheritedEnv = []string{
+	"HOME",
+	"HTTPS_PROXY",
+	"HTTP_PROXY",
+	"LANG",
+	"LC_ALL",
+	"NO_PROXY",
+	"PATH",
+	"TMPDIR",
+	"TZ",
+	"USER",
+	"http_proxy",
+	"https_proxy",
+	"no_proxy",
+}
+
+// StagingEnvironment is what Cloud Controller would give the buildpacks of
+// the app when staging on Diego.
+type StagingEnvironment struct {
+	// Environment holds the user provided and staging environment variable
+	// group variables.
+	Environment     map[string]string `json:"environment"`
+	VcapApplication json.RawMessage   `json:"vcap_application"`
+	VcapServices    json.RawMessage   `json:"vcap_services"`
+	Stack           string            `json:"stack"`
+	MemoryLimit     string            `json:"memory_limit"`
+}
+
+func ParseStagingEnvironment(contents []byte) (StagingEnvironment, error) {
+	var env StagingEnvironment
+	if err := json.Unmarshal(contents, &env); err != nil {
+		return StagingEnvironment{}, fmt.Errorf("invalid staging environment: %s", err.Error())
+	}
+
+	return env, nil
+}
+
+// Stack is the stack the app is staged for. The staging environment can
+// override the CF_STACK of the executor.
+func (s Config) Stack() string {
+	if s.StagingEnv.Stack != "" {
+		return s.StagingEnv.Stack
+	}
+	return os.Getenv("CF_STACK")
+}
+
+// BuildpackEnv returns the environment buildpack scripts run with, sorted by
+// name. The variables Cloud Controller sets win over user provided ones of the
+// same name.
+func (s Config) BuildpackEnv() []string {
+	return s.buildpackEnv(nil)
+}
+
+// buildpackEnv adds platformEnv, set up by the runner, to the variables Cloud
+// Controller sets.
+func (s Config) buildpackEnv(platformEnv map[string]string) []string {
+	env := map[string]string{}
+	for _, name := range inheritedEnv {
+		if value, ok := os.LookupEnv(name); ok {
+			env[name] = value
+		}
+	}
+
+	for name, value := range s.StagingEnv.Environment {
+		env[name] = value
+	}
+
+	cfEnv := map[string]string{
+		"VCAP_APPLICATION": string(s.StagingEnv.VcapApplication),
+		"VCAP_SERVICES":    string(s.StagingEnv.VcapServices),
+		"CF_STACK":         s.Stack(),
+		"MEMORY_LIMIT":     s.StagingEnv.MemoryLimit,
+	}
+	for name, value := range platformEnv {
+		cfEnv[name] = value
+	}
+	for name, value := range cfEnv {
+		if value == "" {
+			continue
+		}
+		if _, ok := s.StagingEnv.Environment[name]; ok {
+			log.Printf("Ignoring the user provided %s, it is set by the platform", name)
+		}
+		env[name] = value
+	}
+
+	result := make([]string, 0, len(env))
+	for name, value := range env {
+		result = append(result, name+"="+value)
+	}
+	sort.Strings(result)
+
+	return result
+}
@@ -0,0 +1,6 @@
+package builder
+
+var (
+	ParseTOML = parseTOML
+	TOMLQuote = tomlQuote
+)
@@ -0,0 +1,140 @@
+package builder
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DropletManifestName is the name of the manifest of a layered droplet,
+// which is written next to the staging result.
+const DropletManifestName = "droplet-manifest.json"
+
+// DropletManifest lists the layers of a layered droplet. Extracting every
+// layer at its path, in order, gives the contents of droplet.tgz.
+type DropletManifest struct {
+	Layers []DropletLayer `json:"layers"`
+}
+
+// DropletLayer is a gzipped tarball named after its digest, so that a layer
+// that did not change since the last staging has the same name.
+type DropletLayer struct {
+	Path   string `json:"path"`
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+}
+
+// FileName is the name of the tarball of the layer in the layers directory.
+func (l DropletLayer) FileName() string {
+	return strings.TrimPrefix(l.Digest, "sha256:") + ".tgz"
+}
+
+func ReadDropletManifest(path string) (DropletManifest, error) {
+	var manifest DropletManifest
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return manifest, err
+	}
+
+	err = json.Unmarshal(contents, &manifest)
+	return manifest, err
+}
+
+// createLayers writes the droplet as a layer per buildpack in deps, one for
+// profile.d, one for the app and one for whatever else is at the top of the
+// droplet. Layers are always reproducible, as otherwise the digest of a layer
+// would change with every staging.
+func (runner *Runner) createLayers(ctx context.Context) error {
+	layersDir := runner.config.OutputLayersLocation
+	if err := os.MkdirAll(layersDir, 0755); err != nil {
+		return err
+	}
+
+	layerDirs := map[string]string{"app": runner.config.BuildDir}
+	if _, err := os.Stat(filepath.Join(runner.contentsDir, "profile.d")); err == nil {
+		layerDirs["profile.d"] = filepath.Join(runner.contentsDir, "profile.d")
+	}
+
+	deps, err := ioutil.ReadDir(runner.depsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, dep := range deps {
+		if dep.IsDir() {
+			layerDirs["deps/"+dep.Name()] = filepath.Join(runner.depsDir, dep.Name())
+		}
+	}
+
+	paths := make([]string, 0, len(layerDirs))
+	for path := range layerDirs {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	tarball := runner.tarball(CompressionGzip)
+	tarball.Reproducible = true
+
+	root := tarball
+	root.Exclude = paths
+
+	manifest := DropletManifest{}
+	layer, err := writeLayer(ctx, root, runner.contentsDir, ".", layersDir)
+	if err != nil {
+		return err
+	}
+	manifest.Layers = append(manifest.Layers, layer)
+
+	for _, path := range paths {
+		layer, err := writeLayer(ctx, tarball, layerDirs[path], path, layersDir)
+		if err != nil {
+			return errors.Wrap(err, "failed to write layer "+path)
+		}
+		manifest.Layers = append(manifest.Layers, layer)
+	}
+
+	contents, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	manifestPath := filepath.Join(filepath.Dir(runner.config.OutputMetadataLocation), DropletManifestName)
+	return ioutil.WriteFile(manifestPath, contents, 0644)
+}
+
+// writeLayer archives dir into layersDir under the digest of the tarball.
+func writeLayer(ctx context.Context, tarball Tarball, dir, path, layersDir string) (DropletLayer, error) {
+	tmpFile := filepath.Join(layersDir, "layer.tmp")
+	if err := tarball.Write(ctx, dir, tmpFile); err != nil {
+		return DropletLayer{}, err
+	}
+
+	file, err := os.Open(tmpFile)
+	if err != nil {
+		return DropletLayer{}, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return DropletLayer{}, err
+	}
+	file.Close()
+
+	layer := DropletLayer{
+		Path:   path,
+		Digest: "sha256:" + hex.EncodeToString(hash.Sum(nil)),
+		Size:   size,
+	}
+
+	return layer, os.Rename(tmpFile, filepath.Join(layersDir, layer.FileName()))
+}
@@ -1,5 +1,9 @@
 package builder
 
+// RevisionsFileName is written by the downloader next to the installed
+// buildpacks and maps each git buildpack to the commit it was cloned at.
+const RevisionsFileName = "revisions.json"
+
 type Release struct {
 	DefaultProcessTypes ProcessTypes `yaml:"default_process_types"`
 }
@@ -8,6 +12,7 @@ type Release struct {
 type StagingInfo struct {
 	DetectedBuildpack string `json:"detected_buildpack" yaml:"detected_buildpack"`
 	StartCommand      string `json:"start_command" yaml:"start_command"`
+	Stack             string `json:"stack,omitempty" yaml:"stack,omitempty"`
 }
 
 type ProcessTypes map[string]string
@@ -17,12 +22,14 @@ type Buildpack struct {
 	Key        string `json:"key"`
 	URL        string `json:"url"`
 	SkipDetect bool   `json:"skip_detect,omit_empty"`
+	SHA256     string `json:"sha256,omitempty"`
 }
 
 type BuildpackMetadata struct {
-	Key     string `json:"key"`
-	Name    string `json:"name"`
-	Version string `json:"version,omitempty"`
+	Key      string `json:"key"`
+	Name     string `json:"name"`
+	Version  string `json:"version,omitempty"`
+	Revision string `json:"revision,omitempty"`
 }
 
 type LifecycleMetadata struct {
@@ -34,15 +41,17 @@ type LifecycleMetadata struct {
 type StagingResult struct {
 	LifecycleMetadata `json:"lifecycle_metadata"`
 	ProcessTypes      `json:"process_types"`
-	ExecutionMetadata string `json:"execution_metadata"`
-	LifecycleType     string `json:"lifecycle_type"`
+	ExecutionMetadata string         `json:"execution_metadata"`
+	LifecycleType     string         `json:"lifecycle_type"`
+	StagingReport     *StagingReport `json:"staging_report,omitempty"`
 }
 
-func NewStagingResult(procTypes ProcessTypes, lifeMeta LifecycleMetadata) StagingResult {
+func NewStagingResult(procTypes ProcessTypes, lifeMeta LifecycleMetadata, report StagingReport) StagingResult {
 	return StagingResult{
-		LifecycleType:     "buildpack",
+		LifecycleType:     LifecycleTypeBuildpack,
 		LifecycleMetadata: lifeMeta,
 		ProcessTypes:      procTypes,
 		ExecutionMetadata: "",
+		StagingReport:     &report,
 	}
 }
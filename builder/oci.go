@@ -0,0 +1,365 @@
+package builder
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	MediaTypeOCIIndex        = "application/vnd.oci.image.index.v1+json"
+	MediaTypeOCIManifest     = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeOCIConfig       = "application/vnd.oci.image.config.v1+json"
+	MediaTypeOCILayer        = "application/vnd.oci.image.layer.v1.tar+gzip"
+	MediaTypeOCIForeignLayer = "application/vnd.oci.image.layer.nondistributable.v1.tar+gzip"
+
+	// StackLabel and ProcessTypesLabel are the image config labels holding
+	// the stack the image was staged for and every process type of the app.
+	StackLabel        = "org.cloudfoundry.stack"
+	ProcessTypesLabel = "org.cloudfoundry.process-types"
+
+	// RefNameAnnotation tags the manifest in index.json.
+	RefNameAnnotation = "org.opencontainers.image.ref.name"
+
+	// imageHome is where the droplet is extracted on Diego, which the app
+	// relies on.
+	imageHome = "/home/vcap"
+)
+
+// profileScript is the entrypoint of images. It sources the profile.d
+// scripts of the buildpacks and of the app, like the Diego launcher does,
+// before running the command of the process.
+const profileScript = `cd /home/vcap/app
+for script in /home/vcap/profile.d/*.sh /home/vcap/app/.profile.d/*.sh; do
+  if [ -f "$script" ]; then . "$script"; fi
+done
+if [ -f /home/vcap/app/.profile ]; then . /home/vcap/app/.profile; fi
+exec bash -c "$1"`
+
+type OCIDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	URLs        []string          `json:"urls,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// StackLayer is the layer of the stack image an app image is based on. It is
+// referenced rather than included, so its blob is usually not in the layout.
+type StackLayer struct {
+	OCIDescriptor
+	DiffID string `json:"diffID"`
+}
+
+// ParseStackLayer reads the JSON descriptor of a stack layer. Stack layers
+// are not distributable unless their media type says otherwise.
+func ParseStackLayer(value string) (*StackLayer, error) {
+	stack := StackLayer{}
+	if err := json.Unmarshal([]byte(value), &stack); err != nil {
+		return nil, err
+	}
+	if stack.Digest == "" || stack.DiffID == "" {
+		return nil, errors.New("digest and diffID are required")
+	}
+	if stack.MediaType == "" {
+		stack.MediaType = MediaTypeOCIForeignLayer
+	}
+
+	return &stack, nil
+}
+
+type OCIIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Manifests     []OCIDescriptor `json:"manifests"`
+}
+
+type OCIManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	Config        OCIDescriptor     `json:"config"`
+	Layers        []OCIDescriptor   `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+type OCIImageConfig struct {
+	Architecture string             `json:"architecture"`
+	OS           string             `json:"os"`
+	Config       OCIContainerConfig `json:"config"`
+	RootFS       OCIRootFS          `json:"rootfs"`
+}
+
+type OCIContainerConfig struct {
+	User       string            `json:"User,omitempty"`
+	Env        []string          `json:"Env,omitempty"`
+	Entrypoint []string          `json:"Entrypoint,omitempty"`
+	Cmd        []string          `json:"Cmd,omitempty"`
+	WorkingDir string            `json:"WorkingDir,omitempty"`
+	Labels     map[string]string `json:"Labels,omitempty"`
+}
+
+type OCIRootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+// OCILayout is a directory in the OCI image layout format holding a single
+// image.
+type OCILayout struct {
+	Dir string
+}
+
+// CreateOCILayout creates an empty layout in dir, replacing whatever it held.
+func CreateOCILayout(dir string) (OCILayout, error) {
+	if err := os.RemoveAll(dir); err != nil {
+		return OCILayout{}, err
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0755); err != nil {
+		return OCILayout{}, err
+	}
+
+	err := ioutil.WriteFile(filepath.Join(dir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644)
+	return OCILayout{Dir: dir}, err
+}
+
+func (l OCILayout) BlobPath(digest string) string {
+	return filepath.Join(l.Dir, "blobs", strings.Replace(digest, ":", string(filepath.Separator), 1))
+}
+
+// HasBlob tells whether the blob is in the layout, which referenced blobs
+// like the stack layer are not.
+func (l OCILayout) HasBlob(digest string) bool {
+	_, err := os.Stat(l.BlobPath(digest))
+	return err == nil
+}
+
+func (l OCILayout) WriteBlob(mediaType string, contents []byte) (OCIDescriptor, error) {
+	descriptor := OCIDescriptor{
+		MediaType: mediaType,
+		Digest:    digestOf(contents),
+		Size:      int64(len(contents)),
+	}
+
+	return descriptor, ioutil.WriteFile(l.BlobPath(descriptor.Digest), contents, 0644)
+}
+
+func (l OCILayout) WriteJSONBlob(mediaType string, value interface{}) (OCIDescriptor, error) {
+	contents, err := json.Marshal(value)
+	if err != nil {
+		return OCIDescriptor{}, err
+	}
+
+	return l.WriteBlob(mediaType, contents)
+}
+
+// AddLayer moves the gzipped tarball at path into the layout and returns its
+// descriptor along with its diff ID, the digest of the uncompressed tarball.
+func (l OCILayout) AddLayer(path string) (OCIDescriptor, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return OCIDescriptor{}, "", err
+	}
+	defer file.Close()
+
+	compressed := sha256.New()
+	gzipReader, err := gzip.NewReader(io.TeeReader(file, compressed))
+	if err != nil {
+		return OCIDescriptor{}, "", err
+	}
+
+	uncompressed := sha256.New()
+	if _, err = io.Copy(uncompressed, gzipReader); err != nil {
+		return OCIDescriptor{}, "", err
+	}
+	// whatever follows the gzip stream is part of the blob too
+	if _, err = io.Copy(compressed, file); err != nil {
+		return OCIDescriptor{}, "", err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return OCIDescriptor{}, "", err
+	}
+
+	descriptor := OCIDescriptor{
+		MediaType: MediaTypeOCILayer,
+		Digest:    "sha256:" + hex.EncodeToString(compressed.Sum(nil)),
+		Size:      info.Size(),
+	}
+	file.Close()
+
+	if err = os.Rename(path, l.BlobPath(descriptor.Digest)); err != nil {
+		return OCIDescriptor{}, "", err
+	}
+
+	return descriptor, "sha256:" + hex.EncodeToString(uncompressed.Sum(nil)), nil
+}
+
+// WriteIndex makes manifest the image of the layout, tagged with tag.
+func (l OCILayout) WriteIndex(manifest OCIDescriptor, tag string) error {
+	manifest.Annotations = map[string]string{RefNameAnnotation: tag}
+	index, err := json.Marshal(OCIIndex{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIIndex,
+		Manifests:     []OCIDescriptor{manifest},
+	})
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(l.Dir, "index.json"), index, 0644)
+}
+
+// Manifest returns the manifest of the image of the layout and its
+// descriptor.
+func (l OCILayout) Manifest() (OCIManifest, OCIDescriptor, error) {
+	var index OCIIndex
+	if err := l.readJSON(filepath.Join(l.Dir, "index.json"), &index); err != nil {
+		return OCIManifest{}, OCIDescriptor{}, errors.Wrap(err, "failed to read the image index")
+	}
+	if len(index.Manifests) != 1 {
+		return OCIManifest{}, OCIDescriptor{}, fmt.Errorf("expected one image in the layout, found %d", len(index.Manifests))
+	}
+
+	var manifest OCIManifest
+	if err := l.readJSON(l.BlobPath(index.Manifests[0].Digest), &manifest); err != nil {
+		return OCIManifest{}, OCIDescriptor{}, errors.Wrap(err, "failed to read the image manifest")
+	}
+
+	return manifest, index.Manifests[0], nil
+}
+
+func (l OCILayout) ImageConfig(manifest OCIManifest) (OCIImageConfig, error) {
+	var config OCIImageConfig
+	err := l.readJSON(l.BlobPath(manifest.Config.Digest), &config)
+	return config, errors.Wrap(err, "failed to read the image config")
+}
+
+func (l OCILayout) readJSON(path string, value interface{}) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(contents, value)
+}
+
+// createImage writes the staged app as an OCI image: the stack layer it
+// runs on, a layer with everything the buildpacks placed next to the app and
+// a layer with the app itself.
+func (runner *Runner) createImage(ctx context.Context, processTypes ProcessTypes) error {
+	layout, err := CreateOCILayout(runner.config.OutputImageLocation)
+	if err != nil {
+		return err
+	}
+
+	var (
+		layers  []OCIDescriptor
+		diffIDs []string
+	)
+	if stack := runner.config.StackLayer; stack != nil {
+		layers = append(layers, stack.OCIDescriptor)
+		diffIDs = append(diffIDs, stack.DiffID)
+	}
+
+	skeleton, err := ioutil.TempDir("", "image")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(skeleton)
+
+	for _, dir := range []string{skeleton, filepath.Join(skeleton, "home"), filepath.Join(skeleton, "home", "vcap")} {
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		if err = os.Chmod(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	for _, mounts := range []map[string]string{
+		{"home/vcap": runner.contentsDir},
+		{"home/vcap/app": runner.config.BuildDir},
+	} {
+		// written next to the blobs so that adding it to the layout is a rename
+		layerPath := filepath.Join(layout.Dir, "blobs", "layer.tmp")
+		if err = runner.imageTarball().WriteWithMounts(ctx, skeleton, layerPath, mounts); err != nil {
+			return err
+		}
+
+		layer, diffID, err := layout.AddLayer(layerPath)
+		if err != nil {
+			os.Remove(layerPath)
+			return err
+		}
+		layers = append(layers, layer)
+		diffIDs = append(diffIDs, diffID)
+	}
+
+	processTypesJSON, err := json.Marshal(processTypes)
+	if err != nil {
+		return err
+	}
+
+	config, err := layout.WriteJSONBlob(MediaTypeOCIConfig, OCIImageConfig{
+		Architecture: runtime.GOARCH,
+		OS:           "linux",
+		Config: OCIContainerConfig{
+			User: "vcap",
+			Env: []string{
+				"HOME=" + imageHome + "/app",
+				"DEPS_DIR=" + imageHome + "/deps",
+				"TMPDIR=" + imageHome + "/tmp",
+				"LANG=en_US.UTF-8",
+				"PATH=/usr/local/bin:/usr/bin:/bin",
+			},
+			Entrypoint: []string{"/bin/bash", "-c", profileScript, "--"},
+			Cmd:        []string{processTypes["web"]},
+			WorkingDir: imageHome + "/app",
+			Labels: map[string]string{
+				StackLabel:        runner.config.Stack(),
+				ProcessTypesLabel: string(processTypesJSON),
+			},
+		},
+		RootFS: OCIRootFS{Type: "layers", DiffIDs: diffIDs},
+	})
+	if err != nil {
+		return err
+	}
+
+	manifest, err := layout.WriteJSONBlob(MediaTypeOCIManifest, OCIManifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIManifest,
+		Config:        config,
+		Layers:        layers,
+	})
+	if err != nil {
+		return err
+	}
+
+	return layout.WriteIndex(manifest, "latest")
+}
+
+// imageTarball owns the files of image layers by vcap, which the image runs
+// as, whether or not they are reproducible.
+func (runner *Runner) imageTarball() Tarball {
+	tarball := runner.tarball(CompressionGzip)
+	tarball.VcapOwned = true
+	return tarball
+}
+
+func digestOf(contents []byte) string {
+	sum := sha256.Sum256(contents)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,119 @@
+package builder
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// appLayerCount is the number of layers a staging adds on top of the stack:
+// the deps layer and the app layer.
+const appLayerCount = 2
+
+// Rebase swaps the stack layer of an image written by a staging for another
+// layer of the same stack, such as a patched release of it. The layers the
+// buildpacks produced are kept as they are, so no buildpack is run.
+func Rebase(layoutDir, stack string, stackLayer StackLayer) error {
+	layout := OCILayout{Dir: layoutDir}
+	manifest, manifestDescriptor, err := layout.Manifest()
+	if err != nil {
+		return err
+	}
+
+	config, err := layout.ImageConfig(manifest)
+	if err != nil {
+		return err
+	}
+
+	if len(manifest.Layers) <= appLayerCount || len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return errors.New("the image has no stack layer to replace")
+	}
+	stackLayers := manifest.Layers[:len(manifest.Layers)-appLayerCount]
+	appLayers := manifest.Layers[len(stackLayers):]
+
+	stagingInfo, err := layout.stagingInfo(appLayers[0])
+	if err != nil {
+		return err
+	}
+
+	switch label := config.Config.Labels[StackLabel]; {
+	case stagingInfo.Stack == "":
+		return errors.New("the staging info of the image does not name a stack")
+	case stagingInfo.Stack != label:
+		return fmt.Errorf("the staging info of the image names stack %s, but the image is labelled with stack %s", stagingInfo.Stack, label)
+	case stagingInfo.Stack != stack:
+		return fmt.Errorf("the image was staged for stack %s, not %s", stagingInfo.Stack, stack)
+	}
+
+	manifest.Layers = append([]OCIDescriptor{stackLayer.OCIDescriptor}, appLayers...)
+	config.RootFS.DiffIDs = append([]string{stackLayer.DiffID}, config.RootFS.DiffIDs[len(stackLayers):]...)
+
+	oldConfig := manifest.Config
+	manifest.Config, err = layout.WriteJSONBlob(MediaTypeOCIConfig, config)
+	if err != nil {
+		return err
+	}
+
+	newManifestDescriptor, err := layout.WriteJSONBlob(MediaTypeOCIManifest, manifest)
+	if err != nil {
+		return err
+	}
+
+	tag := manifestDescriptor.Annotations[RefNameAnnotation]
+	if tag == "" {
+		tag = "latest"
+	}
+	if err = layout.WriteIndex(newManifestDescriptor, tag); err != nil {
+		return err
+	}
+
+	// blobs nothing refers to anymore are dropped from the layout
+	unused := append([]OCIDescriptor{oldConfig, manifestDescriptor}, stackLayers...)
+	for _, blob := range unused {
+		if blob.Digest != stackLayer.Digest && blob.Digest != manifest.Config.Digest && blob.Digest != newManifestDescriptor.Digest {
+			if err = os.Remove(layout.BlobPath(blob.Digest)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// stagingInfo reads the staging_info.yml the staging placed in the deps
+// layer.
+func (l OCILayout) stagingInfo(depsLayer OCIDescriptor) (StagingInfo, error) {
+	var stagingInfo StagingInfo
+
+	file, err := os.Open(l.BlobPath(depsLayer.Digest))
+	if err != nil {
+		return stagingInfo, errors.Wrap(err, "failed to read the deps layer")
+	}
+	defer file.Close()
+
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		return stagingInfo, errors.Wrap(err, "failed to read the deps layer")
+	}
+
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return stagingInfo, errors.New("the image has no staging info")
+		}
+		if err != nil {
+			return stagingInfo, errors.Wrap(err, "failed to read the deps layer")
+		}
+
+		if header.Name == "."+imageHome+"/staging_info.yml" {
+			err = json.NewDecoder(tarReader).Decode(&stagingInfo)
+			return stagingInfo, errors.Wrap(err, "failed to parse the staging info")
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package builder_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/eirini-staging/builder"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Rebase", func() {
+	var (
+		tmpDir         string
+		layout         builder.OCILayout
+		oldStack       builder.StackLayer
+		newStack       builder.StackLayer
+		stagedStack    string
+		labelStack     string
+		appLayers      []builder.OCIDescriptor
+		appDiffIDs     []string
+		oldManifest    builder.OCIDescriptor
+		rebaseStack    string
+		rebaseErr      error
+		stagingInfoDir string
+	)
+
+	stackLayer := func(digest, diffID string) builder.StackLayer {
+		return builder.StackLayer{
+			OCIDescriptor: builder.OCIDescriptor{
+				MediaType: builder.MediaTypeOCIForeignLayer,
+				Digest:    digest,
+				Size:      42,
+			},
+			DiffID: diffID,
+		}
+	}
+
+	addLayer := func(dir string) {
+		layerPath := filepath.Join(tmpDir, "layer.tgz")
+		Expect(builder.Tarball{}.Write(context.Background(), dir, layerPath)).To(Succeed())
+
+		layer, diffID, err := layout.AddLayer(layerPath)
+		Expect(err).NotTo(HaveOccurred())
+		appLayers = append(appLayers, layer)
+		appDiffIDs = append(appDiffIDs, diffID)
+	}
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "rebase")
+		Expect(err).NotTo(HaveOccurred())
+
+		oldStack = stackLayer("sha256:0001", "sha256:1001")
+		newStack = stackLayer("sha256:0002", "sha256:1002")
+		stagedStack = "cflinuxfs3"
+		labelStack = "cflinuxfs3"
+		rebaseStack = "cflinuxfs3"
+		stagingInfoDir = filepath.Join("home", "vcap")
+		appLayers = nil
+		appDiffIDs = nil
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		layout, err = builder.CreateOCILayout(filepath.Join(tmpDir, "image"))
+		Expect(err).NotTo(HaveOccurred())
+
+		deps := filepath.Join(tmpDir, "deps")
+		Expect(os.MkdirAll(filepath.Join(deps, stagingInfoDir), 0755)).To(Succeed())
+		stagingInfo := `{"detected_buildpack":"Ruby","start_command":"rackup","stack":"` + stagedStack + `"}`
+		Expect(ioutil.WriteFile(filepath.Join(deps, stagingInfoDir, "staging_info.yml"), []byte(stagingInfo), 0644)).To(Succeed())
+		addLayer(deps)
+
+		app := filepath.Join(tmpDir, "app")
+		Expect(os.MkdirAll(filepath.Join(app, "home", "vcap", "app"), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(app, "home", "vcap", "app", "config.ru"), []byte("run App"), 0644)).To(Succeed())
+		addLayer(app)
+
+		config, err := layout.WriteJSONBlob(builder.MediaTypeOCIConfig, builder.OCIImageConfig{
+			OS: "linux",
+			Config: builder.OCIContainerConfig{
+				Cmd:    []string{"rackup"},
+				Labels: map[string]string{builder.StackLabel: labelStack},
+			},
+			RootFS: builder.OCIRootFS{Type: "layers", DiffIDs: append([]string{oldStack.DiffID}, appDiffIDs...)},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		oldManifest, err = layout.WriteJSONBlob(builder.MediaTypeOCIManifest, builder.OCIManifest{
+			SchemaVersion: 2,
+			MediaType:     builder.MediaTypeOCIManifest,
+			Config:        config,
+			Layers:        append([]builder.OCIDescriptor{oldStack.OCIDescriptor}, appLayers...),
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(layout.WriteIndex(oldManifest, "v1")).To(Succeed())
+
+		rebaseErr = builder.Rebase(layout.Dir, rebaseStack, newStack)
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	It("replaces the stack layer and keeps the app layers", func() {
+		Expect(rebaseErr).NotTo(HaveOccurred())
+
+		manifest, descriptor, err := layout.Manifest()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(manifest.Layers).To(Equal(append([]builder.OCIDescriptor{newStack.OCIDescriptor}, appLayers...)))
+		Expect(descriptor.Annotations[builder.RefNameAnnotation]).To(Equal("v1"))
+
+		config, err := layout.ImageConfig(manifest)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config.RootFS.DiffIDs).To(Equal(append([]string{newStack.DiffID}, appDiffIDs...)))
+		Expect(config.Config.Cmd).To(Equal([]string{"rackup"}))
+	})
+
+	It("drops the old manifest from the layout", func() {
+		Expect(layout.HasBlob(oldManifest.Digest)).To(BeFalse())
+	})
+
+	Context("when the stack of the new layer is another one", func() {
+		BeforeEach(func() {
+			rebaseStack = "cflinuxfs4"
+		})
+
+		It("refuses to rebase", func() {
+			Expect(rebaseErr).To(MatchError("the image was staged for stack cflinuxfs3, not cflinuxfs4"))
+			_, descriptor, err := layout.Manifest()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(descriptor.Digest).To(Equal(oldManifest.Digest))
+		})
+	})
+
+	Context("when the staging info does not match the image", func() {
+		BeforeEach(func() {
+			labelStack = "cflinuxfs2"
+		})
+
+		It("refuses to rebase", func() {
+			Expect(rebaseErr).To(MatchError(ContainSubstring("labelled with stack cflinuxfs2")))
+		})
+	})
+
+	Context("when the staging info does not name a stack", func() {
+		BeforeEach(func() {
+			stagedStack = ""
+		})
+
+		It("refuses to rebase", func() {
+			Expect(rebaseErr).To(MatchError(ContainSubstring("does not name a stack")))
+		})
+	})
+
+	Context("when the image has no staging info", func() {
+		BeforeEach(func() {
+			stagingInfoDir = "elsewhere"
+		})
+
+		It("refuses to rebase", func() {
+			Expect(rebaseErr).To(MatchError("the image has no staging info"))
+		})
+	})
+})
@@ -0,0 +1,104 @@
+package builder
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"time"
+)
+
+// StepsFileName is where a staging container records the steps it took, so
+// that the container that writes the staging report can include them.
+const StepsFileName = "staging_steps.json"
+
+const (
+	StepDownload = "download"
+	StepExtract  = "extract"
+	StepTar      = "tar"
+	StepUpload   = "upload"
+)
+
+// StagingReport tells where the time and memory of a staging went.
+type StagingReport struct {
+	Steps  []StepReport  `json:"steps"`
+	Phases []PhaseReport `json:"phases"`
+}
+
+type StepReport struct {
+	Step       string `json:"step"`
+	WallTimeMS int64  `json:"wall_time_ms"`
+}
+
+type PhaseReport struct {
+	Phase           Phase  `json:"phase"`
+	Buildpack       string `json:"buildpack"`
+	ExitCode        int    `json:"exit_code"`
+	WallTimeMS      int64  `json:"wall_time_ms"`
+	UserCPUTimeMS   int64  `json:"user_cpu_time_ms"`
+	SystemCPUTimeMS int64  `json:"system_cpu_time_ms"`
+	PeakRSSBytes    int64  `json:"peak_rss_bytes"`
+}
+
+func NewStepReport(step string, wallTime time.Duration) StepReport {
+	return StepReport{Step: step, WallTimeMS: milliseconds(wallTime)}
+}
+
+// newPhaseReport reads the resource usage of a buildpack script that has been
+// waited for. Usage includes the processes the script started and waited for.
+func newPhaseReport(phase Phase, buildpack string, wallTime time.Duration, state *os.ProcessState) PhaseReport {
+	report := PhaseReport{
+		Phase:           phase,
+		Buildpack:       buildpack,
+		ExitCode:        state.ExitCode(),
+		WallTimeMS:      milliseconds(wallTime),
+		UserCPUTimeMS:   milliseconds(state.UserTime()),
+		SystemCPUTimeMS: milliseconds(state.SystemTime()),
+	}
+
+	if usage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		// the kernel reports the peak resident set size in kilobytes
+		report.PeakRSSBytes = usage.Maxrss * 1024
+	}
+
+	return report
+}
+
+// TimeStep runs step and returns how long it took alongside its error.
+func TimeStep(step string, fn func() error) (StepReport, error) {
+	start := time.Now()
+	err := fn()
+	return NewStepReport(step, time.Since(start)), err
+}
+
+// ReadStepReports reads the steps recorded at path. Nothing recorded is not
+// an error, as the report is informational only.
+func ReadStepReports(path string) ([]StepReport, error) {
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var steps []StepReport
+	if err = json.Unmarshal(contents, &steps); err != nil {
+		return nil, err
+	}
+
+	return steps, nil
+}
+
+func WriteStepReports(path string, steps []StepReport) error {
+	contents, err := json.Marshal(steps)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, contents, 0644)
+}
+
+func milliseconds(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
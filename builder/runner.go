@@ -2,6 +2,7 @@ package builder
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/json"
 	"fmt"
@@ -12,35 +13,56 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
 	yaml "gopkg.in/yaml.v2"
 )
 
 type Runner struct {
-	config       *Config
-	depsDir      string
-	contentsDir  string
-	profileDir   string
-	BuildpackOut io.Writer
-	BuildpackErr io.Writer
+	config        *Config
+	lifecycleType string
+	depsDir       string
+	contentsDir   string
+	profileDir    string
+	certsDir      string
+	platformEnv   map[string]string
+	report        StagingReport
+	BuildpackOut  io.Writer
+	BuildpackErr  io.Writer
 }
 
 func NewRunner(config *Config) *Runner {
 	return &Runner{
-		config:       config,
-		BuildpackOut: os.Stdout,
-		BuildpackErr: os.Stderr,
+		config:        config,
+		lifecycleType: LifecycleTypeBuildpack,
+		platformEnv:   map[string]string{},
+		BuildpackOut:  os.Stdout,
+		BuildpackErr:  os.Stderr,
 	}
 }
 
-func (runner *Runner) Run() error {
+// Run stages the app. Buildpack scripts are killed, together with everything
+// they started, once ctx is done or their phase exceeds its timeout.
+func (runner *Runner) Run(ctx context.Context) error {
+	if runner.config.StagingTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, runner.config.StagingTimeout)
+		defer cancel()
+	}
+
 	//set up the world
 	err := runner.makeDirectories()
 	if err != nil {
 		return errors.Wrap(err, "Failed to set up filesystem when generating droplet")
 	}
 
+	err = runner.setUpTrustedCerts()
+	if err != nil {
+		return errors.Wrap(err, "Failed to set up trusted certificates")
+	}
+
 	//detect, compile, release
 	log.Println("Cleaning cache dir")
 	err = runner.cleanCacheDir()
@@ -49,13 +71,14 @@ func (runner *Runner) Run() error {
 	}
 
 	log.Println("Detecting buidlpack")
-	detectedBuildpackDir, buildpackMetadata, err := runner.supplyOrDetect()
+	detectedBuildpackDir, buildpackMetadata, err := runner.supplyOrDetect(ctx)
 	if err != nil {
 		// detect buildpack returns custom error
 		return err
 	}
 
-	if err = runner.runFinalize(detectedBuildpackDir); err != nil {
+	finalBuildpack := buildpackMetadata[len(buildpackMetadata)-1].Key
+	if err = runner.runFinalize(ctx, detectedBuildpackDir, finalBuildpack); err != nil {
 		// runFinalize returns custom error
 		return err
 	}
@@ -66,69 +89,98 @@ func (runner *Runner) Run() error {
 	}
 
 	log.Println("Building droplet release")
-	releaseInfo, err := runner.release(detectedBuildpackDir)
+	releaseInfo, err := runner.release(ctx, detectedBuildpackDir, finalBuildpack)
+	if isInterruption(err) {
+		return err
+	}
 	if err != nil {
 		return NewReleaseFailError(errors.Wrap(err, "Failed to build droplet release"))
 	}
 
-	err = runner.writeStagingInfoYML(releaseInfo.DefaultProcessTypes["web"], buildpackMetadata)
+	return runner.createDroplet(ctx, buildpackMetadata, releaseInfo)
+}
+
+// createDroplet writes the droplet, the build artifacts cache and the staging
+// result once the buildpacks are done.
+func (runner *Runner) createDroplet(ctx context.Context, buildpackMetadata []BuildpackMetadata, releaseInfo Release) error {
+	err := runner.writeStagingInfoYML(releaseInfo.DefaultProcessTypes["web"], buildpackMetadata)
 	if err != nil {
 		return errors.Wrap(err, "unable to build staging info for the droplet")
 	}
 
-	tarPath, err := runner.findTar()
-	if err != nil {
-		return err
+	if ctx.Err() == context.Canceled {
+		return NewCancelledError(errors.New("staging was interrupted before creating the droplet"))
 	}
 
 	log.Println("Creating app artifact")
-	err = runner.createArtifacts(tarPath, buildpackMetadata, releaseInfo)
-	if err != nil {
-		return errors.Wrap(err, "failed to find runnable app artifact")
+	tarStep, err := TimeStep(StepTar, func() error {
+		if err := runner.createArtifacts(ctx, releaseInfo.DefaultProcessTypes); err != nil {
+			return errors.Wrap(err, "failed to find runnable app artifact")
+		}
+
+		return errors.Wrap(runner.createCache(ctx), "failed to cache runnable app artifact")
+	})
+	switch {
+	case err == nil:
+	case ctx.Err() == context.Canceled:
+		return NewCancelledError(errors.Wrap(err, "staging was interrupted while creating the droplet"))
+	case ctx.Err() == context.DeadlineExceeded:
+		return NewTimeoutError(StepTar, err)
+	default:
+		return err
 	}
+	runner.RecordSteps(tarStep)
 
-	err = runner.createCache(tarPath)
+	err = runner.saveInfo(buildpackMetadata, releaseInfo)
 	if err != nil {
-		return errors.Wrap(err, "failed to cache runnable app artifact")
+		return errors.Wrap(err, "Failed to encode generated metadata")
 	}
 
 	return nil
 }
 
+// RecordSteps adds steps taken outside of the runner, like downloading the
+// app, to the staging report.
+func (runner *Runner) RecordSteps(steps ...StepReport) {
+	runner.report.Steps = append(runner.report.Steps, steps...)
+}
+
 func (runner *Runner) CleanUp() {
+	if runner.certsDir != "" {
+		os.RemoveAll(runner.certsDir)
+	}
 	if runner.contentsDir == "" {
 		return
 	}
 	os.RemoveAll(runner.contentsDir)
 }
 
-func (runner *Runner) supplyOrDetect() (string, []BuildpackMetadata, error) {
+func (runner *Runner) supplyOrDetect(ctx context.Context) (string, []BuildpackMetadata, error) {
 	if runner.config.SkipDetect {
-		return runner.runSupplyBuildpacks()
+		return runner.runSupplyBuildpacks(ctx)
 	}
 
-	return runner.detect()
+	return runner.detect(ctx)
 }
 
-func (runner *Runner) createArtifacts(tarPath string, buildpackMetadata []BuildpackMetadata, releaseInfo Release) error {
-	err := runner.saveInfo(buildpackMetadata, releaseInfo)
-	if err != nil {
-		return errors.Wrap(err, "Failed to encode generated metadata")
-	}
-
+func (runner *Runner) createArtifacts(ctx context.Context, processTypes ProcessTypes) error {
 	for _, name := range []string{"tmp", "logs"} {
-		if err = os.MkdirAll(filepath.Join(runner.contentsDir, name), 0755); err != nil {
+		if err := os.MkdirAll(filepath.Join(runner.contentsDir, name), 0755); err != nil {
 			return errors.Wrap(err, "Failed to set up droplet filesystem")
 		}
 	}
 
-	appDir := filepath.Join(runner.contentsDir, "app")
-	err = runner.copyApp(runner.config.BuildDir, appDir)
-	if err != nil {
-		return errors.Wrap(err, "Failed to copy compiled droplet")
+	switch runner.config.OutputFormat {
+	case OutputFormatOCI:
+		return errors.Wrap(runner.createImage(ctx, processTypes), "Failed to write the app image")
+	case OutputFormatLayered:
+		return errors.Wrap(runner.createLayers(ctx), "Failed to write the droplet layers")
 	}
 
-	err = exec.Command(tarPath, "-czf", runner.config.OutputDropletLocation, "-C", runner.contentsDir, ".").Run()
+	// the compiled app is streamed into the droplet instead of being copied
+	// into the contents dir first
+	mounts := map[string]string{"app": runner.config.BuildDir}
+	err := runner.tarball(CompressionGzip).WriteWithMounts(ctx, runner.contentsDir, runner.config.OutputDropletLocation, mounts)
 	if err != nil {
 		return errors.Wrap(err, "Failed to compress droplet filesystem")
 	}
@@ -136,13 +188,13 @@ func (runner *Runner) createArtifacts(tarPath string, buildpackMetadata []Buildp
 	return nil
 }
 
-func (runner *Runner) createCache(tarPath string) error {
+func (runner *Runner) createCache(ctx context.Context) error {
 	err := os.MkdirAll(filepath.Dir(runner.config.OutputBuildArtifactsCache), 0755)
 	if err != nil {
 		return errors.Wrap(err, "Failed to create output build artifacts cache dir")
 	}
 
-	err = exec.Command(tarPath, "-czf", runner.config.OutputBuildArtifactsCache, "-C", runner.config.BuildArtifactsCacheDir(), ".").Run()
+	err = runner.tarball(runner.config.CacheCompression).Write(ctx, runner.config.BuildArtifactsCacheDir(), runner.config.OutputBuildArtifactsCache)
 	if err != nil {
 		return errors.Wrap(err, "Failed to compress build artifacts")
 	}
@@ -151,9 +203,12 @@ func (runner *Runner) createCache(tarPath string) error {
 }
 
 func (runner *Runner) buildpacksMetadata(buildpacks []string) []BuildpackMetadata {
+	revisions := runner.buildpackRevisions()
+
 	data := make([]BuildpackMetadata, len(buildpacks))
 	for i, key := range buildpacks {
 		data[i].Key = key
+		data[i].Revision = revisions[key]
 		configPath := filepath.Join(runner.depsDir, runner.config.DepsIndex(i), "config.yml")
 		if contents, err := ioutil.ReadFile(configPath); err == nil {
 			configyaml := struct {
@@ -169,6 +224,23 @@ func (runner *Runner) buildpacksMetadata(buildpacks []string) []BuildpackMetadat
 	return data
 }
 
+// buildpackRevisions returns the git commits the downloader cloned buildpacks
+// at. Archive buildpacks have no revision, so a missing file is not an error.
+func (runner *Runner) buildpackRevisions() map[string]string {
+	revisions := map[string]string{}
+
+	contents, err := ioutil.ReadFile(filepath.Join(runner.config.BuildpacksDir, RevisionsFileName))
+	if err != nil {
+		return revisions
+	}
+
+	if err := json.Unmarshal(contents, &revisions); err != nil {
+		logError(fmt.Sprintf("failed to read buildpack revisions: %s", err.Error()))
+	}
+
+	return revisions
+}
+
 func (runner *Runner) makeDirectories() error {
 	if err := os.MkdirAll(filepath.Dir(runner.config.OutputDropletLocation), 0755); err != nil {
 		return err
@@ -279,7 +351,12 @@ func fileExists(file string) (bool, error) {
 	return true, nil
 }
 
-func (runner *Runner) runSupplyBuildpacks() (string, []BuildpackMetadata, error) {
+func (runner *Runner) runSupplyBuildpacks(ctx context.Context) (string, []BuildpackMetadata, error) {
+	if err := runner.checkStacks(); err != nil {
+		logError(err.Error())
+		return "", nil, err
+	}
+
 	if err := runner.validateSupplyBuildpacks(); err != nil {
 		return "", nil, err
 	}
@@ -290,7 +367,10 @@ func (runner *Runner) runSupplyBuildpacks() (string, []BuildpackMetadata, error)
 			return "", nil, NewSupplyFailError(err)
 		}
 
-		err = runner.run(exec.Command(filepath.Join(buildpackPath, "bin", "supply"), runner.config.BuildDir, runner.supplyCachePath(buildpack), runner.depsDir, runner.config.DepsIndex(i)))
+		err = runner.run(ctx, PhaseSupply, buildpack, exec.Command(filepath.Join(buildpackPath, "bin", "supply"), runner.config.BuildDir, runner.supplyCachePath(buildpack), runner.depsDir, runner.config.DepsIndex(i)))
+		if isInterruption(err) {
+			return "", nil, err
+		}
 		if err != nil {
 			logError(fmt.Sprintf("supply script failed %s", err.Error()))
 			return "", nil, NewSupplyFailError(err)
@@ -326,7 +406,7 @@ func (runner *Runner) validateSupplyBuildpacks() error {
 	return nil
 }
 
-func (runner *Runner) runFinalize(buildpackPath string) error {
+func (runner *Runner) runFinalize(ctx context.Context, buildpackPath, buildpack string) error {
 	depsIdx := runner.config.DepsIndex(len(runner.config.SupplyBuildpacks()))
 	cacheDir := filepath.Join(runner.config.BuildArtifactsCacheDir(), "final")
 
@@ -342,12 +422,20 @@ func (runner *Runner) runFinalize(buildpackPath string) error {
 		}
 
 		if hasSupply {
-			if err := runner.run(exec.Command(filepath.Join(buildpackPath, "bin", "supply"), runner.config.BuildDir, cacheDir, runner.depsDir, depsIdx)); err != nil {
+			err := runner.run(ctx, PhaseSupply, buildpack, exec.Command(filepath.Join(buildpackPath, "bin", "supply"), runner.config.BuildDir, cacheDir, runner.depsDir, depsIdx))
+			if isInterruption(err) {
+				return err
+			}
+			if err != nil {
 				return NewSupplyFailError(err)
 			}
 		}
 
-		if err := runner.run(exec.Command(filepath.Join(buildpackPath, "bin", "finalize"), runner.config.BuildDir, cacheDir, runner.depsDir, depsIdx, runner.profileDir)); err != nil {
+		err = runner.run(ctx, PhaseFinalize, buildpack, exec.Command(filepath.Join(buildpackPath, "bin", "finalize"), runner.config.BuildDir, cacheDir, runner.depsDir, depsIdx, runner.profileDir))
+		if isInterruption(err) {
+			return err
+		}
+		if err != nil {
 			return NewFinalizeFailError(err)
 		}
 	} else {
@@ -360,7 +448,11 @@ func (runner *Runner) runFinalize(buildpackPath string) error {
 			return NewCompileFailError(err)
 		}
 
-		if err := runner.run(exec.Command(filepath.Join(buildpackPath, "bin", "compile"), runner.config.BuildDir, cacheDir)); err != nil {
+		err := runner.run(ctx, PhaseCompile, buildpack, exec.Command(filepath.Join(buildpackPath, "bin", "compile"), runner.config.BuildDir, cacheDir))
+		if isInterruption(err) {
+			return err
+		}
+		if err != nil {
 			logError(fmt.Sprintf("compile script failed %s", err.Error()))
 			return NewCompileFailError(errors.Wrap(err, "failed to compile droplet"))
 		}
@@ -369,7 +461,7 @@ func (runner *Runner) runFinalize(buildpackPath string) error {
 	return nil
 }
 
-func (runner *Runner) detect() (string, []BuildpackMetadata, error) {
+func (runner *Runner) detect(ctx context.Context) (string, []BuildpackMetadata, error) {
 	for _, buildpack := range runner.config.BuildpackOrder {
 		buildpackPath, err := runner.buildpackPath(buildpack)
 		if err != nil {
@@ -377,12 +469,20 @@ func (runner *Runner) detect() (string, []BuildpackMetadata, error) {
 			continue
 		}
 
+		if err = checkStack(buildpackPath, runner.config.Stack()); err != nil {
+			log.Printf("Skipping buildpack %s: %s", buildpack, err.Error())
+			continue
+		}
+
 		if err = runner.warnIfDetectNotExecutable(buildpackPath); err != nil {
 			logError(err.Error())
 			continue
 		}
 
-		output, err := runner.runWithCapturing(exec.Command(filepath.Join(buildpackPath, "bin", "detect"), runner.config.BuildDir))
+		output, err := runner.runWithCapturing(ctx, PhaseDetect, buildpack, exec.Command(filepath.Join(buildpackPath, "bin", "detect"), runner.config.BuildDir))
+		if isInterruption(err) {
+			return "", nil, err
+		}
 
 		if err == nil {
 			buildpacks := runner.buildpacksMetadata([]string{buildpack})
@@ -419,13 +519,16 @@ func (runner *Runner) readProcfile() (map[string]string, error) {
 	return processes, nil
 }
 
-func (runner *Runner) release(buildpackDir string) (Release, error) {
+func (runner *Runner) release(ctx context.Context, buildpackDir, buildpack string) (Release, error) {
 	startCommands, err := runner.readProcfile()
 	if err != nil {
 		return Release{}, errors.Wrap(err, "Failed to read command from Procfile")
 	}
 
-	output, err := runner.runWithCapturing(exec.Command(filepath.Join(buildpackDir, "bin", "release"), runner.config.BuildDir))
+	output, err := runner.runWithCapturing(ctx, PhaseRelease, buildpack, exec.Command(filepath.Join(buildpackDir, "bin", "release"), runner.config.BuildDir))
+	if isInterruption(err) {
+		return Release{}, err
+	}
 	if err != nil {
 		return Release{}, errors.Wrap(err, "no release script")
 	}
@@ -467,33 +570,104 @@ func (runner *Runner) saveInfo(buildpacks []BuildpackMetadata, releaseInfo Relea
 	}
 	defer resultFile.Close()
 
-	return json.NewEncoder(resultFile).Encode(NewStagingResult(
+	result := NewStagingResult(
 		releaseInfo.DefaultProcessTypes,
 		LifecycleMetadata{
 			BuildpackKey:      lastBuildpack.Key,
 			DetectedBuildpack: lastBuildpack.Name,
 			Buildpacks:        buildpacks,
 		},
-	))
+		runner.report,
+	)
+	result.LifecycleType = runner.lifecycleType
+
+	return json.NewEncoder(resultFile).Encode(result)
 }
 
-func (runner *Runner) run(cmd *exec.Cmd) error {
+func (runner *Runner) run(ctx context.Context, phase Phase, buildpack string, cmd *exec.Cmd) error {
 	cmd.Stdout = runner.BuildpackOut
 	cmd.Stderr = runner.BuildpackErr
+	cmd.Env = runner.config.buildpackEnv(runner.platformEnv)
 
-	return cmd.Run()
+	return runner.measure(ctx, phase, buildpack, cmd)
 }
 
-func (runner *Runner) runWithCapturing(cmd *exec.Cmd) (*bytes.Buffer, error) {
+func (runner *Runner) runWithCapturing(ctx context.Context, phase Phase, buildpack string, cmd *exec.Cmd) (*bytes.Buffer, error) {
 	output := new(bytes.Buffer)
 	cmd.Stdout = output
 	cmd.Stderr = runner.BuildpackErr
+	cmd.Env = runner.config.buildpackEnv(runner.platformEnv)
+
+	return output, runner.measure(ctx, phase, buildpack, cmd)
+}
+
+// measure runs cmd and adds its resource usage to the staging report, unless
+// it was never started.
+func (runner *Runner) measure(ctx context.Context, phase Phase, buildpack string, cmd *exec.Cmd) error {
+	start := time.Now()
+	err := runner.runInProcessGroup(ctx, phase, cmd)
+	if cmd.ProcessState != nil {
+		runner.report.Phases = append(runner.report.Phases, newPhaseReport(phase, buildpack, time.Since(start), cmd.ProcessState))
+	}
 
-	return output, cmd.Run()
+	return err
 }
 
-func (runner *Runner) copyApp(buildDir, stageDir string) error {
-	return runner.run(exec.Command("cp", "-a", buildDir, stageDir))
+// runInProcessGroup runs cmd in a process group of its own, so that when ctx
+// is done or the phase times out whatever the script started is stopped too.
+// On cancellation the group gets the grace period to exit after SIGTERM.
+func (runner *Runner) runInProcessGroup(ctx context.Context, phase Phase, cmd *exec.Cmd) error {
+	timeout := runner.config.PhaseTimeouts[phase]
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	if err := ctx.Err(); err == context.DeadlineExceeded {
+		return NewTimeoutError(phase, err)
+	} else if err != nil {
+		return NewCancelledError(fmt.Errorf("%s was not started: %s", phase, err.Error()))
+	}
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		runner.signalProcessGroup(phase, cmd, syscall.SIGKILL)
+		<-done
+		return NewTimeoutError(phase, ctx.Err())
+	}
+
+	log.Printf("Stopping %s", phase)
+	runner.signalProcessGroup(phase, cmd, syscall.SIGTERM)
+	select {
+	case <-done:
+	case <-time.After(runner.config.KillGracePeriod):
+		runner.signalProcessGroup(phase, cmd, syscall.SIGKILL)
+		<-done
+	}
+
+	return NewCancelledError(fmt.Errorf("%s was interrupted: %s", phase, ctx.Err().Error()))
+}
+
+func (runner *Runner) signalProcessGroup(phase Phase, cmd *exec.Cmd, signal syscall.Signal) {
+	if err := syscall.Kill(-cmd.Process.Pid, signal); err != nil && err != syscall.ESRCH {
+		logError(fmt.Sprintf("failed to signal the %s process group: %s", phase, err.Error()))
+	}
 }
 
 func (runner *Runner) warnIfDetectNotExecutable(buildpackPath string) error {
@@ -509,12 +683,12 @@ func (runner *Runner) warnIfDetectNotExecutable(buildpackPath string) error {
 	return nil
 }
 
-func (runner *Runner) findTar() (string, error) {
-	tarPath, err := exec.LookPath("tar")
-	if err != nil {
-		return "", err
+func (runner *Runner) tarball(compression Compression) Tarball {
+	return Tarball{
+		Reproducible: runner.config.ReproducibleArchives,
+		Compression:  compression,
+		Level:        runner.config.CompressionLevel,
 	}
-	return tarPath, nil
 }
 
 func (runner *Runner) writeStagingInfoYML(startCommand string, buildpacks []BuildpackMetadata) error {
@@ -533,5 +707,6 @@ func (runner *Runner) writeStagingInfoYML(startCommand string, buildpacks []Buil
 	return json.NewEncoder(stagingInfoFile).Encode(StagingInfo{
 		DetectedBuildpack: lastBuildpack.Name,
 		StartCommand:      startCommand,
+		Stack:             runner.config.Stack(),
 	})
 }
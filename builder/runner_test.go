@@ -1,16 +1,21 @@
 package builder_test
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"code.cloudfoundry.org/eirini-staging/builder"
 
@@ -31,6 +36,17 @@ var _ = Describe("Building", func() {
 		outputBuildArtifactsCache string
 		skipDetect                bool
 		buildpackOrder            string
+		stagingTimeout            time.Duration
+		killGracePeriod           time.Duration
+		recordSteps               []builder.StepReport
+		stagingEnv                builder.StagingEnvironment
+		trustedCertsDir           string
+		ctx                       context.Context
+		phaseTimeouts             map[builder.Phase]time.Duration
+		outputFormat              string
+		outputImage               string
+		outputLayers              string
+		stackLayer                *builder.StackLayer
 
 		runner *builder.Runner
 		logOut *gbytes.Buffer
@@ -72,6 +88,17 @@ var _ = Describe("Building", func() {
 		Expect(outputMetadataFile.Close()).To(Succeed())
 
 		skipDetect = false
+		stagingTimeout = 0
+		killGracePeriod = 0
+		recordSteps = nil
+		stagingEnv = builder.StagingEnvironment{}
+		trustedCertsDir = ""
+		ctx = context.Background()
+		phaseTimeouts = nil
+		outputFormat = ""
+		outputImage = filepath.Join(tmpDir, "image")
+		outputLayers = filepath.Join(tmpDir, "layers")
+		stackLayer = nil
 		logOut = gbytes.NewBuffer()
 		log.SetOutput(logOut)
 	})
@@ -92,19 +119,47 @@ var _ = Describe("Building", func() {
 			BuildpackOrder:            strings.Split(buildpackOrder, ","),
 			BuildArtifactsCache:       "/tmp/cache",
 			SkipDetect:                skipDetect,
+			StagingTimeout:            stagingTimeout,
+			PhaseTimeouts:             phaseTimeouts,
+			KillGracePeriod:           killGracePeriod,
+			StagingEnv:                stagingEnv,
+			TrustedCertsDir:           trustedCertsDir,
+			OutputFormat:              outputFormat,
+			OutputImageLocation:       outputImage,
+			OutputLayersLocation:      outputLayers,
+			StackLayer:                stackLayer,
 		}
 
 		runner = builder.NewRunner(&conf)
 		runner.BuildpackOut = GinkgoWriter
 		runner.BuildpackErr = GinkgoWriter
-		userFacingError = runner.Run()
+		runner.RecordSteps(recordSteps...)
+		userFacingError = runner.Run(ctx)
 
 	})
 
+	stagingReport := func() builder.StagingReport {
+		resultInfo, err := ioutil.ReadFile(outputMetadata)
+		Expect(err).NotTo(HaveOccurred())
+
+		var stagingResult builder.StagingResult
+		Expect(json.Unmarshal(resultInfo, &stagingResult)).To(Succeed())
+		Expect(stagingResult.StagingReport).NotTo(BeNil())
+		return *stagingResult.StagingReport
+	}
+
+	// resultJSON leaves the staging report out, as its timings differ from
+	// one run to the next
 	resultJSON := func() []byte {
 		resultInfo, err := ioutil.ReadFile(outputMetadata)
 		Expect(err).NotTo(HaveOccurred())
 
+		var result map[string]interface{}
+		Expect(json.Unmarshal(resultInfo, &result)).To(Succeed())
+		delete(result, "staging_report")
+
+		resultInfo, err = json.Marshal(result)
+		Expect(err).NotTo(HaveOccurred())
 		return resultInfo
 	}
 
@@ -226,6 +281,50 @@ var _ = Describe("Building", func() {
 				}`))
 				})
 
+				It("reports the resource usage of every buildpack script", func() {
+					report := stagingReport()
+					Expect(report.Phases).To(HaveLen(3))
+
+					for i, phase := range []builder.Phase{builder.PhaseDetect, builder.PhaseCompile, builder.PhaseRelease} {
+						Expect(report.Phases[i].Phase).To(Equal(phase))
+						Expect(report.Phases[i].Buildpack).To(Equal("always-detects"))
+						Expect(report.Phases[i].ExitCode).To(BeZero())
+						Expect(report.Phases[i].WallTimeMS).To(BeNumerically(">=", 0))
+						Expect(report.Phases[i].PeakRSSBytes).To(BeNumerically(">", 0))
+					}
+				})
+
+				It("reports the time it took to create the droplet", func() {
+					report := stagingReport()
+					Expect(report.Steps).To(HaveLen(1))
+					Expect(report.Steps[0].Step).To(Equal(builder.StepTar))
+				})
+
+				Context("when steps were taken before the runner ran", func() {
+					BeforeEach(func() {
+						extract := builder.NewStepReport(builder.StepExtract, 1500*time.Millisecond)
+						recordSteps = []builder.StepReport{extract}
+					})
+
+					It("reports them first", func() {
+						Expect(stagingReport().Steps).To(HaveLen(2))
+						Expect(stagingReport().Steps[0]).To(Equal(builder.StepReport{Step: "extract", WallTimeMS: 1500}))
+					})
+				})
+
+				Context("when the buildpack was cloned from git", func() {
+					BeforeEach(func() {
+						revisions := `{"always-detects": "4b825dc642cb6eb9a060e54bf8d69288fbee4904"}`
+						Expect(ioutil.WriteFile(filepath.Join(buildpacksDir, builder.RevisionsFileName), []byte(revisions), 0644)).To(Succeed())
+					})
+
+					It("records the revision of the buildpack", func() {
+						Expect(resultJSONbuildpacks()).To(MatchJSON(`[
+							{"key": "always-detects", "name": "Always Matching", "revision": "4b825dc642cb6eb9a060e54bf8d69288fbee4904"}
+						]`))
+					})
+				})
+
 				Context("when the app has a Procfile", func() {
 					BeforeEach(func() {
 						cp(filepath.Join(appFixtures, "with-procfile-with-web", "Procfile"), buildDir)
@@ -876,6 +975,485 @@ var _ = Describe("Building", func() {
 		})
 	})
 
+	Context("with buildpacks for another stack", func() {
+		BeforeEach(func() {
+			stagingEnv.Stack = "cflinuxfs3"
+			buildpackOrder = "cflinuxfs2-only,cflinuxfs2-dependencies,always-detects"
+			cpBuildpack("cflinuxfs2-only")
+			cpBuildpack("cflinuxfs2-dependencies")
+			cpBuildpack("always-detects")
+			cp(filepath.Join(appFixtures, "bash-app", "app.sh"), buildDir)
+		})
+
+		It("skips them during detection", func() {
+			Expect(userFacingError).NotTo(HaveOccurred())
+			Expect(resultJSONbuildpacks()).To(MatchJSON(`[{"key": "always-detects", "name": "Always Matching"}]`))
+		})
+
+		It("logs why they were skipped", func() {
+			Expect(logOut).To(gbytes.Say("Skipping buildpack cflinuxfs2-only: it only supports stack cflinuxfs2, not cflinuxfs3"))
+			Expect(logOut).To(gbytes.Say("Skipping buildpack cflinuxfs2-dependencies: none of its dependencies support stack cflinuxfs3"))
+		})
+
+		Context("when the stack is not known", func() {
+			BeforeEach(func() {
+				stagingEnv.Stack = ""
+				Expect(os.Unsetenv("CF_STACK")).To(Succeed())
+			})
+
+			It("does not skip them", func() {
+				Expect(userFacingError).NotTo(HaveOccurred())
+				Expect(resultJSONbuildpacks()).To(MatchJSON(`[{"key": "cflinuxfs2-only", "name": "cflinuxfs2 only"}]`))
+			})
+		})
+
+		Context("when the buildpack supports the stack", func() {
+			BeforeEach(func() {
+				stagingEnv.Stack = "cflinuxfs2"
+			})
+
+			It("detects it", func() {
+				Expect(userFacingError).NotTo(HaveOccurred())
+				Expect(resultJSONbuildpacks()).To(MatchJSON(`[{"key": "cflinuxfs2-only", "name": "cflinuxfs2 only"}]`))
+			})
+		})
+
+		Context("when detection is skipped", func() {
+			BeforeEach(func() {
+				skipDetect = true
+				buildpackOrder = "always-detects,cflinuxfs2-dependencies"
+			})
+
+			It("fails before running any buildpack", func() {
+				Expect(userFacingError).To(HaveOccurred())
+				Expect(userFacingError.(builder.DescriptiveError).ExitCode).To(Equal(builder.StackFailCode))
+				Expect(userFacingError.(builder.DescriptiveError).Message).To(Equal(builder.StackFailMsg))
+				Expect(userFacingError).To(MatchError(ContainSubstring("buildpack cflinuxfs2-dependencies cannot be used: none of its dependencies support stack cflinuxfs3")))
+				Expect(filepath.Join(buildDir, "compiled")).NotTo(BeAnExistingFile())
+			})
+		})
+	})
+
+	Context("with a staging environment", func() {
+		var compileEnv []string
+
+		BeforeEach(func() {
+			buildpackOrder = "dumps-env"
+			cpBuildpack("dumps-env")
+			cp(filepath.Join(appFixtures, "bash-app", "app.sh"), buildDir)
+
+			stagingEnv = builder.StagingEnvironment{
+				Environment: map[string]string{
+					"BP_DEBUG":       "true",
+					"MEMORY_LIMIT":   "1m",
+					"JBP_CONFIG_JRE": "{jre: {version: 11.+}}",
+				},
+				VcapApplication: json.RawMessage(`{"application_name":"my-app"}`),
+				VcapServices:    json.RawMessage(`{}`),
+				Stack:           "cflinuxfs3",
+				MemoryLimit:     "1024m",
+			}
+
+			Expect(os.Setenv("CF_PASSWORD", "hunter2")).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(os.Unsetenv("CF_PASSWORD")).To(Succeed())
+		})
+
+		JustBeforeEach(func() {
+			Expect(userFacingError).NotTo(HaveOccurred())
+			contents, err := ioutil.ReadFile(filepath.Join(buildDir, "compile.env"))
+			Expect(err).NotTo(HaveOccurred())
+			compileEnv = strings.Split(strings.TrimSpace(string(contents)), "\n")
+		})
+
+		It("passes the app environment to the buildpack", func() {
+			Expect(compileEnv).To(ContainElement("BP_DEBUG=true"))
+			Expect(compileEnv).To(ContainElement("JBP_CONFIG_JRE={jre: {version: 11.+}}"))
+		})
+
+		It("passes the variables Cloud Controller sets", func() {
+			Expect(compileEnv).To(ContainElement(`VCAP_APPLICATION={"application_name":"my-app"}`))
+			Expect(compileEnv).To(ContainElement("VCAP_SERVICES={}"))
+			Expect(compileEnv).To(ContainElement("CF_STACK=cflinuxfs3"))
+			Expect(compileEnv).To(ContainElement("MEMORY_LIMIT=1024m"))
+		})
+
+		It("keeps PATH", func() {
+			Expect(compileEnv).To(ContainElement("PATH=" + os.Getenv("PATH")))
+		})
+
+		It("does not leak the environment of the executor", func() {
+			for _, variable := range compileEnv {
+				Expect(variable).NotTo(HavePrefix("CF_PASSWORD="))
+			}
+		})
+
+		It("does not set up trusted certificates", func() {
+			for _, variable := range compileEnv {
+				Expect(variable).NotTo(HavePrefix("SSL_CERT_FILE="))
+			}
+		})
+
+		Context("with trusted certificates", func() {
+			var certPEM []byte
+
+			BeforeEach(func() {
+				server := httptest.NewTLSServer(http.NotFoundHandler())
+				defer server.Close()
+				certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+
+				trustedCertsDir = filepath.Join(tmpDir, "trusted-certs")
+				Expect(os.MkdirAll(trustedCertsDir, 0755)).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(trustedCertsDir, "proxy.crt"), certPEM, 0644)).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(trustedCertsDir, "README"), []byte("not a cert"), 0644)).To(Succeed())
+			})
+
+			It("points the TLS variables to a bundle", func() {
+				for _, name := range []string{"SSL_CERT_FILE", "CURL_CA_BUNDLE", "GIT_SSL_CAINFO", "NODE_EXTRA_CA_CERTS", "REQUESTS_CA_BUNDLE"} {
+					Expect(compileEnv).To(ContainElement(HavePrefix(name + "=")))
+				}
+			})
+
+			It("adds the trusted certificates to the system ones in the bundle", func() {
+				bundle, err := ioutil.ReadFile(filepath.Join(buildDir, "bundle.crt"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(bundle)).To(HaveSuffix(string(certPEM)))
+
+				systemBundle, err := ioutil.ReadFile("/etc/ssl/certs/ca-certificates.crt")
+				if err == nil {
+					Expect(string(bundle)).To(HavePrefix(string(systemBundle)))
+				}
+			})
+
+			It("places each trusted certificate in CF_SYSTEM_CERT_PATH", func() {
+				Expect(compileEnv).To(ContainElement(HavePrefix("CF_SYSTEM_CERT_PATH=")))
+				Expect(filepath.Join(buildDir, "system-certs", "proxy.crt")).To(BeAnExistingFile())
+				Expect(filepath.Join(buildDir, "system-certs", "README")).NotTo(BeAnExistingFile())
+			})
+
+			It("removes them when cleaning up", func() {
+				var certsDir string
+				for _, variable := range compileEnv {
+					if strings.HasPrefix(variable, "CF_SYSTEM_CERT_PATH=") {
+						certsDir = filepath.Dir(strings.TrimPrefix(variable, "CF_SYSTEM_CERT_PATH="))
+					}
+				}
+				Expect(certsDir).To(BeADirectory())
+
+				runner.CleanUp()
+				Expect(certsDir).NotTo(BeADirectory())
+			})
+		})
+	})
+
+	Context("when a buildpack script hangs", func() {
+		// killed children are zombies until they are reaped, which does not
+		// count as running
+		childIsRunning := func() bool {
+			pid, err := ioutil.ReadFile(filepath.Join(buildDir, "child.pid"))
+			Expect(err).NotTo(HaveOccurred())
+			stat, err := ioutil.ReadFile(filepath.Join("/proc", strings.TrimSpace(string(pid)), "stat"))
+			if err != nil {
+				return false
+			}
+			fields := strings.Fields(string(stat[strings.LastIndex(string(stat), ")")+1:]))
+			return fields[0] != "Z"
+		}
+
+		Context("and its phase times out", func() {
+			BeforeEach(func() {
+				buildpackOrder = "hangs-on-detect"
+				phaseTimeouts = map[builder.Phase]time.Duration{builder.PhaseDetect: 200 * time.Millisecond}
+
+				cpBuildpack("hangs-on-detect")
+				cp(filepath.Join(appFixtures, "bash-app", "app.sh"), buildDir)
+			})
+
+			It("should fail with a timeout", func() {
+				Expect(userFacingError).To(MatchError(ContainSubstring("detect did not finish in time")))
+				Expect(userFacingError.(builder.DescriptiveError).ExitCode).To(Equal(builder.TimeoutFailCode))
+				Expect(userFacingError.(builder.DescriptiveError).Message).To(Equal(builder.TimeoutFailMsg))
+			})
+
+			It("should kill the processes the script started", func() {
+				Eventually(childIsRunning).Should(BeFalse())
+			})
+		})
+
+		Context("and the staging times out", func() {
+			BeforeEach(func() {
+				buildpackOrder = "hangs-on-compile"
+				stagingTimeout = 300 * time.Millisecond
+				phaseTimeouts = map[builder.Phase]time.Duration{builder.PhaseCompile: time.Minute}
+
+				cpBuildpack("hangs-on-compile")
+				cp(filepath.Join(appFixtures, "bash-app", "app.sh"), buildDir)
+			})
+
+			It("should fail with a timeout", func() {
+				Expect(userFacingError).To(MatchError(ContainSubstring("compile did not finish in time")))
+				Expect(userFacingError.(builder.DescriptiveError).ExitCode).To(Equal(builder.TimeoutFailCode))
+			})
+
+			It("should kill the processes the script started", func() {
+				Eventually(childIsRunning).Should(BeFalse())
+			})
+		})
+	})
+
+	Context("when the staging is cancelled", func() {
+		var cancel context.CancelFunc
+
+		BeforeEach(func() {
+			ctx, cancel = context.WithCancel(context.Background())
+			time.AfterFunc(500*time.Millisecond, cancel)
+			cp(filepath.Join(appFixtures, "bash-app", "app.sh"), buildDir)
+		})
+
+		AfterEach(func() {
+			cancel()
+		})
+
+		Context("and the buildpack stops on SIGTERM", func() {
+			var started time.Time
+
+			BeforeEach(func() {
+				buildpackOrder = "hangs-on-compile"
+				killGracePeriod = time.Minute
+				cpBuildpack("hangs-on-compile")
+				started = time.Now()
+			})
+
+			It("should fail as cancelled without waiting for the grace period", func() {
+				Expect(time.Since(started)).To(BeNumerically("<", 10*time.Second))
+				Expect(userFacingError).To(MatchError(ContainSubstring("compile was interrupted")))
+				Expect(userFacingError.(builder.DescriptiveError).ExitCode).To(Equal(builder.CancelFailCode))
+				Expect(userFacingError.(builder.DescriptiveError).Message).To(Equal(builder.CancelFailMsg))
+			})
+		})
+
+		Context("and the buildpack ignores SIGTERM", func() {
+			BeforeEach(func() {
+				buildpackOrder = "ignores-sigterm"
+				killGracePeriod = 200 * time.Millisecond
+				cpBuildpack("ignores-sigterm")
+			})
+
+			It("should kill it after the grace period", func() {
+				Expect(userFacingError.(builder.DescriptiveError).ExitCode).To(Equal(builder.CancelFailCode))
+				pid, err := ioutil.ReadFile(filepath.Join(buildDir, "child.pid"))
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(func() bool {
+					stat, err := ioutil.ReadFile(filepath.Join("/proc", strings.TrimSpace(string(pid)), "stat"))
+					return err == nil && !strings.Contains(string(stat), ") Z ")
+				}).Should(BeFalse())
+			})
+		})
+	})
+
+	Context("when writing an OCI image", func() {
+		var (
+			layout   builder.OCILayout
+			manifest builder.OCIManifest
+			config   builder.OCIImageConfig
+		)
+
+		layerFiles := func(layer builder.OCIDescriptor) []string {
+			listing, err := exec.Command("tar", "--numeric-owner", "-tvzf", layout.BlobPath(layer.Digest)).Output()
+			Expect(err).NotTo(HaveOccurred())
+			return strings.Split(strings.TrimSpace(string(listing)), "\n")
+		}
+
+		fileNames := func(layer builder.OCIDescriptor) []string {
+			listing, err := exec.Command("tar", "-tzf", layout.BlobPath(layer.Digest)).Output()
+			Expect(err).NotTo(HaveOccurred())
+			return strings.Split(strings.TrimSpace(string(listing)), "\n")
+		}
+
+		BeforeEach(func() {
+			outputFormat = builder.OutputFormatOCI
+			stagingEnv.Stack = "cflinuxfs3"
+			buildpackOrder = "always-detects,has-finalize"
+			skipDetect = true
+
+			cpBuildpack("always-detects")
+			cpBuildpack("has-finalize")
+			cp(path.Join(appFixtures, "bash-app", "app.sh"), buildDir)
+		})
+
+		JustBeforeEach(func() {
+			Expect(userFacingError).NotTo(HaveOccurred())
+
+			layout = builder.OCILayout{Dir: outputImage}
+			var err error
+			manifest, _, err = layout.Manifest()
+			Expect(err).NotTo(HaveOccurred())
+			config, err = layout.ImageConfig(manifest)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("writes a deps layer and an app layer", func() {
+			Expect(manifest.MediaType).To(Equal(builder.MediaTypeOCIManifest))
+			Expect(manifest.Layers).To(HaveLen(2))
+
+			deps := fileNames(manifest.Layers[0])
+			Expect(deps).To(ContainElement("./home/vcap/deps/0/supplied"))
+			Expect(deps).To(ContainElement("./home/vcap/profile.d/finalized.sh"))
+			Expect(deps).To(ContainElement("./home/vcap/staging_info.yml"))
+			Expect(deps).To(ContainElement("./home/vcap/tmp/"))
+			Expect(deps).NotTo(ContainElement(ContainSubstring("app.sh")))
+
+			app := fileNames(manifest.Layers[1])
+			Expect(app).To(ContainElement("./home/vcap/app/app.sh"))
+			Expect(app).To(ContainElement("./home/vcap/app/finalized"))
+			Expect(app).NotTo(ContainElement(ContainSubstring("deps")))
+		})
+
+		It("owns the files of the layers by vcap", func() {
+			for _, layer := range manifest.Layers {
+				for _, file := range layerFiles(layer) {
+					Expect(file).To(ContainSubstring(" 2000/2000 "))
+				}
+			}
+		})
+
+		It("records the digests of the uncompressed layers", func() {
+			Expect(config.RootFS.DiffIDs).To(HaveLen(2))
+			for i, layer := range manifest.Layers {
+				uncompressed, err := exec.Command("bash", "-c", fmt.Sprintf("gunzip -c %s | sha256sum", layout.BlobPath(layer.Digest))).Output()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(config.RootFS.DiffIDs[i]).To(Equal("sha256:" + strings.Fields(string(uncompressed))[0]))
+			}
+		})
+
+		It("runs the web process through the profile scripts", func() {
+			Expect(config.Config.Entrypoint[:2]).To(Equal([]string{"/bin/bash", "-c"}))
+			Expect(config.Config.Entrypoint[2]).To(ContainSubstring("/home/vcap/profile.d/*.sh"))
+			Expect(config.Config.Cmd).To(Equal([]string{"the start command"}))
+			Expect(config.Config.Env).To(ContainElement("DEPS_DIR=/home/vcap/deps"))
+			Expect(config.Config.WorkingDir).To(Equal("/home/vcap/app"))
+			Expect(config.Config.User).To(Equal("vcap"))
+		})
+
+		It("records the stack in the staging info", func() {
+			stagingInfo, err := exec.Command("tar", "-xzf", layout.BlobPath(manifest.Layers[0].Digest), "-O", "./home/vcap/staging_info.yml").Output()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stagingInfo).To(MatchJSON(`{"detected_buildpack":"Finalize","start_command":"the start command","stack":"cflinuxfs3"}`))
+		})
+
+		It("labels the image with the stack and the process types", func() {
+			Expect(config.Config.Labels).To(Equal(map[string]string{
+				builder.StackLabel:        "cflinuxfs3",
+				builder.ProcessTypesLabel: `{"web":"the start command"}`,
+			}))
+		})
+
+		It("still writes the result.json", func() {
+			Expect(stagingReport().Steps).NotTo(BeEmpty())
+		})
+
+		Context("with a stack layer", func() {
+			BeforeEach(func() {
+				stackLayer = &builder.StackLayer{
+					OCIDescriptor: builder.OCIDescriptor{
+						MediaType: builder.MediaTypeOCIForeignLayer,
+						Digest:    "sha256:aaaa",
+						Size:      42,
+						URLs:      []string{"https://stacks.example.com/cflinuxfs3.tgz"},
+					},
+					DiffID: "sha256:bbbb",
+				}
+			})
+
+			It("references it as the first layer without including it", func() {
+				Expect(manifest.Layers).To(HaveLen(3))
+				Expect(manifest.Layers[0]).To(Equal(stackLayer.OCIDescriptor))
+				Expect(config.RootFS.DiffIDs[0]).To(Equal("sha256:bbbb"))
+				Expect(layout.HasBlob("sha256:aaaa")).To(BeFalse())
+			})
+		})
+	})
+
+	Context("when writing a layered droplet", func() {
+		var manifest builder.DropletManifest
+
+		layerFiles := func(layer builder.DropletLayer) []string {
+			listing, err := exec.Command("tar", "-tzf", filepath.Join(outputLayers, layer.FileName())).Output()
+			Expect(err).NotTo(HaveOccurred())
+			return strings.Split(strings.TrimSpace(string(listing)), "\n")
+		}
+
+		BeforeEach(func() {
+			outputFormat = builder.OutputFormatLayered
+			buildpackOrder = "always-detects,has-finalize"
+			skipDetect = true
+
+			cpBuildpack("always-detects")
+			cpBuildpack("has-finalize")
+			cp(path.Join(appFixtures, "bash-app", "app.sh"), buildDir)
+		})
+
+		JustBeforeEach(func() {
+			Expect(userFacingError).NotTo(HaveOccurred())
+
+			var err error
+			manifest, err = builder.ReadDropletManifest(filepath.Join(filepath.Dir(outputMetadata), builder.DropletManifestName))
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("lists a layer per buildpack, profile.d, the app and the rest", func() {
+			var paths []string
+			for _, layer := range manifest.Layers {
+				paths = append(paths, layer.Path)
+				Expect(filepath.Join(outputLayers, layer.FileName())).To(BeAnExistingFile())
+			}
+			Expect(paths).To(Equal([]string{".", "app", "deps/0", "deps/1", "profile.d"}))
+		})
+
+		It("places each directory in its own layer", func() {
+			Expect(layerFiles(manifest.Layers[0])).To(ConsistOf("./", "./deps/", "./logs/", "./staging_info.yml", "./tmp/"))
+			Expect(layerFiles(manifest.Layers[1])).To(ContainElement("./app.sh"))
+			Expect(layerFiles(manifest.Layers[2])).To(ContainElement("./supplied"))
+			Expect(layerFiles(manifest.Layers[4])).To(ContainElement("./finalized.sh"))
+		})
+
+		It("names the layers after their digest", func() {
+			for _, layer := range manifest.Layers {
+				sum, err := exec.Command("sha256sum", filepath.Join(outputLayers, layer.FileName())).Output()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(layer.Digest).To(Equal("sha256:" + strings.Fields(string(sum))[0]))
+			}
+		})
+
+		It("produces the same deps layers when staged again", func() {
+			previous := manifest.Layers[2].Digest
+			runner.CleanUp()
+
+			conf := builder.Config{
+				BuildDir:                  buildDir,
+				BuildpacksDir:             buildpacksDir,
+				OutputDropletLocation:     outputDroplet,
+				OutputBuildArtifactsCache: outputBuildArtifactsCache,
+				OutputMetadataLocation:    outputMetadata,
+				BuildpackOrder:            strings.Split(buildpackOrder, ","),
+				BuildArtifactsCache:       "/tmp/cache",
+				SkipDetect:                true,
+				OutputFormat:              builder.OutputFormatLayered,
+				OutputLayersLocation:      outputLayers,
+			}
+			runner = builder.NewRunner(&conf)
+			runner.BuildpackOut = GinkgoWriter
+			runner.BuildpackErr = GinkgoWriter
+			Expect(runner.Run(context.Background())).To(Succeed())
+
+			restaged, err := builder.ReadDropletManifest(filepath.Join(filepath.Dir(outputMetadata), builder.DropletManifestName))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(restaged.Layers[2].Digest).To(Equal(previous))
+		})
+	})
+
 	Context("with a nested buildpack", func() {
 		BeforeEach(func() {
 			nestedBuildpack := "nested-buildpack"
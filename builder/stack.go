@@ -0,0 +1,86 @@
+package builder
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// buildpackManifest holds the parts of a buildpack's manifest.yml that tell
+// which stacks it supports.
+type buildpackManifest struct {
+	Stack        string `yaml:"stack"`
+	Dependencies []struct {
+		CFStacks []string `yaml:"cf_stacks"`
+	} `yaml:"dependencies"`
+}
+
+// checkStack returns why the buildpack does not support stack, if it does
+// not. A buildpack that does not say which stacks it supports is assumed to
+// support them all, as is any buildpack when the stack is not known.
+func checkStack(buildpackPath, stack string) error {
+	if stack == "" {
+		return nil
+	}
+
+	contents, err := ioutil.ReadFile(filepath.Join(buildpackPath, "manifest.yml"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		logError(fmt.Sprintf("failed to read buildpack manifest: %s", err.Error()))
+		return nil
+	}
+
+	var manifest buildpackManifest
+	if err = yaml.Unmarshal(contents, &manifest); err != nil {
+		logError(fmt.Sprintf("failed to parse buildpack manifest: %s", err.Error()))
+		return nil
+	}
+
+	if manifest.Stack != "" {
+		if manifest.Stack != stack {
+			return fmt.Errorf("it only supports stack %s, not %s", manifest.Stack, stack)
+		}
+		return nil
+	}
+
+	stackSpecific := false
+	for _, dependency := range manifest.Dependencies {
+		for _, dependencyStack := range dependency.CFStacks {
+			if dependencyStack == stack {
+				return nil
+			}
+			stackSpecific = true
+		}
+	}
+
+	if stackSpecific {
+		return fmt.Errorf("none of its dependencies support stack %s", stack)
+	}
+
+	return nil
+}
+
+// checkStacks fails when any of the buildpacks does not support the stack.
+// Stagings that skip detection use every buildpack, so they cannot do without
+// any of them.
+func (runner *Runner) checkStacks() error {
+	stack := runner.config.Stack()
+	for _, buildpack := range runner.config.BuildpackOrder {
+		buildpackPath, err := runner.buildpackPath(buildpack)
+		if err != nil {
+			// reported when the buildpack is run
+			continue
+		}
+
+		if err = checkStack(buildpackPath, stack); err != nil {
+			return NewStackFailError(fmt.Errorf("buildpack %s cannot be used: %s", buildpack, err.Error()))
+		}
+	}
+
+	return nil
+}
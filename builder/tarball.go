@@ -0,0 +1,228 @@
+package builder
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	// ReproducibleUID and ReproducibleGID are the ids of the vcap user the
+	// droplet is run as.
+	ReproducibleUID = 2000
+	ReproducibleGID = 2000
+)
+
+// ReproducibleEpoch is the latest timestamp a reproducible tarball records.
+// It is the earliest time zip archives can represent, so app files from the
+// package keep theirs as long as they are not older.
+var ReproducibleEpoch = time.Date(1980, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Tarball writes a directory as a compressed tarball. Entries are named like
+// the ones of `tar -C dir .`, which is what droplet consumers expect.
+type Tarball struct {
+	// Reproducible makes the output depend on the directory contents only:
+	// timestamps are clamped to ReproducibleEpoch and ownership is
+	// normalized.
+	Reproducible bool
+	// VcapOwned records every entry as owned by vcap without clamping
+	// timestamps, which Reproducible implies.
+	VcapOwned bool
+	// Compression defaults to gzip.
+	Compression Compression
+	// Level is passed to the compressor, nil selects its default.
+	Level *int
+	// Workers is the number of blocks compressed concurrently, zero uses
+	// every CPU.
+	Workers int
+	// Exclude lists slash separated paths inside the tarball that are left
+	// out, along with everything below them.
+	Exclude []string
+}
+
+// Write archives sourceDir, giving up with the error of ctx once it is done.
+func (t Tarball) Write(ctx context.Context, sourceDir, destination string) error {
+	return t.WriteWithMounts(ctx, sourceDir, destination, nil)
+}
+
+// WriteWithMounts archives sourceDir as if the directories in mounts, keyed
+// by their slash separated path inside the tarball, had been copied into it.
+// This saves copying big directories just to archive them.
+func (t Tarball) WriteWithMounts(ctx context.Context, sourceDir, destination string, mounts map[string]string) error {
+	file, err := os.Create(destination)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	compressor, err := newCompressor(file, t.Compression, t.Level, t.Workers)
+	if err != nil {
+		return err
+	}
+	tarWriter := tar.NewWriter(compressor)
+
+	err = t.walk(ctx, tarWriter, sourceDir, ".", mounts)
+	if err != nil {
+		compressor.Close()
+		return err
+	}
+
+	if err = tarWriter.Close(); err != nil {
+		compressor.Close()
+		return err
+	}
+	if err = compressor.Close(); err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+// walk writes path and everything below it. Children are visited in lexical
+// order, mounts included, so the order does not depend on the file system.
+// ctx is checked before every entry.
+func (t Tarball) walk(ctx context.Context, tarWriter *tar.Writer, path, rel string, mounts map[string]string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+
+	if err = t.writeEntry(tarWriter, path, "./"+rel, info); err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return nil
+	}
+
+	children, err := t.children(path, rel, mounts)
+	if err != nil {
+		return err
+	}
+
+	for _, child := range children {
+		childRel := child
+		if rel != "." {
+			childRel = rel + "/" + child
+		}
+		if contains(t.Exclude, childRel) {
+			continue
+		}
+
+		childPath, mounted := mounts[childRel]
+		if !mounted {
+			childPath = filepath.Join(path, child)
+		}
+
+		if err = t.walk(ctx, tarWriter, childPath, childRel, mounts); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t Tarball) children(path, rel string, mounts map[string]string) ([]string, error) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	for mountRel := range mounts {
+		name := filepath.Base(mountRel)
+		if filepath.Dir(mountRel) == rel && !contains(names, name) {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+func (t Tarball) writeEntry(tarWriter *tar.Writer, path, name string, info os.FileInfo) error {
+	var link string
+	switch mode := info.Mode(); {
+	case mode.IsDir():
+		if name == "./." {
+			name = "./"
+		} else {
+			name += "/"
+		}
+	case mode&os.ModeSymlink != 0:
+		var err error
+		if link, err = os.Readlink(path); err != nil {
+			return err
+		}
+	case !mode.IsRegular():
+		log.Printf("Skipping %s: only files, directories and symlinks are archived", name)
+		return nil
+	}
+
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+
+	if t.Reproducible {
+		t.normalize(header)
+	} else if t.VcapOwned {
+		ownByVcap(header)
+	}
+
+	if err = tarWriter.WriteHeader(header); err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(tarWriter, file)
+	return err
+}
+
+func (t Tarball) normalize(header *tar.Header) {
+	if header.ModTime.After(ReproducibleEpoch) {
+		header.ModTime = ReproducibleEpoch
+	}
+	header.AccessTime = time.Time{}
+	header.ChangeTime = time.Time{}
+	ownByVcap(header)
+}
+
+func ownByVcap(header *tar.Header) {
+	header.Uid = ReproducibleUID
+	header.Gid = ReproducibleGID
+	header.Uname = "vcap"
+	header.Gname = "vcap"
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,332 @@
+package builder_test
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/eirini-staging/builder"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+)
+
+var _ = Describe("Tarball", func() {
+	var (
+		tmpDir      string
+		sourceDir   string
+		destination string
+		tarball     builder.Tarball
+	)
+
+	writeSource := func() {
+		Expect(os.MkdirAll(filepath.Join(sourceDir, "app", "lib"), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(sourceDir, "app", "lib", "b.rb"), []byte("b"), 0644)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(sourceDir, "app", "a.rb"), []byte("a"), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(sourceDir, "staging_info.yml"), []byte("{}"), 0644)).To(Succeed())
+		Expect(os.Symlink("lib/b.rb", filepath.Join(sourceDir, "app", "link"))).To(Succeed())
+	}
+
+	readHeaders := func(path string) []*tar.Header {
+		file, err := os.Open(path)
+		Expect(err).NotTo(HaveOccurred())
+		defer file.Close()
+
+		gzipReader, err := gzip.NewReader(file)
+		Expect(err).NotTo(HaveOccurred())
+
+		var headers []*tar.Header
+		tarReader := tar.NewReader(gzipReader)
+		for {
+			header, err := tarReader.Next()
+			if err == io.EOF {
+				return headers
+			}
+			Expect(err).NotTo(HaveOccurred())
+			headers = append(headers, header)
+		}
+	}
+
+	names := func(headers []*tar.Header) []string {
+		var result []string
+		for _, header := range headers {
+			result = append(result, header.Name)
+		}
+		return result
+	}
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "tarball")
+		Expect(err).NotTo(HaveOccurred())
+
+		sourceDir = filepath.Join(tmpDir, "source")
+		destination = filepath.Join(tmpDir, "droplet.tgz")
+		writeSource()
+
+		tarball = builder.Tarball{}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	It("names the entries like tar does", func() {
+		Expect(tarball.Write(context.Background(), sourceDir, destination)).To(Succeed())
+		Expect(names(readHeaders(destination))).To(Equal([]string{
+			"./",
+			"./app/",
+			"./app/a.rb",
+			"./app/lib/",
+			"./app/lib/b.rb",
+			"./app/link",
+			"./staging_info.yml",
+		}))
+	})
+
+	It("stops once the context is done", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		Expect(tarball.Write(ctx, sourceDir, destination)).To(MatchError(context.Canceled))
+	})
+
+	It("keeps modes and symlinks", func() {
+		Expect(tarball.Write(context.Background(), sourceDir, destination)).To(Succeed())
+
+		headers := readHeaders(destination)
+		Expect(headers[2].FileInfo().Mode().Perm()).To(Equal(os.FileMode(0755)))
+		Expect(headers[4].FileInfo().Mode().Perm()).To(Equal(os.FileMode(0644)))
+		Expect(headers[5].Typeflag).To(Equal(byte(tar.TypeSymlink)))
+		Expect(headers[5].Linkname).To(Equal("lib/b.rb"))
+	})
+
+	Context("when a directory is mounted into the tarball", func() {
+		var mountedDir string
+
+		BeforeEach(func() {
+			mountedDir = filepath.Join(tmpDir, "build")
+			Expect(os.MkdirAll(filepath.Join(mountedDir, "bin"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(mountedDir, "bin", "run"), []byte("run"), 0755)).To(Succeed())
+			Expect(os.RemoveAll(filepath.Join(sourceDir, "app"))).To(Succeed())
+			Expect(os.MkdirAll(filepath.Join(sourceDir, "deps"), 0755)).To(Succeed())
+		})
+
+		It("archives the mounted directory in place without touching it", func() {
+			Expect(tarball.WriteWithMounts(context.Background(), sourceDir, destination, map[string]string{"app": mountedDir})).To(Succeed())
+			Expect(names(readHeaders(destination))).To(Equal([]string{
+				"./",
+				"./app/",
+				"./app/bin/",
+				"./app/bin/run",
+				"./deps/",
+				"./staging_info.yml",
+			}))
+
+			Expect(filepath.Join(mountedDir, "bin", "run")).To(BeAnExistingFile())
+			Expect(filepath.Join(sourceDir, "app")).NotTo(BeAnExistingFile())
+		})
+	})
+
+	Context("when paths are excluded", func() {
+		BeforeEach(func() {
+			tarball.Exclude = []string{"app/lib"}
+		})
+
+		It("leaves them out along with their contents", func() {
+			Expect(tarball.Write(context.Background(), sourceDir, destination)).To(Succeed())
+			Expect(names(readHeaders(destination))).To(Equal([]string{
+				"./",
+				"./app/",
+				"./app/a.rb",
+				"./app/link",
+				"./staging_info.yml",
+			}))
+		})
+	})
+
+	Context("when the content spans several compression blocks", func() {
+		var content []byte
+
+		BeforeEach(func() {
+			content = make([]byte, 3<<20+17)
+			for i := range content {
+				content[i] = byte(i * 7 % 251)
+			}
+			Expect(ioutil.WriteFile(filepath.Join(sourceDir, "app", "big"), content, 0644)).To(Succeed())
+
+			tarball.Workers = 2
+			level := gzip.BestSpeed
+			tarball.Level = &level
+		})
+
+		It("writes a single readable gzip stream", func() {
+			Expect(tarball.Write(context.Background(), sourceDir, destination)).To(Succeed())
+
+			file, err := os.Open(destination)
+			Expect(err).NotTo(HaveOccurred())
+			defer file.Close()
+
+			gzipReader, err := gzip.NewReader(file)
+			Expect(err).NotTo(HaveOccurred())
+			tarReader := tar.NewReader(gzipReader)
+			for {
+				header, err := tarReader.Next()
+				Expect(err).NotTo(HaveOccurred())
+				if header.Name == "./app/big" {
+					break
+				}
+			}
+
+			extracted, err := ioutil.ReadAll(tarReader)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(extracted).To(Equal(content))
+		})
+	})
+
+	Context("when the compression level is invalid", func() {
+		BeforeEach(func() {
+			level := 42
+			tarball.Level = &level
+		})
+
+		It("fails", func() {
+			Expect(tarball.Write(context.Background(), sourceDir, destination)).To(MatchError("gzip compression levels range from -2 to 9, not 42"))
+		})
+	})
+
+	Context("when the compression level is zero", func() {
+		BeforeEach(func() {
+			level := gzip.NoCompression
+			tarball.Level = &level
+		})
+
+		It("does not compress instead of using the default level", func() {
+			Expect(tarball.Write(context.Background(), sourceDir, destination)).To(Succeed())
+			stored, err := os.Stat(destination)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(builder.Tarball{}.Write(context.Background(), sourceDir, destination)).To(Succeed())
+			compressed, err := os.Stat(destination)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(stored.Size()).To(BeNumerically(">", compressed.Size()))
+		})
+	})
+
+	Context("when compressing with zstd", func() {
+		BeforeEach(func() {
+			tarball.Compression = builder.CompressionZstd
+		})
+
+		It("writes a zstd compressed tarball", func() {
+			Expect(tarball.Write(context.Background(), sourceDir, destination)).To(Succeed())
+
+			listing, err := exec.Command("sh", "-c", "zstd -dc "+destination+" | tar -t").Output()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(strings.Fields(string(listing))).To(ContainElement("./app/lib/b.rb"))
+		})
+
+		Context("and a level gzip does not support", func() {
+			BeforeEach(func() {
+				level := 19
+				tarball.Level = &level
+			})
+
+			It("uses it", func() {
+				Expect(tarball.Write(context.Background(), sourceDir, destination)).To(Succeed())
+			})
+		})
+
+		Context("and zstd is not installed", func() {
+			var (
+				originalPath string
+				logOut       *gbytes.Buffer
+			)
+
+			BeforeEach(func() {
+				originalPath = os.Getenv("PATH")
+				Expect(os.Setenv("PATH", sourceDir)).To(Succeed())
+				logOut = gbytes.NewBuffer()
+				log.SetOutput(logOut)
+			})
+
+			AfterEach(func() {
+				Expect(os.Setenv("PATH", originalPath)).To(Succeed())
+				log.SetOutput(os.Stderr)
+			})
+
+			It("warns and compresses with gzip", func() {
+				Expect(tarball.Write(context.Background(), sourceDir, destination)).To(Succeed())
+				Expect(logOut).To(gbytes.Say("warning: zstd is not available, compressing with gzip instead"))
+
+				file, err := os.Open(destination)
+				Expect(err).NotTo(HaveOccurred())
+				defer file.Close()
+				_, err = gzip.NewReader(file)
+				Expect(err).NotTo(HaveOccurred())
+			})
+		})
+
+		Context("and a level zstd does not support", func() {
+			BeforeEach(func() {
+				level := 0
+				tarball.Level = &level
+			})
+
+			It("fails", func() {
+				Expect(tarball.Write(context.Background(), sourceDir, destination)).To(MatchError("zstd compression levels range from 1 to 19, not 0"))
+			})
+		})
+	})
+
+	Context("when reproducible", func() {
+		BeforeEach(func() {
+			tarball.Reproducible = true
+		})
+
+		It("normalizes timestamps and ownership", func() {
+			Expect(tarball.Write(context.Background(), sourceDir, destination)).To(Succeed())
+
+			for _, header := range readHeaders(destination) {
+				Expect(header.ModTime.Equal(builder.ReproducibleEpoch)).To(BeTrue(), header.Name)
+				Expect(header.Uid).To(Equal(builder.ReproducibleUID))
+				Expect(header.Gid).To(Equal(builder.ReproducibleGID))
+			}
+		})
+
+		It("keeps timestamps older than the epoch", func() {
+			old := time.Date(1975, time.June, 1, 0, 0, 0, 0, time.UTC)
+			Expect(os.Chtimes(filepath.Join(sourceDir, "staging_info.yml"), old, old)).To(Succeed())
+			Expect(tarball.Write(context.Background(), sourceDir, destination)).To(Succeed())
+
+			headers := readHeaders(destination)
+			Expect(headers[6].ModTime.Equal(old)).To(BeTrue())
+		})
+
+		It("produces the same bytes for the same contents", func() {
+			Expect(tarball.Write(context.Background(), sourceDir, destination)).To(Succeed())
+			first, err := ioutil.ReadFile(destination)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(os.RemoveAll(sourceDir)).To(Succeed())
+			time.Sleep(10 * time.Millisecond)
+			writeSource()
+
+			Expect(tarball.Write(context.Background(), sourceDir, destination)).To(Succeed())
+			second, err := ioutil.ReadFile(destination)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(second).To(Equal(first))
+		})
+	})
+})
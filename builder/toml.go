@@ -0,0 +1,476 @@
+package builder
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// parseTOML reads the subset of TOML that buildpacks write: tables, arrays
+// of tables and key/value pairs whose values are strings, booleans, numbers,
+// inline tables or arrays of those. Dates are not supported. Arrays of
+// tables become []map[string]interface{}.
+func parseTOML(data string) (map[string]interface{}, error) {
+	root := map[string]interface{}{}
+	current := root
+
+	rest := data
+	for {
+		rest = skipBlank(rest)
+		if rest == "" {
+			return root, nil
+		}
+		lineNumber := strings.Count(data[:len(data)-len(rest)], "\n") + 1
+
+		var keys []string
+		var err error
+		switch {
+		case strings.HasPrefix(rest, "[["):
+			keys, rest, err = parseHeader(rest[2:], "]]")
+			if err == nil {
+				current, err = appendTable(root, keys)
+			}
+		case strings.HasPrefix(rest, "["):
+			keys, rest, err = parseHeader(rest[1:], "]")
+			if err == nil {
+				current, err = table(root, keys)
+			}
+		default:
+			rest, err = setKey(current, rest)
+		}
+
+		if err == nil {
+			rest, err = endOfLine(rest)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNumber, err.Error())
+		}
+	}
+}
+
+func parseHeader(s, closing string) ([]string, string, error) {
+	keys, rest, err := parseKey(s)
+	if err != nil {
+		return nil, "", err
+	}
+
+	rest = strings.TrimLeft(rest, " \t")
+	if !strings.HasPrefix(rest, closing) {
+		return nil, "", fmt.Errorf("malformed table header")
+	}
+
+	return keys, rest[len(closing):], nil
+}
+
+func table(root map[string]interface{}, keys []string) (map[string]interface{}, error) {
+	current := root
+	for _, key := range keys {
+		switch value := current[key].(type) {
+		case nil:
+			next := map[string]interface{}{}
+			current[key] = next
+			current = next
+		case map[string]interface{}:
+			current = value
+		case []map[string]interface{}:
+			current = value[len(value)-1]
+		default:
+			return nil, fmt.Errorf("%s is not a table", key)
+		}
+	}
+
+	return current, nil
+}
+
+func appendTable(root map[string]interface{}, keys []string) (map[string]interface{}, error) {
+	parent, err := table(root, keys[:len(keys)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	key := keys[len(keys)-1]
+	tables, ok := parent[key].([]map[string]interface{})
+	if !ok && parent[key] != nil {
+		return nil, fmt.Errorf("%s is not an array of tables", key)
+	}
+
+	next := map[string]interface{}{}
+	parent[key] = append(tables, next)
+	return next, nil
+}
+
+// setKey parses the key/value pair s starts with into current and returns
+// what follows the value.
+func setKey(current map[string]interface{}, s string) (string, error) {
+	keys, rest, err := parseKey(s)
+	if err != nil {
+		return "", err
+	}
+
+	rest = strings.TrimLeft(rest, " \t")
+	if !strings.HasPrefix(rest, "=") {
+		return "", fmt.Errorf("expected = after key %s", strings.Join(keys, "."))
+	}
+
+	value, rest, err := parseValue(strings.TrimLeft(rest[1:], " \t"))
+	if err != nil {
+		return "", err
+	}
+
+	parent, err := table(current, keys[:len(keys)-1])
+	if err != nil {
+		return "", err
+	}
+	parent[keys[len(keys)-1]] = value
+
+	return rest, nil
+}
+
+// parseKey parses a bare, quoted or dotted key.
+func parseKey(s string) ([]string, string, error) {
+	var keys []string
+	for {
+		s = strings.TrimLeft(s, " \t")
+
+		var key string
+		switch {
+		case strings.HasPrefix(s, `"`):
+			end := closingQuote(s)
+			if end < 0 {
+				return nil, "", fmt.Errorf("unterminated key")
+			}
+			var err error
+			if key, err = unescape(s[1:end], false); err != nil {
+				return nil, "", err
+			}
+			s = s[end+1:]
+		case strings.HasPrefix(s, "'"):
+			end := strings.IndexAny(s[1:], "'\n")
+			if end < 0 || s[end+1] != '\'' {
+				return nil, "", fmt.Errorf("unterminated key")
+			}
+			key, s = s[1:end+1], s[end+2:]
+		default:
+			end := strings.IndexFunc(s, func(r rune) bool {
+				return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-')
+			})
+			if end < 0 {
+				end = len(s)
+			}
+			if end == 0 {
+				return nil, "", fmt.Errorf("expected a key, got %q", firstLine(s))
+			}
+			key, s = s[:end], s[end:]
+		}
+		keys = append(keys, key)
+
+		rest := strings.TrimLeft(s, " \t")
+		if !strings.HasPrefix(rest, ".") {
+			return keys, s, nil
+		}
+		s = rest[1:]
+	}
+}
+
+// parseValue parses the value s starts with and returns what follows it.
+func parseValue(s string) (interface{}, string, error) {
+	switch {
+	case strings.HasPrefix(s, `"""`):
+		end := closingDelimiter(s, `"""`, true)
+		if end < 0 {
+			return nil, "", fmt.Errorf("unterminated string")
+		}
+		value, err := unescape(trimFirstNewline(s[3:end]), true)
+		return value, s[end+3:], err
+	case strings.HasPrefix(s, "'''"):
+		end := closingDelimiter(s, "'''", false)
+		if end < 0 {
+			return nil, "", fmt.Errorf("unterminated string")
+		}
+		return trimFirstNewline(s[3:end]), s[end+3:], nil
+	case strings.HasPrefix(s, `"`):
+		end := closingQuote(s)
+		if end < 0 {
+			return nil, "", fmt.Errorf("unterminated string")
+		}
+		value, err := unescape(s[1:end], false)
+		return value, s[end+1:], err
+	case strings.HasPrefix(s, "'"):
+		end := strings.IndexAny(s[1:], "'\n")
+		if end < 0 || s[end+1] != '\'' {
+			return nil, "", fmt.Errorf("unterminated string")
+		}
+		return s[1 : end+1], s[end+2:], nil
+	case strings.HasPrefix(s, "["):
+		return parseArray(s[1:])
+	case strings.HasPrefix(s, "{"):
+		return parseInlineTable(s[1:])
+	}
+
+	end := strings.IndexAny(s, ",]}#\r\n")
+	if end < 0 {
+		end = len(s)
+	}
+	token := strings.TrimSpace(s[:end])
+
+	switch token {
+	case "true":
+		return true, s[end:], nil
+	case "false":
+		return false, s[end:], nil
+	}
+	if number, err := strconv.ParseInt(strings.Replace(token, "_", "", -1), 10, 64); err == nil {
+		return number, s[end:], nil
+	}
+	if number, err := strconv.ParseFloat(strings.Replace(token, "_", "", -1), 64); err == nil {
+		return number, s[end:], nil
+	}
+
+	return nil, "", fmt.Errorf("unsupported value %q", token)
+}
+
+func parseArray(s string) (interface{}, string, error) {
+	values := []interface{}{}
+	for {
+		s = skipBlank(s)
+		if strings.HasPrefix(s, "]") {
+			return values, s[1:], nil
+		}
+		if s == "" {
+			return nil, "", fmt.Errorf("unterminated array")
+		}
+
+		value, rest, err := parseValue(s)
+		if err != nil {
+			return nil, "", err
+		}
+		values = append(values, value)
+
+		s = skipBlank(rest)
+		switch {
+		case strings.HasPrefix(s, ","):
+			s = s[1:]
+		case s == "":
+			return nil, "", fmt.Errorf("unterminated array")
+		case !strings.HasPrefix(s, "]"):
+			return nil, "", fmt.Errorf("expected , or ] in array")
+		}
+	}
+}
+
+func parseInlineTable(s string) (interface{}, string, error) {
+	values := map[string]interface{}{}
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if strings.HasPrefix(s, "}") {
+			return values, s[1:], nil
+		}
+
+		rest, err := setKey(values, s)
+		if err != nil {
+			return nil, "", err
+		}
+
+		s = strings.TrimLeft(rest, " \t")
+		if strings.HasPrefix(s, ",") {
+			s = s[1:]
+		} else if !strings.HasPrefix(s, "}") {
+			return nil, "", fmt.Errorf("expected , or } in inline table")
+		}
+	}
+}
+
+// closingQuote returns the index of the quote that ends the basic string s
+// starts with, which cannot span lines.
+func closingQuote(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		case '\n':
+			return -1
+		}
+	}
+	return -1
+}
+
+// closingDelimiter returns the index of the delimiter that ends the
+// multi-line string s starts with. Up to two quotes right before it belong
+// to the string.
+func closingDelimiter(s, delimiter string, escapes bool) int {
+	for i := len(delimiter); i < len(s); i++ {
+		if escapes && s[i] == '\\' {
+			i++
+			continue
+		}
+		if !strings.HasPrefix(s[i:], delimiter) {
+			continue
+		}
+		for extra := 0; extra < 2 && strings.HasPrefix(s[i+1:], delimiter); extra++ {
+			i++
+		}
+		return i
+	}
+	return -1
+}
+
+func trimFirstNewline(s string) string {
+	if strings.HasPrefix(s, "\r\n") {
+		return s[2:]
+	}
+	return strings.TrimPrefix(s, "\n")
+}
+
+// unescape replaces the escape sequences of a basic string. In multi-line
+// strings, a backslash at the end of a line also removes the whitespace and
+// newlines that follow it.
+func unescape(s string, multiline bool) (string, error) {
+	var unescaped strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			unescaped.WriteByte(s[i])
+			continue
+		}
+
+		i++
+		if i == len(s) {
+			return "", fmt.Errorf("unterminated escape sequence")
+		}
+
+		switch c := s[i]; c {
+		case 'b':
+			unescaped.WriteByte('\b')
+		case 't':
+			unescaped.WriteByte('\t')
+		case 'n':
+			unescaped.WriteByte('\n')
+		case 'f':
+			unescaped.WriteByte('\f')
+		case 'r':
+			unescaped.WriteByte('\r')
+		case '"', '\\':
+			unescaped.WriteByte(c)
+		case 'u', 'U':
+			size := 4
+			if c == 'U' {
+				size = 8
+			}
+			if i+size >= len(s) {
+				return "", fmt.Errorf("invalid escape sequence \\%s", s[i:])
+			}
+			code, err := strconv.ParseUint(s[i+1:i+1+size], 16, 32)
+			if err != nil || !utf8.ValidRune(rune(code)) {
+				return "", fmt.Errorf("invalid escape sequence \\%s", s[i:i+1+size])
+			}
+			unescaped.WriteRune(rune(code))
+			i += size
+		default:
+			whitespace := strings.TrimLeft(s[i:], " \t")
+			if !multiline || !(strings.HasPrefix(whitespace, "\n") || strings.HasPrefix(whitespace, "\r\n")) {
+				return "", fmt.Errorf("invalid escape sequence \\%c", c)
+			}
+			i = len(s) - len(strings.TrimLeft(whitespace, " \t\r\n")) - 1
+		}
+	}
+
+	return unescaped.String(), nil
+}
+
+// skipBlank skips whitespace, newlines and comments.
+func skipBlank(s string) string {
+	for {
+		s = strings.TrimLeft(s, " \t\r\n")
+		if !strings.HasPrefix(s, "#") {
+			return s
+		}
+
+		end := strings.Index(s, "\n")
+		if end < 0 {
+			return ""
+		}
+		s = s[end:]
+	}
+}
+
+// endOfLine skips the rest of the line, which may only hold a comment.
+func endOfLine(s string) (string, error) {
+	rest := strings.TrimLeft(s, " \t")
+	if strings.HasPrefix(rest, "#") {
+		end := strings.Index(rest, "\n")
+		if end < 0 {
+			return "", nil
+		}
+		rest = rest[end:]
+	}
+
+	if rest != "" && !strings.HasPrefix(rest, "\n") && !strings.HasPrefix(rest, "\r\n") {
+		return "", fmt.Errorf("unexpected %q at the end of the line", firstLine(rest))
+	}
+	return rest, nil
+}
+
+func firstLine(s string) string {
+	if end := strings.Index(s, "\n"); end >= 0 {
+		return s[:end]
+	}
+	return s
+}
+
+func tomlString(table map[string]interface{}, key string) string {
+	value, _ := table[key].(string)
+	return value
+}
+
+func tomlBool(table map[string]interface{}, key string) bool {
+	value, _ := table[key].(bool)
+	return value
+}
+
+func tomlTable(table map[string]interface{}, key string) map[string]interface{} {
+	value, _ := table[key].(map[string]interface{})
+	return value
+}
+
+func tomlTables(table map[string]interface{}, key string) []map[string]interface{} {
+	value, _ := table[key].([]map[string]interface{})
+	return value
+}
+
+func tomlStrings(table map[string]interface{}, key string) []string {
+	values, _ := table[key].([]interface{})
+	strs := make([]string, 0, len(values))
+	for _, value := range values {
+		if str, ok := value.(string); ok {
+			strs = append(strs, str)
+		}
+	}
+	return strs
+}
+
+// tomlQuote writes s as a TOML basic string.
+func tomlQuote(s string) string {
+	var quoted strings.Builder
+	quoted.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			quoted.WriteByte('\\')
+			quoted.WriteRune(r)
+		case r == '\n':
+			quoted.WriteString(`\n`)
+		case r == '\t':
+			quoted.WriteString(`\t`)
+		case r == '\r':
+			quoted.WriteString(`\r`)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&quoted, `\u%04X`, r)
+		default:
+			quoted.WriteRune(r)
+		}
+	}
+	quoted.WriteByte('"')
+	return quoted.String()
+}
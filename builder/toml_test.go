@@ -0,0 +1,77 @@
+package builder_test
+
+import (
+	"code.cloudfoundry.org/eirini-staging/builder"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type table = map[string]interface{}
+
+var _ = Describe("TOML", func() {
+	Describe("parsing", func() {
+		for _, example := range []struct {
+			description string
+			document    string
+			expected    table
+		}{
+			{"an empty document", "", table{}},
+			{"comments", "# comment\nkey = 'value' # another\n", table{"key": "value"}},
+			{"integers, floats and booleans", "a = 1_000\nb = -2.5\nc = true\nd = false", table{"a": int64(1000), "b": -2.5, "c": true, "d": false}},
+			{"basic strings", `s = "tab\tquote\" backslash\\ \u00e9 \U0001F600"`, table{"s": "tab\tquote\" backslash\\ é 😀"}},
+			{"literal strings", `s = 'C:\path\"'`, table{"s": `C:\path\"`}},
+			{"multi-line basic strings", "s = \"\"\"\nfirst\\tline\nsecond \\\n    line\"\"\"", table{"s": "first\tline\nsecond line"}},
+			{"multi-line basic strings ending with quotes", `s = """say "hi"""""`, table{"s": `say "hi""`}},
+			{"multi-line literal strings", "s = '''\nraw \\n\n'line' '''", table{"s": "raw \\n\n'line' "}},
+			{"quoted and dotted keys", `"a b" = 1` + "\n" + `c . 'd.e' = 2`, table{"a b": int64(1), "c": table{"d.e": int64(2)}}},
+			{"arrays over several lines", "a = [\n  'x', # first\n  [1, 2],\n]", table{"a": []interface{}{"x", []interface{}{int64(1), int64(2)}}}},
+			{"inline tables", `p = { type = "web", args = ["-p", "8080"], nested = { on = true } }`, table{"p": table{
+				"type":   "web",
+				"args":   []interface{}{"-p", "8080"},
+				"nested": table{"on": true},
+			}}},
+			{"tables", "[types]\nlaunch = true\n[a.'b']\nc = 1", table{"types": table{"launch": true}, "a": table{"b": table{"c": int64(1)}}}},
+			{"arrays of tables", "[[order]]\n[[order.group]]\nid = 'a'\n[[order.group]]\nid = 'b'\n[[order]]", table{"order": []map[string]interface{}{
+				{"group": []map[string]interface{}{{"id": "a"}, {"id": "b"}}},
+				{},
+			}}},
+		} {
+			example := example
+			It("parses "+example.description, func() {
+				Expect(builder.ParseTOML(example.document)).To(Equal(example.expected))
+			})
+		}
+
+		for _, example := range []struct {
+			description string
+			document    string
+			err         string
+		}{
+			{"invalid escapes", `s = "\x41"`, `line 1: invalid escape sequence \x`},
+			{"surrogate escapes", `s = "\uD800"`, `line 1: invalid escape sequence \uD800`},
+			{"strings spanning lines", "a = 1\ns = \"two\nlines\"", "line 2: unterminated string"},
+			{"unterminated arrays", "a = [1, 2", "line 1: unterminated array"},
+			{"values followed by more", "a = 'x' 'y'", `line 1: unexpected "'y'" at the end of the line`},
+			{"dates", "d = 1979-05-27", `line 1: unsupported value "1979-05-27"`},
+			{"malformed headers", "[table", "line 1: malformed table header"},
+			{"keys without a value", "key", "line 1: expected = after key key"},
+			{"tables that are values", "a = 1\n[a.b]", "line 2: a is not a table"},
+		} {
+			example := example
+			It("rejects "+example.description, func() {
+				_, err := builder.ParseTOML(example.document)
+				Expect(err).To(MatchError(example.err))
+			})
+		}
+	})
+
+	Describe("quoting", func() {
+		It("writes strings that parse back to the same value", func() {
+			value := "quote\" backslash\\ newline\n tab\t bell\a é"
+			parsed, err := builder.ParseTOML("s = " + builder.TOMLQuote(value))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(parsed).To(Equal(table{"s": value}))
+		})
+	})
+})
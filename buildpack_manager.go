@@ -1,13 +1,20 @@
 package eirinistaging
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
 	"time"
 
 	"code.cloudfoundry.org/eirini-staging/builder"
@@ -15,44 +22,51 @@ import (
 )
 
 type BuildpackManager struct {
-	unzipper       Unzipper
+	extractor      Extractor
 	buildpackDir   string
 	buildpacksJSON string
+	concurrency    int
 	internalClient *http.Client
 	defaultClient  *http.Client
+	retryPolicy    RetryPolicy
+	gitCredentials GitCredentials
 }
 
-const configFileName = "config.json"
-
-func OpenBuildpackURL(buildpackURL string, client *http.Client) ([]byte, error) {
-	resp, err := client.Get(buildpackURL)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to request buildpack")
-	}
-	defer resp.Body.Close()
+const (
+	configFileName    = "config.json"
+	checksumsFileName = "checksums.json"
+)
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New(fmt.Sprintf("downloading buildpack failed with status code %d", resp.StatusCode))
+func DownloadBuildpack(ctx context.Context, buildpackURL string, client *http.Client, retryPolicy RetryPolicy, destination *os.File) error {
+	err := retryPolicy.Download(ctx, client, buildpackURL, destination)
+	if statusErr, ok := err.(StatusCodeError); ok {
+		return errors.New(fmt.Sprintf("downloading buildpack failed with status code %d", statusErr.StatusCode))
 	}
-
-	bytes, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return errors.Wrap(err, "failed to request buildpack")
 	}
 
-	return bytes, nil
+	return nil
 }
 
-func NewBuildpackManager(internalClient *http.Client, defaultClient *http.Client, buildpackDir, buildpacksJSON string) Installer {
+func NewBuildpackManager(internalClient *http.Client, defaultClient *http.Client, buildpackDir, buildpacksJSON string, concurrency int, retryPolicy RetryPolicy, gitCredentials GitCredentials) Installer {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
 	return &BuildpackManager{
+		extractor:      &ArchiveExtractor{},
 		internalClient: internalClient,
 		defaultClient:  defaultClient,
 		buildpackDir:   buildpackDir,
 		buildpacksJSON: buildpacksJSON,
+		concurrency:    concurrency,
+		retryPolicy:    retryPolicy,
+		gitCredentials: gitCredentials,
 	}
 }
 
-func (b *BuildpackManager) Install() error {
+func (b *BuildpackManager) Install(ctx context.Context) error {
 	var buildpacks []builder.Buildpack
 
 	err := json.Unmarshal([]byte(b.buildpacksJSON), &buildpacks)
@@ -61,70 +75,217 @@ func (b *BuildpackManager) Install() error {
 		return err
 	}
 
-	for _, buildpack := range buildpacks {
-		if err := b.install(buildpack); err != nil {
-			return fmt.Errorf("installing buildpack %s: %s failed: %s", buildpack.Name, buildpack.URL, err.Error())
+	installations, err := b.installAll(ctx, buildpacks)
+	if err != nil {
+		return err
+	}
+
+	checksums := map[string]string{}
+	revisions := map[string]string{}
+	for i, buildpack := range buildpacks {
+		if installations[i].digest != "" {
+			checksums[buildpack.Name] = installations[i].digest
+		}
+		if installations[i].revision != "" {
+			revisions[buildpack.Name] = installations[i].revision
 		}
 	}
 
+	if err := b.writeMapJSON(checksumsFileName, checksums); err != nil {
+		return err
+	}
+
+	if err := b.writeMapJSON(builder.RevisionsFileName, revisions); err != nil {
+		return err
+	}
+
 	return b.writeBuildpackJSON(buildpacks)
 }
 
-func (b *BuildpackManager) install(buildpack builder.Buildpack) error {
+// installation describes where an installed buildpack came from: the sha256
+// digest of its archive or the commit of its git repository.
+type installation struct {
+	digest   string
+	revision string
+}
+
+// installAll installs at most b.concurrency buildpacks at a time and reports
+// the failures of every buildpack in the order they were provided.
+func (b *BuildpackManager) installAll(ctx context.Context, buildpacks []builder.Buildpack) ([]installation, error) {
+	errs := make([]error, len(buildpacks))
+	installations := make([]installation, len(buildpacks))
+	slots := make(chan struct{}, b.concurrency)
+
+	var wg sync.WaitGroup
+	for i, buildpack := range buildpacks {
+		wg.Add(1)
+		go func(i int, buildpack builder.Buildpack) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			var err error
+			if installations[i], err = b.install(ctx, buildpack); err != nil {
+				errs[i] = fmt.Errorf("installing buildpack %s: %s failed: %s", buildpack.Name, redactURL(buildpack.URL), err.Error())
+			}
+		}(i, buildpack)
+	}
+	wg.Wait()
+
+	if err := combineErrors(errs); err != nil {
+		return nil, err
+	}
+
+	return installations, nil
+}
+
+func (b *BuildpackManager) install(ctx context.Context, buildpack builder.Buildpack) (installation, error) {
 	destination := builder.BuildpackPath(b.buildpackDir, buildpack.Name)
-	err := b.installFromArchive(buildpack, destination)
+
+	buildpackURL, err := parseBuildpackURL(buildpack.URL)
+	if err != nil {
+		return installation{}, fmt.Errorf("invalid buildpack url (%s): %s", redactURL(buildpack.URL), err.Error())
+	}
+
+	// private repositories cannot be downloaded over http, so there is no
+	// point in trying before cloning
+	if isGitURL(buildpackURL) {
+		return b.installFromGit(ctx, buildpack, buildpackURL, destination)
+	}
+
+	digest, err := b.installFromArchive(ctx, buildpack, destination)
 	if err == nil {
-		return nil
+		return installation{digest: digest}, nil
 	}
 
-	if _, ok := err.(NotZipFileError); !ok {
-		return err
+	archiveErr, ok := err.(UnsupportedArchiveError)
+	if !ok {
+		return installation{}, err
 	}
 
-	buildpackURL, err := url.Parse(buildpack.URL)
+	result, err := b.installFromGit(ctx, buildpack, buildpackURL, destination)
 	if err != nil {
-		return fmt.Errorf("invalid buildpack url (%s): %s", buildpack.URL, err.Error())
+		return installation{}, fmt.Errorf("%s, and the download is %s", err.Error(), archiveErr.Error())
 	}
 
-	return GitClone(*buildpackURL, destination)
+	return result, nil
 }
 
-func (b *BuildpackManager) installFromArchive(buildpack builder.Buildpack, buildpackPath string) error {
+func (b *BuildpackManager) installFromGit(ctx context.Context, buildpack builder.Buildpack, buildpackURL *url.URL, destination string) (installation, error) {
+	if buildpack.SHA256 != "" {
+		return installation{}, fmt.Errorf("buildpack %s declares a sha256 checksum but is not an archive", buildpack.Name)
+	}
+
+	revision, err := GitClone(ctx, *buildpackURL, destination, b.gitCredentials)
+	if err != nil {
+		return installation{}, err
+	}
+
+	return installation{revision: revision}, nil
+}
+
+// scpLikeURL matches the scp-like syntax git accepts for ssh, as in
+// git@github.com:org/repo.git, which is not a URL.
+var scpLikeURL = regexp.MustCompile(`^(?:([^@/:]+)@)?([^@/:]+):([^/].*|/[^/].*)$`)
+
+// parseBuildpackURL parses the URL of a buildpack. An scp-like git location
+// is turned into the equivalent ssh URL, where ~ keeps a relative path
+// relative to the home directory.
+func parseBuildpackURL(rawURL string) (*url.URL, error) {
+	match := scpLikeURL.FindStringSubmatch(rawURL)
+	if match == nil {
+		return url.Parse(rawURL)
+	}
+
+	user, host, path := match[1], match[2], match[3]
+	if !strings.HasPrefix(path, "/") {
+		path = "/~/" + path
+	}
+	if user != "" {
+		host = user + "@" + host
+	}
+
+	return url.Parse("ssh://" + host + path)
+}
+
+func isGitURL(buildpackURL *url.URL) bool {
+	return buildpackURL.Scheme == "ssh" ||
+		buildpackURL.Scheme == "git" ||
+		strings.HasSuffix(buildpackURL.Path, ".git")
+}
+
+func (b *BuildpackManager) installFromArchive(ctx context.Context, buildpack builder.Buildpack, buildpackPath string) (string, error) {
 	tmpDir, err := ioutil.TempDir("", "buildpacks")
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	bytes, err := OpenBuildpackURL(buildpack.URL, b.internalClient)
+	fileName := filepath.Join(tmpDir, fmt.Sprintf("buildback-%d-.archive", time.Now().Nanosecond()))
+	file, err := os.Create(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		file.Close()
+		os.RemoveAll(tmpDir)
+	}()
+
+	err = DownloadBuildpack(ctx, buildpack.URL, b.internalClient, b.retryPolicy, file)
 	if err != nil {
-		var err2 error
-		bytes, err2 = OpenBuildpackURL(buildpack.URL, b.defaultClient)
+		err2 := DownloadBuildpack(ctx, buildpack.URL, b.defaultClient, b.retryPolicy, file)
 		if err2 != nil {
-			return errors.Wrap(err, fmt.Sprintf("default client also failed: %s", err2.Error()))
+			return "", errors.Wrap(err, fmt.Sprintf("default client also failed: %s", err2.Error()))
 		}
 	}
 
-	fileName := filepath.Join(tmpDir, fmt.Sprintf("buildback-%d-.zip", time.Now().Nanosecond()))
-	defer func() {
-		err = os.Remove(fileName)
-	}()
+	if err = file.Close(); err != nil {
+		return "", err
+	}
 
-	err = ioutil.WriteFile(fileName, bytes, 0777)
+	digest, err := sha256File(fileName)
 	if err != nil {
-		return err
+		return "", errors.Wrap(err, "failed to compute buildpack checksum")
+	}
+
+	if buildpack.SHA256 != "" && !strings.EqualFold(buildpack.SHA256, digest) {
+		return "", ChecksumMismatchError{Buildpack: buildpack.Name, Expected: buildpack.SHA256, Actual: digest}
 	}
 
 	err = os.MkdirAll(buildpackPath, 0777)
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	err = b.extractor.Extract(ctx, fileName, buildpackPath)
+	if err != nil {
+		return "", err
 	}
 
-	err = b.unzipper.Extract(fileName, buildpackPath)
+	return digest, nil
+}
+
+func sha256File(path string) (string, error) {
+	file, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (b *BuildpackManager) writeMapJSON(fileName string, values map[string]string) error {
+	bytes, err := json.Marshal(values)
 	if err != nil {
-		return NotZipFileError{err: err}
+		return err
 	}
 
-	return err
+	return ioutil.WriteFile(filepath.Join(b.buildpackDir, fileName), bytes, 0644)
 }
 
 func (b *BuildpackManager) writeBuildpackJSON(buildpacks []builder.Buildpack) error {
@@ -1,7 +1,10 @@
 package eirinistaging_test
 
 import (
+	"context"
+	"io/ioutil"
 	"net/http"
+	"os"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -32,7 +35,16 @@ var _ = Describe("BuildpackManager", func() {
 
 		JustBeforeEach(func() {
 			expectedBytes = []byte(responseContent)
-			actualBytes, err = eirinistaging.OpenBuildpackURL(buildpack.URL, client)
+
+			destination, tmpErr := ioutil.TempFile("", "buildpack")
+			Expect(tmpErr).NotTo(HaveOccurred())
+			defer os.Remove(destination.Name())
+			defer destination.Close()
+
+			err = eirinistaging.DownloadBuildpack(context.Background(), buildpack.URL, client, eirinistaging.NewRetryPolicy(1, 0, 0), destination)
+			if err == nil {
+				actualBytes, err = ioutil.ReadFile(destination.Name())
+			}
 		})
 
 		Context("and it is a valid URL", func() {
@@ -1,7 +1,10 @@
 package eirinistaging_test
 
 import (
+	"context"
 	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -11,6 +14,9 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -28,13 +34,16 @@ var _ = Describe("Buildpackmanager", func() {
 		buildpacksJSON   []byte
 		buildpackManager eirinistaging.Installer
 		buildpacks       []builder.Buildpack
+		installWorkers   int
 		server           *ghttp.Server
 		responseContent  []byte
+		gitCredentials   eirinistaging.GitCredentials
 		err              error
 	)
 
 	BeforeEach(func() {
 		client = http.DefaultClient
+		gitCredentials = eirinistaging.GitCredentials{}
 
 		buildpackDir, err = ioutil.TempDir("", "buildpacks")
 		Expect(err).ToNot(HaveOccurred())
@@ -42,26 +51,19 @@ var _ = Describe("Buildpackmanager", func() {
 		responseContent, err = makeZippedPackage()
 		Expect(err).ToNot(HaveOccurred())
 
-		server = ghttp.NewServer()
-		server.AppendHandlers(
-			ghttp.CombineHandlers(
-				ghttp.VerifyRequest("GET", "/my-buildpack"),
-				ghttp.RespondWith(http.StatusOK, responseContent),
-			),
-			ghttp.CombineHandlers(
-				ghttp.VerifyRequest("GET", "/your-buildpack"),
-				ghttp.RespondWith(http.StatusOK, responseContent),
-			),
-		)
+		installWorkers = eirinistaging.BuildpackInstallWorkers
 
+		server = ghttp.NewServer()
+		server.RouteToHandler("GET", "/my-buildpack", ghttp.RespondWith(http.StatusOK, responseContent))
+		server.RouteToHandler("GET", "/your-buildpack", ghttp.RespondWith(http.StatusOK, responseContent))
 	})
 
 	JustBeforeEach(func() {
 		buildpacksJSON, err = json.Marshal(buildpacks)
 		Expect(err).NotTo(HaveOccurred())
 
-		buildpackManager = eirinistaging.NewBuildpackManager(client, client, buildpackDir, string(buildpacksJSON))
-		err = buildpackManager.Install()
+		buildpackManager = eirinistaging.NewBuildpackManager(client, client, buildpackDir, string(buildpacksJSON), installWorkers, eirinistaging.NewRetryPolicy(1, 0, 0), gitCredentials)
+		err = buildpackManager.Install(context.Background())
 	})
 
 	Context("When a list of Buildpacks needs be installed", func() {
@@ -107,6 +109,108 @@ var _ = Describe("Buildpackmanager", func() {
 		})
 	})
 
+	Context("When multiple buildpacks are installed concurrently", func() {
+		var (
+			inFlight    int
+			maxInFlight int
+			lock        sync.Mutex
+		)
+
+		BeforeEach(func() {
+			inFlight, maxInFlight = 0, 0
+			installWorkers = 2
+
+			slowHandler := func(w http.ResponseWriter, r *http.Request) {
+				defer GinkgoRecover()
+
+				lock.Lock()
+				inFlight++
+				if inFlight > maxInFlight {
+					maxInFlight = inFlight
+				}
+				lock.Unlock()
+
+				time.Sleep(10 * time.Millisecond)
+
+				lock.Lock()
+				inFlight--
+				lock.Unlock()
+
+				_, writeErr := w.Write(responseContent)
+				Expect(writeErr).NotTo(HaveOccurred())
+			}
+
+			buildpacks = []builder.Buildpack{}
+			for _, name := range []string{"first", "second", "third", "fourth"} {
+				server.RouteToHandler("GET", "/"+name, slowHandler)
+				buildpacks = append(buildpacks, builder.Buildpack{
+					Name: name + "_buildpack",
+					Key:  name + "-key",
+					URL:  fmt.Sprintf("%s/%s", server.URL(), name),
+				})
+			}
+		})
+
+		It("should not fail", func() {
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("should not exceed the number of install workers", func() {
+			Expect(maxInFlight).To(BeNumerically("<=", 2))
+		})
+
+		It("should write the buildpacks to the config.json in the provided order", func() {
+			var actualBytes []byte
+			actualBytes, err = ioutil.ReadFile(filepath.Join(buildpackDir, "config.json"))
+			Expect(err).ToNot(HaveOccurred())
+
+			var actualBuildpacks []builder.Buildpack
+			err = json.Unmarshal(actualBytes, &actualBuildpacks)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(actualBuildpacks).To(Equal(buildpacks))
+		})
+
+		Context("and the downloads depend on each other running", func() {
+			BeforeEach(func() {
+				var arrived sync.WaitGroup
+				arrived.Add(2)
+
+				bothArrived := make(chan struct{})
+				go func() {
+					arrived.Wait()
+					close(bothArrived)
+				}()
+
+				waitForOther := func(w http.ResponseWriter, r *http.Request) {
+					defer GinkgoRecover()
+
+					arrived.Done()
+					select {
+					case <-bothArrived:
+						_, writeErr := w.Write(responseContent)
+						Expect(writeErr).NotTo(HaveOccurred())
+					case <-time.After(5 * time.Second):
+						w.WriteHeader(http.StatusRequestTimeout)
+					}
+				}
+
+				buildpacks = []builder.Buildpack{}
+				for _, name := range []string{"first", "second"} {
+					server.RouteToHandler("GET", "/"+name, waitForOther)
+					buildpacks = append(buildpacks, builder.Buildpack{
+						Name: name + "_buildpack",
+						Key:  name + "-key",
+						URL:  fmt.Sprintf("%s/%s", server.URL(), name),
+					})
+				}
+			})
+
+			It("should download them at the same time", func() {
+				Expect(err).ToNot(HaveOccurred())
+			})
+		})
+	})
+
 	Context("When a single buildpack with skip detect is provided", func() {
 		BeforeEach(func() {
 			buildpacks = []builder.Buildpack{
@@ -173,6 +277,172 @@ var _ = Describe("Buildpackmanager", func() {
 		})
 	})
 
+	Context("When the internal client fails while streaming the buildpack", func() {
+		BeforeEach(func() {
+			truncatedContent := responseContent[:len(responseContent)/2]
+
+			server = ghttp.NewServer()
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/my-buildpack"),
+					func(w http.ResponseWriter, r *http.Request) {
+						w.Header().Set("Content-Length", fmt.Sprintf("%d", len(responseContent)))
+						_, writeErr := w.Write(truncatedContent)
+						Expect(writeErr).NotTo(HaveOccurred())
+					},
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/my-buildpack"),
+					ghttp.RespondWith(http.StatusOK, responseContent),
+				),
+			)
+
+			buildpacks = []builder.Buildpack{
+				{
+					Name: "my_buildpack",
+					Key:  "my-key",
+					URL:  fmt.Sprintf("%s/my-buildpack", server.URL()),
+				},
+			}
+		})
+
+		It("should install the buildpack with the default client", func() {
+			Expect(err).ToNot(HaveOccurred())
+			Expect(server.ReceivedRequests()).To(HaveLen(2))
+		})
+	})
+
+	Context("When a buildpack declares a sha256 checksum", func() {
+		var expectedDigest string
+
+		BeforeEach(func() {
+			digest := sha256.Sum256(responseContent)
+			expectedDigest = hex.EncodeToString(digest[:])
+
+			buildpacks = []builder.Buildpack{
+				{
+					Name:   "my_buildpack",
+					Key:    "my-key",
+					URL:    fmt.Sprintf("%s/my-buildpack", server.URL()),
+					SHA256: expectedDigest,
+				},
+			}
+		})
+
+		It("should not fail", func() {
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("should record the computed digest next to the config.json", func() {
+			var actualBytes []byte
+			actualBytes, err = ioutil.ReadFile(filepath.Join(buildpackDir, "checksums.json"))
+			Expect(err).ToNot(HaveOccurred())
+
+			var checksums map[string]string
+			err = json.Unmarshal(actualBytes, &checksums)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(checksums).To(Equal(map[string]string{"my_buildpack": expectedDigest}))
+		})
+
+		Context("and the checksum does not match", func() {
+			BeforeEach(func() {
+				buildpacks[0].SHA256 = strings.Repeat("0", 64)
+			})
+
+			It("should fail with a descriptive error", func() {
+				Expect(err).To(MatchError(ContainSubstring(
+					fmt.Sprintf("checksum mismatch for buildpack my_buildpack: expected sha256 %s, got %s", strings.Repeat("0", 64), expectedDigest),
+				)))
+			})
+
+			It("should not extract the buildpack", func() {
+				Expect(builder.BuildpackPath(buildpackDir, "my_buildpack")).NotTo(BeADirectory())
+			})
+
+			It("should not write a config.json", func() {
+				Expect(filepath.Join(buildpackDir, "config.json")).NotTo(BeAnExistingFile())
+			})
+		})
+	})
+
+	Context("When several buildpacks fail to install", func() {
+		BeforeEach(func() {
+			server.RouteToHandler("GET", "/bad-buildpack.zip", ghttp.RespondWith(http.StatusInternalServerError, nil))
+			server.RouteToHandler("GET", "/worse-buildpack.zip", ghttp.RespondWith(http.StatusInternalServerError, nil))
+
+			buildpacks = []builder.Buildpack{
+				{
+					Name: "bad_buildpack",
+					Key:  "bad-key",
+					URL:  fmt.Sprintf("%s/bad-buildpack.zip", server.URL()),
+				},
+				{
+					Name: "my_buildpack",
+					Key:  "my-key",
+					URL:  fmt.Sprintf("%s/my-buildpack", server.URL()),
+				},
+				{
+					Name: "worse_buildpack",
+					Key:  "worse-key",
+					URL:  fmt.Sprintf("%s/worse-buildpack.zip", server.URL()),
+				},
+			}
+		})
+
+		It("should report every failed buildpack", func() {
+			Expect(err).To(MatchError(ContainSubstring("installing buildpack bad_buildpack")))
+			Expect(err).To(MatchError(ContainSubstring("installing buildpack worse_buildpack")))
+			Expect(err).NotTo(MatchError(ContainSubstring("installing buildpack my_buildpack")))
+		})
+
+		It("should not write a config.json", func() {
+			Expect(filepath.Join(buildpackDir, "config.json")).NotTo(BeAnExistingFile())
+		})
+	})
+
+	Context("When the buildpack is a gzipped tarball", func() {
+		BeforeEach(func() {
+			var tarball []byte
+			tarball, err = ioutil.ReadFile("testdata/untar_me.tar.gz")
+			Expect(err).ToNot(HaveOccurred())
+			server.RouteToHandler("GET", "/tgz-buildpack", ghttp.RespondWith(http.StatusOK, tarball))
+
+			buildpacks = []builder.Buildpack{
+				{
+					Name: "tgz_buildpack",
+					Key:  "tgz-key",
+					URL:  fmt.Sprintf("%s/tgz-buildpack", server.URL()),
+				},
+			}
+		})
+
+		It("should extract the buildpack", func() {
+			Expect(err).ToNot(HaveOccurred())
+
+			buildpackPath := builder.BuildpackPath(buildpackDir, "tgz_buildpack")
+			Expect(filepath.Join(buildpackPath, "innerDir", "innermostDir", "file3")).To(BeAnExistingFile())
+		})
+	})
+
+	Context("When the buildpack is a corrupt gzipped tarball", func() {
+		BeforeEach(func() {
+			server.RouteToHandler("GET", "/corrupt-buildpack", ghttp.RespondWith(http.StatusOK, []byte{0x1f, 0x8b, 0x00}))
+
+			buildpacks = []builder.Buildpack{
+				{
+					Name: "corrupt_buildpack",
+					Key:  "corrupt-key",
+					URL:  fmt.Sprintf("%s/corrupt-buildpack", server.URL()),
+				},
+			}
+		})
+
+		It("should fail without trying to git clone", func() {
+			Expect(err).To(HaveOccurred())
+			Expect(err).NotTo(MatchError(ContainSubstring("Failed to clone git repository")))
+		})
+	})
+
 	Context("When the buildpack file is invalid zip", func() {
 		BeforeEach(func() {
 			server = ghttp.NewServer()
@@ -204,6 +474,29 @@ var _ = Describe("Buildpackmanager", func() {
 			Expect(err).To(HaveOccurred())
 			Expect(err).To(MatchError(ContainSubstring("Failed to clone git repository")))
 		})
+
+		It("should explain that the download is not a supported archive", func() {
+			Expect(err).To(MatchError(ContainSubstring("not a supported archive")))
+		})
+	})
+
+	Context("When the buildpack url points to a missing git repository", func() {
+		BeforeEach(func() {
+			buildpacks = []builder.Buildpack{
+				{
+					Name: "my_buildpack",
+					Key:  "my-key",
+					URL:  fmt.Sprintf("%s/private-buildpack.git", server.URL()),
+				},
+			}
+			server.SetAllowUnhandledRequests(true)
+			server.SetUnhandledRequestStatusCode(http.StatusNotFound)
+		})
+
+		It("should clone without downloading the url first", func() {
+			Expect(err).To(MatchError(ContainSubstring("Failed to clone git repository")))
+			Expect(err).NotTo(MatchError(ContainSubstring("not a supported archive")))
+		})
 	})
 
 	Context("when the buildpack url is a git repo", func() {
@@ -289,6 +582,73 @@ var _ = Describe("Buildpackmanager", func() {
 			It("should succeed cloning the buildpack", func() {
 				Expect(err).NotTo(HaveOccurred())
 			})
+
+			It("should record the cloned revision next to the config.json", func() {
+				var actualBytes []byte
+				actualBytes, err = ioutil.ReadFile(filepath.Join(buildpackDir, builder.RevisionsFileName))
+				Expect(err).ToNot(HaveOccurred())
+
+				var revisions map[string]string
+				err = json.Unmarshal(actualBytes, &revisions)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(revisions).To(Equal(map[string]string{"buildpack": headOf(filepath.Join(tmpDir, "fake-buildpack"), "master")}))
+			})
+		})
+
+		Context("with an scp-like ssh location", func() {
+			var (
+				originalPath string
+				sshArgsPath  string
+			)
+
+			BeforeEach(func() {
+				// a fake ssh runs the git command it is given locally, in a
+				// home directory that holds the repository
+				binDir := filepath.Join(tmpDir, "bin")
+				Expect(os.Mkdir(binDir, 0755)).To(Succeed())
+				sshArgsPath = filepath.Join(tmpDir, "ssh-args")
+				writeFile(filepath.Join(binDir, "ssh"), fmt.Sprintf(`#!/bin/sh
+printf '%%s\n' "$@" > '%s'
+for command; do :; done
+HOME='%s' exec sh -c "$command"
+`, sshArgsPath, tmpDir))
+				Expect(os.Chmod(filepath.Join(binDir, "ssh"), 0755)).To(Succeed())
+
+				originalPath = os.Getenv("PATH")
+				Expect(os.Setenv("PATH", binDir+":"+originalPath)).To(Succeed())
+
+				writeFile(filepath.Join(tmpDir, "ssh-privatekey"), "key")
+				writeFile(filepath.Join(tmpDir, "known_hosts"), "git.example.com ssh-ed25519 AAAA")
+				gitCredentials = eirinistaging.GitCredentials{
+					SSHKeyPath:     filepath.Join(tmpDir, "ssh-privatekey"),
+					KnownHostsPath: filepath.Join(tmpDir, "known_hosts"),
+				}
+
+				buildpacks = []builder.Buildpack{
+					{
+						Name: "buildpack",
+						Key:  "key",
+						URL:  "git@git.example.com:fake-buildpack/.git",
+					},
+				}
+
+				cloneTarget = builder.BuildpackPath(buildpackDir, buildpacks[0].Name)
+			})
+
+			AfterEach(func() {
+				Expect(os.Setenv("PATH", originalPath)).To(Succeed())
+			})
+
+			It("clones the repository over ssh with the key", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(filepath.Join(cloneTarget, "content")).To(BeARegularFile())
+
+				sshArgs, readErr := ioutil.ReadFile(sshArgsPath)
+				Expect(readErr).NotTo(HaveOccurred())
+				Expect(string(sshArgs)).To(ContainSubstring("git@git.example.com\n"))
+				Expect(string(sshArgs)).To(ContainSubstring("IdentitiesOnly=yes\n-i\n"))
+				Expect(string(sshArgs)).To(ContainSubstring("'~/fake-buildpack/.git'"))
+			})
 		})
 	})
 })
@@ -0,0 +1,88 @@
+package eirinistaging
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// CacheInstaller downloads the build artifacts cache of the previous staging.
+// The cache only speeds staging up, so failing to fetch it is not an error.
+type CacheInstaller struct {
+	client      *http.Client
+	downloadURL string
+	downloadDir string
+	retryPolicy RetryPolicy
+}
+
+func NewCacheInstaller(client *http.Client, downloadURL, downloadDir string, retryPolicy RetryPolicy) Installer {
+	return &CacheInstaller{
+		client:      client,
+		downloadURL: downloadURL,
+		downloadDir: downloadDir,
+		retryPolicy: retryPolicy,
+	}
+}
+
+func (c *CacheInstaller) Install(ctx context.Context) error {
+	downloadPath := filepath.Join(c.downloadDir, BuildArtifactsCacheBits)
+	if err := c.download(ctx, downloadPath); err != nil {
+		log.Printf("warning: build artifacts cache not downloaded, staging without it: %s", redactError(err))
+		os.Remove(downloadPath)
+	}
+
+	return nil
+}
+
+func (c *CacheInstaller) download(ctx context.Context, downloadPath string) error {
+	file, err := os.Create(downloadPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err = c.retryPolicy.Download(ctx, c.client, c.downloadURL, file); err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+// RestoreBuildArtifactsCache extracts the cache downloaded by the
+// CacheInstaller into cacheDir. A missing or corrupt cache leaves cacheDir
+// empty so that the buildpacks start from scratch.
+func RestoreBuildArtifactsCache(ctx context.Context, extractor Extractor, cachePath, cacheDir string) {
+	if _, err := os.Stat(cachePath); err != nil {
+		log.Println("No build artifacts cache to restore")
+		return
+	}
+
+	log.Println("Restoring build artifacts cache")
+	if err := extractor.Extract(ctx, cachePath, cacheDir); err != nil {
+		log.Printf("warning: build artifacts cache could not be restored, staging without it: %s", err.Error())
+		if err = emptyDir(cacheDir); err != nil {
+			log.Printf("warning: failed to clean up the build artifacts cache: %s", err.Error())
+		}
+	}
+}
+
+func emptyDir(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
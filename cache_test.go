@@ -0,0 +1,145 @@
+package eirinistaging_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/onsi/gomega/ghttp"
+
+	eirinistaging "code.cloudfoundry.org/eirini-staging"
+)
+
+var _ = Describe("Build artifacts cache", func() {
+	var (
+		logOut *gbytes.Buffer
+		err    error
+	)
+
+	BeforeEach(func() {
+		logOut = gbytes.NewBuffer()
+		log.SetOutput(logOut)
+	})
+
+	AfterEach(func() {
+		log.SetOutput(os.Stderr)
+	})
+
+	Describe("CacheInstaller", func() {
+		var (
+			server      *ghttp.Server
+			downloadDir string
+			cacheBits   []byte
+		)
+
+		BeforeEach(func() {
+			cacheBits, err = ioutil.ReadFile("testdata/untar_me.tar.gz")
+			Expect(err).NotTo(HaveOccurred())
+
+			downloadDir, err = ioutil.TempDir("", "cache-download")
+			Expect(err).NotTo(HaveOccurred())
+
+			server = ghttp.NewServer()
+		})
+
+		JustBeforeEach(func() {
+			installer := eirinistaging.NewCacheInstaller(http.DefaultClient, server.URL()+"/cache", downloadDir, eirinistaging.NewRetryPolicy(1, 0, 0))
+			err = installer.Install(context.Background())
+		})
+
+		AfterEach(func() {
+			server.Close()
+			Expect(os.RemoveAll(downloadDir)).To(Succeed())
+		})
+
+		Context("when there is a previous cache", func() {
+			BeforeEach(func() {
+				server.AppendHandlers(ghttp.RespondWith(http.StatusOK, cacheBits))
+			})
+
+			It("downloads it next to the app bits", func() {
+				Expect(err).NotTo(HaveOccurred())
+
+				downloaded, readErr := ioutil.ReadFile(filepath.Join(downloadDir, eirinistaging.BuildArtifactsCacheBits))
+				Expect(readErr).NotTo(HaveOccurred())
+				Expect(bytes.Equal(downloaded, cacheBits)).To(BeTrue())
+			})
+		})
+
+		Context("when there is no previous cache", func() {
+			BeforeEach(func() {
+				server.AppendHandlers(ghttp.RespondWith(http.StatusNotFound, nil))
+			})
+
+			It("only warns", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(logOut).To(gbytes.Say("warning: build artifacts cache not downloaded"))
+				Expect(filepath.Join(downloadDir, eirinistaging.BuildArtifactsCacheBits)).NotTo(BeAnExistingFile())
+			})
+		})
+	})
+
+	Describe("RestoreBuildArtifactsCache", func() {
+		var (
+			cachePath string
+			cacheDir  string
+		)
+
+		BeforeEach(func() {
+			cacheDir, err = ioutil.TempDir("", "cache")
+			Expect(err).NotTo(HaveOccurred())
+			cachePath = "testdata/untar_me.tar.gz"
+		})
+
+		JustBeforeEach(func() {
+			eirinistaging.RestoreBuildArtifactsCache(context.Background(), &eirinistaging.TarGzipExtractor{}, cachePath, cacheDir)
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(cacheDir)).To(Succeed())
+		})
+
+		It("extracts the cache", func() {
+			Expect(filepath.Join(cacheDir, "file1")).To(BeAnExistingFile())
+		})
+
+		Context("when no cache was downloaded", func() {
+			BeforeEach(func() {
+				cachePath = filepath.Join(cacheDir, "missing.tgz")
+			})
+
+			It("logs that there is nothing to restore", func() {
+				Expect(logOut).To(gbytes.Say("No build artifacts cache to restore"))
+			})
+		})
+
+		Context("when the cache is corrupt", func() {
+			BeforeEach(func() {
+				cacheBits, readErr := ioutil.ReadFile("testdata/untar_me.tar.gz")
+				Expect(readErr).NotTo(HaveOccurred())
+
+				cachePath = filepath.Join(cacheDir, "..", filepath.Base(cacheDir)+"-truncated.tgz")
+				Expect(ioutil.WriteFile(cachePath, cacheBits[:len(cacheBits)*2/3], 0644)).To(Succeed())
+			})
+
+			AfterEach(func() {
+				Expect(os.Remove(cachePath)).To(Succeed())
+			})
+
+			It("warns and leaves the cache dir empty", func() {
+				Expect(logOut).To(gbytes.Say("warning: build artifacts cache could not be restored"))
+
+				entries, readErr := ioutil.ReadDir(cacheDir)
+				Expect(readErr).NotTo(HaveOccurred())
+				Expect(entries).To(BeEmpty())
+			})
+		})
+	})
+})
@@ -1,10 +1,16 @@
 package cmd
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
+	"time"
 
 	eirinistaging "code.cloudfoundry.org/eirini-staging"
+	"code.cloudfoundry.org/eirini-staging/builder"
+	"github.com/pkg/errors"
 )
 
 func CreateResponder(certPath string) (eirinistaging.Responder, error) {
@@ -18,3 +24,145 @@ func CreateResponder(certPath string) (eirinistaging.Responder, error) {
 
 	return eirinistaging.NewResponder(stagingGUID, completionCallback, eiriniAddress, cacert, cert, key)
 }
+
+func CreateRetryPolicy() (eirinistaging.RetryPolicy, error) {
+	maxAttempts := eirinistaging.DownloadMaxAttempts
+	if value, ok := os.LookupEnv(eirinistaging.EnvDownloadMaxAttempts); ok {
+		var err error
+		maxAttempts, err = strconv.Atoi(value)
+		if err != nil || maxAttempts < 1 {
+			return eirinistaging.RetryPolicy{}, fmt.Errorf("invalid value for %s: %q", eirinistaging.EnvDownloadMaxAttempts, value)
+		}
+	}
+
+	initialBackoff, err := lookupDuration(eirinistaging.EnvDownloadInitialBackoff, eirinistaging.DownloadInitialBackoff)
+	if err != nil {
+		return eirinistaging.RetryPolicy{}, err
+	}
+
+	maxBackoff, err := lookupDuration(eirinistaging.EnvDownloadMaxBackoff, eirinistaging.DownloadMaxBackoff)
+	if err != nil {
+		return eirinistaging.RetryPolicy{}, err
+	}
+
+	return eirinistaging.NewRetryPolicy(maxAttempts, initialBackoff, maxBackoff), nil
+}
+
+// OutputBuildArtifactsCache returns where the executor writes the build
+// artifacts cache for the uploader. The default name follows the compression
+// of the cache.
+func OutputBuildArtifactsCache() string {
+	if location, ok := os.LookupEnv(eirinistaging.EnvOutputBuildArtifactsCache); ok {
+		return location
+	}
+
+	if os.Getenv(eirinistaging.EnvCacheCompression) == string(builder.CompressionZstd) {
+		return eirinistaging.RecipeOutputZstdCache
+	}
+	return eirinistaging.RecipeOutputBuildArtifactsCache
+}
+
+// ConfigureTimeouts reads the timeouts of the whole staging and of each
+// buildpack phase. Unset or zero timeouts do not limit anything.
+func ConfigureTimeouts(conf *builder.Config) error {
+	stagingTimeout, err := lookupDuration(eirinistaging.EnvStagingTimeout, 0)
+	if err != nil {
+		return err
+	}
+	conf.StagingTimeout = stagingTimeout
+
+	phaseTimeoutEnvs := map[builder.Phase]string{
+		builder.PhaseDetect:   eirinistaging.EnvDetectTimeout,
+		builder.PhaseSupply:   eirinistaging.EnvSupplyTimeout,
+		builder.PhaseFinalize: eirinistaging.EnvFinalizeTimeout,
+		builder.PhaseCompile:  eirinistaging.EnvCompileTimeout,
+		builder.PhaseRelease:  eirinistaging.EnvReleaseTimeout,
+		builder.PhaseBuild:    eirinistaging.EnvBuildTimeout,
+	}
+
+	conf.PhaseTimeouts = map[builder.Phase]time.Duration{}
+	for phase, envName := range phaseTimeoutEnvs {
+		timeout, err := lookupDuration(envName, 0)
+		if err != nil {
+			return err
+		}
+		if timeout > 0 {
+			conf.PhaseTimeouts[phase] = timeout
+		}
+	}
+
+	return nil
+}
+
+// LoadStagingEnvironment reads the environment of the app being staged from
+// EIRINI_STAGING_ENV or, when that is not set, from a mounted file. Staging
+// without a mounted file gives the buildpacks no app environment.
+func LoadStagingEnvironment() (builder.StagingEnvironment, error) {
+	if value, ok := os.LookupEnv(eirinistaging.EnvStagingEnv); ok {
+		return builder.ParseStagingEnvironment([]byte(value))
+	}
+
+	path, ok := os.LookupEnv(eirinistaging.EnvStagingEnvPath)
+	if !ok {
+		path = eirinistaging.StagingEnvMountPath
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && !ok {
+		return builder.StagingEnvironment{}, nil
+	}
+	if err != nil {
+		return builder.StagingEnvironment{}, errors.Wrap(err, "failed to read the staging environment")
+	}
+
+	return builder.ParseStagingEnvironment(contents)
+}
+
+func lookupDuration(envName string, defaultValue time.Duration) (time.Duration, error) {
+	value, ok := os.LookupEnv(envName)
+	if !ok {
+		return defaultValue, nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		return 0, fmt.Errorf("invalid value for %s: %q", envName, value)
+	}
+
+	return duration, nil
+}
+
+func CreateUnzipper() (*eirinistaging.Unzipper, error) {
+	maxTotalSize := int64(eirinistaging.UnzipMaxTotalSize)
+	if value, ok := os.LookupEnv(eirinistaging.EnvUnzipMaxTotalSize); ok {
+		var err error
+		maxTotalSize, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || maxTotalSize < 0 {
+			return nil, fmt.Errorf("invalid value for %s: %q", eirinistaging.EnvUnzipMaxTotalSize, value)
+		}
+	}
+
+	maxEntries := eirinistaging.UnzipMaxEntries
+	if value, ok := os.LookupEnv(eirinistaging.EnvUnzipMaxEntries); ok {
+		var err error
+		maxEntries, err = strconv.Atoi(value)
+		if err != nil || maxEntries < 0 {
+			return nil, fmt.Errorf("invalid value for %s: %q", eirinistaging.EnvUnzipMaxEntries, value)
+		}
+	}
+
+	maxCompressionRatio := float64(eirinistaging.UnzipMaxCompressionRatio)
+	if value, ok := os.LookupEnv(eirinistaging.EnvUnzipMaxCompressionRatio); ok {
+		var err error
+		maxCompressionRatio, err = strconv.ParseFloat(value, 64)
+		if err != nil || maxCompressionRatio < 0 {
+			return nil, fmt.Errorf("invalid value for %s: %q", eirinistaging.EnvUnzipMaxCompressionRatio, value)
+		}
+	}
+
+	return &eirinistaging.Unzipper{
+		MaxTotalSize:        maxTotalSize,
+		MaxEntries:          maxEntries,
+		MaxCompressionRatio: maxCompressionRatio,
+	}, nil
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 
 	eirinistaging "code.cloudfoundry.org/eirini-staging"
+	"code.cloudfoundry.org/eirini-staging/builder"
 	"code.cloudfoundry.org/eirini-staging/cmd"
 	"code.cloudfoundry.org/eirini-staging/util"
 )
@@ -37,24 +40,72 @@ func main() {
 	if err != nil {
 		log.Fatal("failed to initialize responder", err)
 	}
+
+	gracePeriod, err := cmd.ShutdownGracePeriod()
+	if err != nil {
+		responder.RespondWithFailure(err)
+		log.Fatalf("invalid shutdown grace period: %s", err.Error())
+	}
+	ctx, cancel := cmd.RespondOnSignal(responder, gracePeriod, "download")
+	defer cancel()
+
+	installWorkers := eirinistaging.BuildpackInstallWorkers
+	if workers, ok := os.LookupEnv(eirinistaging.EnvBuildpackInstallWorkers); ok {
+		installWorkers, err = strconv.Atoi(workers)
+		if err == nil && installWorkers < 1 {
+			err = fmt.Errorf("must be at least 1, got %d", installWorkers)
+		}
+		if err != nil {
+			responder.RespondWithFailure(err)
+			log.Fatalf("invalid value for %s: %s", eirinistaging.EnvBuildpackInstallWorkers, err.Error())
+		}
+	}
+
+	retryPolicy, err := cmd.CreateRetryPolicy()
+	if err != nil {
+		responder.RespondWithFailure(err)
+		log.Fatalf("error creating retry policy: %s", err.Error())
+	}
+
+	gitCredentialsPath, ok := os.LookupEnv(eirinistaging.EnvGitCredentialsPath)
+	if !ok {
+		gitCredentialsPath = eirinistaging.GitCredentialsMountPath
+	}
+
+	gitCredentials, err := eirinistaging.LoadGitCredentials(gitCredentialsPath)
+	if err != nil {
+		responder.RespondWithFailure(err)
+		log.Fatalf("error loading git credentials: %s", err.Error())
+	}
+
 	downloadClient, err := createDownloadHTTPClient(certPath)
 	if err != nil {
 		responder.RespondWithFailure(err)
 		log.Fatalf("error creating http client: %s", err.Error())
 	}
 
-	buildpackManager := eirinistaging.NewBuildpackManager(downloadClient, http.DefaultClient, buildpacksDir, buildpacksJSON)
-	packageInstaller := eirinistaging.NewPackageManager(downloadClient, appBitsDownloadURL, workspaceDir)
+	buildpackManager := eirinistaging.NewBuildpackManager(downloadClient, http.DefaultClient, buildpacksDir, buildpacksJSON, installWorkers, retryPolicy, gitCredentials)
+	packageInstaller := eirinistaging.NewPackageManager(downloadClient, appBitsDownloadURL, workspaceDir, retryPolicy)
+
+	installers := []eirinistaging.Installer{buildpackManager, packageInstaller}
+	if cacheDownloadURL := os.Getenv(eirinistaging.EnvCacheDownloadURL); cacheDownloadURL != "" {
+		installers = append(installers, eirinistaging.NewCacheInstaller(downloadClient, cacheDownloadURL, workspaceDir, retryPolicy))
+	}
 
 	log.Println("Installing dependencies")
-	for _, installer := range []eirinistaging.Installer{
-		buildpackManager,
-		packageInstaller,
-	} {
-		if err = installer.Install(); err != nil {
-			responder.RespondWithFailure(err)
-			log.Fatalf("error installing: %s", err.Error())
-		}
+	installer := eirinistaging.NewConcurrentInstaller(installers...)
+	downloadStep, err := builder.TimeStep(builder.StepDownload, func() error {
+		return installer.Install(ctx)
+	})
+	if err != nil {
+		err = cmd.StepError(ctx, "download", err)
+		responder.RespondWithFailure(err)
+		log.Fatalf("error installing: %s", err.Error())
+	}
+
+	stepsPath := filepath.Join(workspaceDir, builder.StepsFileName)
+	if err = builder.WriteStepReports(stepsPath, []builder.StepReport{downloadStep}); err != nil {
+		log.Printf("warning: failed to record the download step: %s", err.Error())
 	}
 }
 
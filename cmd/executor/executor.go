@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 
 	eirinistaging "code.cloudfoundry.org/eirini-staging"
 	"code.cloudfoundry.org/eirini-staging/builder"
@@ -35,10 +38,7 @@ func main() {
 		outputDropletLocation = eirinistaging.RecipeOutputDropletLocation
 	}
 
-	outputBuildArtifactsCache, ok := os.LookupEnv(eirinistaging.EnvOutputBuildArtifactsCache)
-	if !ok {
-		outputBuildArtifactsCache = eirinistaging.RecipeOutputBuildArtifactsCache
-	}
+	outputBuildArtifactsCache := cmd.OutputBuildArtifactsCache()
 
 	outputMetadataLocation, ok := os.LookupEnv(eirinistaging.EnvOutputMetadataLocation)
 	if !ok {
@@ -65,13 +65,42 @@ func main() {
 		log.Fatal("failed to initialize responder", err)
 	}
 
-	buildDir, err := extract(downloadDir)
+	// the staging checks for cancellation while extracting the app and the
+	// cache, before each buildpack script and while creating the droplet
+	ctx, cancel := cmd.CancelOnSignal()
+	defer cancel()
+
+	extractor, err := cmd.CreateUnzipper()
 	if err != nil {
 		responder.RespondWithFailure(errors.Wrap(err, ExitReason))
 		os.Exit(exitCode)
 	}
+
+	// the downloader records its steps in the workspace, the report is
+	// informational so a missing or broken record does not fail the staging
+	steps, err := builder.ReadStepReports(filepath.Join(downloadDir, builder.StepsFileName))
+	if err != nil {
+		log.Printf("warning: failed to read the steps of the download: %s", err.Error())
+	}
+
+	var buildDir string
+	extractStep, err := builder.TimeStep(builder.StepExtract, func() error {
+		buildDir, err = extract(ctx, extractor, downloadDir)
+		return err
+	})
+	steps = append(steps, extractStep)
+	if err != nil {
+		if ctx.Err() != nil {
+			exitCode = builder.CancelFailCode
+		}
+		responder.RespondWithFailure(errors.Wrap(cmd.StepError(ctx, "extraction", err), ExitReason))
+		os.Exit(exitCode)
+	}
 	defer os.RemoveAll(buildDir)
 
+	cachePath := filepath.Join(downloadDir, eirinistaging.BuildArtifactsCacheBits)
+	eirinistaging.RestoreBuildArtifactsCache(ctx, &eirinistaging.ArchiveExtractor{}, cachePath, cacheDir)
+
 	buildConfig, err := builder.NewConfig(
 		buildDir, buildpacksDir,
 		outputDropletLocation,
@@ -84,7 +113,49 @@ func main() {
 		os.Exit(exitCode)
 	}
 
-	err = execute(&buildConfig)
+	if err = configureArchives(&buildConfig); err != nil {
+		responder.RespondWithFailure(errors.Wrap(err, ExitReason))
+		os.Exit(exitCode)
+	}
+
+	if err = configureOutput(&buildConfig); err != nil {
+		responder.RespondWithFailure(errors.Wrap(err, ExitReason))
+		os.Exit(exitCode)
+	}
+
+	if err = cmd.ConfigureTimeouts(&buildConfig); err != nil {
+		responder.RespondWithFailure(errors.Wrap(err, ExitReason))
+		os.Exit(exitCode)
+	}
+
+	buildConfig.KillGracePeriod, err = cmd.ShutdownGracePeriod()
+	if err != nil {
+		responder.RespondWithFailure(errors.Wrap(err, ExitReason))
+		os.Exit(exitCode)
+	}
+
+	buildConfig.LifecycleType = os.Getenv(eirinistaging.EnvLifecycleType)
+
+	buildConfig.TrustedCertsDir, ok = os.LookupEnv(eirinistaging.EnvTrustedCertsPath)
+	if !ok {
+		buildConfig.TrustedCertsDir = eirinistaging.TrustedCertsMountPath
+	}
+
+	buildConfig.StagingEnv, err = cmd.LoadStagingEnvironment()
+	if err != nil {
+		responder.RespondWithFailure(errors.Wrap(err, ExitReason))
+		os.Exit(exitCode)
+	}
+
+	if bindingRoot, ok := os.LookupEnv(eirinistaging.EnvServiceBindingRoot); ok {
+		err = eirinistaging.AddServiceBindings(&buildConfig.StagingEnv, bindingRoot)
+		if err != nil {
+			responder.RespondWithFailure(errors.Wrap(err, ExitReason))
+			os.Exit(exitCode)
+		}
+	}
+
+	err = execute(ctx, &buildConfig, steps)
 	if err != nil {
 		exitCode := builder.SystemFailCode
 		if withExitCode, ok := err.(builder.DescriptiveError); ok {
@@ -95,21 +166,95 @@ func main() {
 	}
 }
 
-func execute(conf *builder.Config) error {
-	runner := builder.NewRunner(conf)
+func execute(ctx context.Context, conf *builder.Config, steps []builder.StepReport) error {
+	runner, err := builder.NewLifecycle(conf)
+	if err != nil {
+		return err
+	}
 	defer runner.CleanUp()
 
-	return runner.Run()
+	runner.RecordSteps(steps...)
+	return runner.Run(ctx)
+}
+
+func configureArchives(conf *builder.Config) error {
+	if value, ok := os.LookupEnv(eirinistaging.EnvReproducibleArchives); ok {
+		reproducible, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %q", eirinistaging.EnvReproducibleArchives, value)
+		}
+		conf.ReproducibleArchives = reproducible
+	}
+
+	if value, ok := os.LookupEnv(eirinistaging.EnvCacheCompression); ok {
+		compression, err := builder.ParseCompression(value)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("invalid value for %s", eirinistaging.EnvCacheCompression))
+		}
+		conf.CacheCompression = compression
+	}
+
+	if value, ok := os.LookupEnv(eirinistaging.EnvCompressionLevel); ok {
+		level, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %q", eirinistaging.EnvCompressionLevel, value)
+		}
+
+		// the droplet is always compressed with gzip, the cache may not be
+		for _, compression := range []builder.Compression{builder.CompressionGzip, conf.CacheCompression} {
+			if err = builder.CheckCompressionLevel(compression, level); err != nil {
+				return errors.Wrap(err, fmt.Sprintf("invalid value for %s", eirinistaging.EnvCompressionLevel))
+			}
+		}
+		conf.CompressionLevel = &level
+	}
+
+	return nil
+}
+
+func configureOutput(conf *builder.Config) error {
+	conf.OutputFormat = os.Getenv(eirinistaging.EnvOutputFormat)
+	switch conf.OutputFormat {
+	case "", builder.OutputFormatDroplet:
+		return nil
+	case builder.OutputFormatLayered:
+		var ok bool
+		conf.OutputLayersLocation, ok = os.LookupEnv(eirinistaging.EnvOutputLayersLocation)
+		if !ok {
+			conf.OutputLayersLocation = eirinistaging.RecipeOutputLayersLocation
+		}
+		return nil
+	case builder.OutputFormatOCI:
+	default:
+		return fmt.Errorf("invalid value for %s: %q", eirinistaging.EnvOutputFormat, conf.OutputFormat)
+	}
+
+	var ok bool
+	conf.OutputImageLocation, ok = os.LookupEnv(eirinistaging.EnvOutputImageLocation)
+	if !ok {
+		conf.OutputImageLocation = eirinistaging.RecipeOutputImageLocation
+	}
+
+	// without a stack layer the image only holds the app, to be run on top
+	// of the stack some other way
+	if value, ok := os.LookupEnv(eirinistaging.EnvStackLayer); ok {
+		stack, err := builder.ParseStackLayer(value)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("invalid value for %s", eirinistaging.EnvStackLayer))
+		}
+		conf.StackLayer = stack
+	}
+
+	return nil
 }
 
-func extract(downloadDir string) (string, error) {
-	extractor := &eirinistaging.Unzipper{}
+func extract(ctx context.Context, extractor eirinistaging.Extractor, downloadDir string) (string, error) {
 	buildDir, err := ioutil.TempDir("", "app-bits")
 	if err != nil {
 		return "", err
 	}
 
-	err = extractor.Extract(filepath.Join(downloadDir, eirinistaging.AppBits), buildDir)
+	err = extractor.Extract(ctx, filepath.Join(downloadDir, eirinistaging.AppBits), buildDir)
 	if err != nil {
 		return "", err
 	}
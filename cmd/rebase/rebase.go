@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+
+	eirinistaging "code.cloudfoundry.org/eirini-staging"
+	"code.cloudfoundry.org/eirini-staging/builder"
+)
+
+func main() {
+	imageDir := flag.String("image", "", "OCI image layout written by a staging")
+	imageRef := flag.String("image-ref", "", "registry reference of a staged image, which is rebased in place, instead of -image")
+	credentialsDir := flag.String("registry-credentials", "", "directory with the username and password files of the registry")
+	insecure := flag.Bool("registry-insecure", false, "talk to the registry over plain http")
+	stack := flag.String("stack", "", "name of the stack the new stack layer belongs to")
+	stackLayer := flag.String("stack-layer", "", "JSON descriptor of the new stack layer: mediaType, digest, size, diffID and urls")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s (-image DIR | -image-ref REF) -stack NAME -stack-layer JSON\n\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "Replaces the stack layer of a staged image without running any buildpack.")
+		fmt.Fprintln(flag.CommandLine.Output(), "Images whose staging info does not name a stack, such as images staged by")
+		fmt.Fprintln(flag.CommandLine.Output(), "releases that did not record it, are refused and have to be restaged once.")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if (*imageDir == "") == (*imageRef == "") || *stack == "" || *stackLayer == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	layer, err := builder.ParseStackLayer(*stackLayer)
+	if err != nil {
+		log.Fatalf("invalid stack layer: %s", err.Error())
+	}
+
+	if *imageRef == "" {
+		if err = builder.Rebase(*imageDir, *stack, *layer); err != nil {
+			log.Fatalf("failed to rebase %s: %s", *imageDir, err.Error())
+		}
+		log.Printf("rebased %s onto %s layer %s", *imageDir, *stack, layer.Digest)
+		return
+	}
+
+	if err = rebaseInRegistry(*imageRef, *credentialsDir, *insecure, *stack, *layer); err != nil {
+		log.Fatalf("failed to rebase %s: %s", *imageRef, err.Error())
+	}
+	log.Printf("rebased %s onto %s layer %s", *imageRef, *stack, layer.Digest)
+}
+
+// rebaseInRegistry pulls the image, rebases it and pushes it to the same
+// reference. Only the new config and manifest are uploaded, as the registry
+// has the app layers already.
+func rebaseInRegistry(imageRef, credentialsDir string, insecure bool, stack string, layer builder.StackLayer) error {
+	var credentials eirinistaging.RegistryCredentials
+	if credentialsDir != "" {
+		var err error
+		if credentials, err = eirinistaging.LoadRegistryCredentials(credentialsDir); err != nil {
+			return err
+		}
+	}
+
+	layoutDir, err := ioutil.TempDir("", "rebase")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(layoutDir)
+
+	puller := eirinistaging.ImagePuller{Client: http.DefaultClient, Insecure: insecure, Credentials: credentials}
+	if err = puller.Pull(context.Background(), imageRef, layoutDir); err != nil {
+		return err
+	}
+
+	if err = builder.Rebase(layoutDir, stack, layer); err != nil {
+		return err
+	}
+
+	pusher := eirinistaging.ImagePusher{Client: http.DefaultClient, Insecure: insecure, Credentials: credentials}
+	return pusher.Push(context.Background(), layoutDir, imageRef)
+}
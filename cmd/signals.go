@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	eirinistaging "code.cloudfoundry.org/eirini-staging"
+	"code.cloudfoundry.org/eirini-staging/builder"
+	"github.com/pkg/errors"
+)
+
+// CancelOnSignal returns a context that is cancelled once the process is
+// asked to terminate, so that running buildpacks can be stopped.
+func CancelOnSignal() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		defer signal.Stop(signals)
+		select {
+		case sig := <-signals:
+			log.Printf("received %s, cancelling the staging", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
+
+// RespondOnSignal returns a context that is cancelled once the process is
+// asked to terminate, which aborts the transfers of the current step. The
+// step reports its failure itself, see StepError; should it not have done so
+// gracePeriod later, the staging is reported as cancelled from here, so that
+// it does not stay pending until it times out.
+func RespondOnSignal(responder eirinistaging.Responder, gracePeriod time.Duration, step string) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		defer signal.Stop(signals)
+
+		var sig os.Signal
+		select {
+		case sig = <-signals:
+		case <-ctx.Done():
+			return
+		}
+
+		log.Printf("received %s, cancelling the %s", sig, step)
+		cancel()
+		time.Sleep(gracePeriod)
+
+		responder.RespondWithFailure(builder.NewCancelledError(errors.Errorf("%s did not stop within %s of %s", step, gracePeriod, sig)))
+		os.Exit(builder.CancelFailCode)
+	}()
+
+	return ctx, cancel
+}
+
+// StepError reports the failure of a step as a cancelled staging when ctx is
+// done, as the step was then stopped because the process is terminating.
+func StepError(ctx context.Context, step string, err error) error {
+	if ctx.Err() == nil {
+		return err
+	}
+
+	return builder.NewCancelledError(errors.Wrap(err, fmt.Sprintf("%s was interrupted", step)))
+}
+
+func ShutdownGracePeriod() (time.Duration, error) {
+	return lookupDuration(eirinistaging.EnvShutdownGracePeriod, eirinistaging.ShutdownGracePeriod)
+}
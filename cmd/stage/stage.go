@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	eirinistaging "code.cloudfoundry.org/eirini-staging"
+	"code.cloudfoundry.org/eirini-staging/builder"
+	"code.cloudfoundry.org/eirini-staging/cmd"
+	"github.com/pkg/errors"
+)
+
+// cacheDirName is the directory created in -cache-dir for the cache. The
+// runner removes whatever it does not recognise from the cache, which must
+// not include files of the user.
+const cacheDirName = "eirini-stage-cache"
+
+// stringList collects the values of a flag that may be repeated.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+func main() {
+	var buildpacks, env stringList
+
+	appPath := flag.String("app", "", "app directory or zip to stage")
+	flag.Var(&buildpacks, "buildpack", "buildpack URL, archive or directory, in detection order (repeatable)")
+	outputDir := flag.String("output", ".", "directory droplet.tgz and result.json are written to")
+	cacheDir := flag.String("cache-dir", "", "directory the build artifacts cache is kept in between stagings (default: none)")
+	skipDetect := flag.Bool("skip-detect", false, "run every buildpack instead of detecting one")
+	stack := flag.String("stack", "", "stack the app is staged for (default: $CF_STACK)")
+	lifecycleType := flag.String("lifecycle", builder.LifecycleTypeBuildpack, "lifecycle to stage with: buildpack or cnb")
+	flag.Var(&env, "env", "KEY=VALUE environment variable of the app (repeatable)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s -app PATH -buildpack BUILDPACK [-buildpack BUILDPACK...]\n\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "Stages an app locally, without Kubernetes or Cloud Controller.")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *appPath == "" || len(buildpacks) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	stagingEnv := builder.StagingEnvironment{Environment: map[string]string{}, Stack: *stack}
+	for _, variable := range env {
+		parts := strings.SplitN(variable, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			log.Fatalf("invalid environment variable %q: expected KEY=VALUE", variable)
+		}
+		stagingEnv.Environment[parts[0]] = parts[1]
+	}
+
+	err := stage(options{
+		appPath:       *appPath,
+		buildpacks:    buildpacks,
+		outputDir:     *outputDir,
+		cacheDir:      *cacheDir,
+		skipDetect:    *skipDetect,
+		lifecycleType: *lifecycleType,
+		stagingEnv:    stagingEnv,
+	})
+	if err != nil {
+		exitCode := builder.SystemFailCode
+		if withExitCode, ok := err.(builder.DescriptiveError); ok {
+			exitCode = withExitCode.ExitCode
+		}
+
+		log.Printf("staging failed: %s", err.Error())
+		os.Exit(exitCode)
+	}
+
+	log.Printf("staged %s into %s", *appPath, *outputDir)
+}
+
+type options struct {
+	appPath       string
+	buildpacks    []string
+	outputDir     string
+	cacheDir      string
+	skipDetect    bool
+	lifecycleType string
+	stagingEnv    builder.StagingEnvironment
+}
+
+func stage(opts options) error {
+	ctx, cancel := cmd.CancelOnSignal()
+	defer cancel()
+
+	workDir, err := ioutil.TempDir("", "stage")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workDir)
+
+	buildpacksDir := filepath.Join(workDir, "buildpacks")
+	buildpacksJSON, err := installBuildpacks(ctx, opts.buildpacks, buildpacksDir)
+	if err != nil {
+		return errors.Wrap(err, "failed to install buildpacks")
+	}
+
+	buildDir := filepath.Join(workDir, "app")
+	if err = copyApp(ctx, opts.appPath, buildDir); err != nil {
+		return errors.Wrap(err, "failed to copy the app")
+	}
+
+	cacheDir := filepath.Join(workDir, "cache")
+	if opts.cacheDir != "" {
+		cacheDir = filepath.Join(opts.cacheDir, cacheDirName)
+	}
+
+	conf, err := builder.NewConfig(
+		buildDir, buildpacksDir,
+		filepath.Join(opts.outputDir, "droplet.tgz"),
+		filepath.Join(workDir, "cache.tgz"),
+		filepath.Join(opts.outputDir, "result.json"),
+		cacheDir, buildpacksJSON,
+	)
+	if err != nil {
+		return err
+	}
+	conf.SkipDetect = opts.skipDetect
+	conf.StagingEnv = opts.stagingEnv
+	conf.LifecycleType = opts.lifecycleType
+
+	if err = cmd.ConfigureTimeouts(&conf); err != nil {
+		return err
+	}
+
+	lifecycle, err := builder.NewLifecycle(&conf)
+	if err != nil {
+		return err
+	}
+	defer lifecycle.CleanUp()
+
+	return lifecycle.Run(ctx)
+}
+
+// installBuildpacks links buildpack directories into buildpacksDir, so that
+// changes to them apply to the next staging, and installs the others like
+// the downloader does. Local archives are read through file URLs.
+func installBuildpacks(ctx context.Context, locations []string, buildpacksDir string) (string, error) {
+	var all, remote []builder.Buildpack
+	for _, location := range locations {
+		buildpack := builder.Buildpack{Name: location, Key: location, URL: location}
+		all = append(all, buildpack)
+
+		info, err := os.Stat(location)
+		if err != nil {
+			if buildpackURL, parseErr := url.Parse(location); parseErr != nil || buildpackURL.Scheme == "" {
+				return "", fmt.Errorf("buildpack %s is neither a URL nor an existing path", location)
+			}
+			remote = append(remote, buildpack)
+			continue
+		}
+
+		path, err := filepath.Abs(location)
+		if err != nil {
+			return "", err
+		}
+
+		if !info.IsDir() {
+			buildpack.URL = "file://" + filepath.ToSlash(path)
+			remote = append(remote, buildpack)
+			continue
+		}
+
+		if err = os.MkdirAll(buildpacksDir, 0755); err != nil {
+			return "", err
+		}
+		if err = os.Symlink(path, builder.BuildpackPath(buildpacksDir, location)); err != nil {
+			return "", err
+		}
+	}
+
+	if len(remote) > 0 {
+		remoteJSON, err := json.Marshal(remote)
+		if err != nil {
+			return "", err
+		}
+
+		retryPolicy, err := cmd.CreateRetryPolicy()
+		if err != nil {
+			return "", err
+		}
+
+		transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+		transport.RegisterProtocol("file", http.NewFileTransport(http.Dir("/")))
+		client := &http.Client{Transport: transport}
+
+		manager := eirinistaging.NewBuildpackManager(client, client, buildpacksDir, string(remoteJSON), eirinistaging.BuildpackInstallWorkers, retryPolicy, eirinistaging.GitCredentials{})
+		if err = manager.Install(ctx); err != nil {
+			return "", err
+		}
+	}
+
+	allJSON, err := json.Marshal(all)
+	return string(allJSON), err
+}
+
+// copyApp places the app in buildDir, which the buildpacks change, so that
+// the app itself is left alone.
+func copyApp(ctx context.Context, appPath, buildDir string) error {
+	info, err := os.Stat(appPath)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(buildDir, 0755); err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		unzipper, err := cmd.CreateUnzipper()
+		if err != nil {
+			return err
+		}
+		return unzipper.Extract(ctx, appPath, buildDir)
+	}
+
+	output, err := exec.CommandContext(ctx, "cp", "-a", appPath+string(filepath.Separator)+".", buildDir).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err.Error(), strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -1,14 +1,19 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 
 	eirinistaging "code.cloudfoundry.org/eirini-staging"
+	"code.cloudfoundry.org/eirini-staging/builder"
 	"code.cloudfoundry.org/eirini-staging/cmd"
 	"code.cloudfoundry.org/eirini-staging/util"
+	"github.com/pkg/errors"
 )
 
 func main() {
@@ -33,11 +38,21 @@ func main() {
 		metadataLocation = eirinistaging.RecipeOutputMetadataLocation
 	}
 
+	buildArtifactsCacheLocation := cmd.OutputBuildArtifactsCache()
+
 	responder, err := cmd.CreateResponder(certPath)
 	if err != nil {
 		log.Fatal("failed to initialize responder", err)
 	}
 
+	gracePeriod, err := cmd.ShutdownGracePeriod()
+	if err != nil {
+		responder.RespondWithFailure(err)
+		log.Fatalf("invalid shutdown grace period: %s", err.Error())
+	}
+	ctx, cancel := cmd.RespondOnSignal(responder, gracePeriod, "upload")
+	defer cancel()
+
 	client, err := createUploaderHTTPClient(certPath)
 	if err != nil {
 		responder.RespondWithFailure(err)
@@ -48,13 +63,47 @@ func main() {
 		Client: client,
 	}
 
-	err = uploadClient.Upload(dropletUploadURL, dropletLocation)
+	outputFormat := os.Getenv(eirinistaging.EnvOutputFormat)
+
+	uploadStep, err := builder.TimeStep(builder.StepUpload, func() error {
+		switch outputFormat {
+		case builder.OutputFormatOCI:
+			if err := pushImage(ctx); err != nil {
+				return err
+			}
+		case builder.OutputFormatLayered:
+			layersLocation, ok := os.LookupEnv(eirinistaging.EnvOutputLayersLocation)
+			if !ok {
+				layersLocation = eirinistaging.RecipeOutputLayersLocation
+			}
+			manifestLocation := filepath.Join(filepath.Dir(metadataLocation), builder.DropletManifestName)
+			layerUploadURL := os.Getenv(eirinistaging.EnvLayerUploadURL)
+			if err := uploadClient.UploadLayers(ctx, dropletUploadURL, layerUploadURL, manifestLocation, layersLocation); err != nil {
+				return err
+			}
+		default:
+			if err := uploadClient.Upload(ctx, dropletUploadURL, dropletLocation); err != nil {
+				return err
+			}
+		}
+
+		// the next staging can do without the cache, so a failed upload does
+		// not fail this one
+		if cacheUploadURL := os.Getenv(eirinistaging.EnvCacheUploadURL); cacheUploadURL != "" {
+			if err := uploadClient.Upload(ctx, cacheUploadURL, buildArtifactsCacheLocation); err != nil {
+				log.Printf("warning: failed to upload build artifacts cache: %s", err.Error())
+			}
+		}
+
+		return nil
+	})
 	if err != nil {
+		err = cmd.StepError(ctx, "upload", err)
 		responder.RespondWithFailure(err)
 		log.Fatalf("failed to upload droplet: %s", err.Error())
 	}
 
-	resp, err := responder.PrepareSuccessResponse(metadataLocation, buildpacksConfig)
+	resp, err := responder.PrepareSuccessResponse(metadataLocation, buildpacksConfig, uploadStep)
 	if err != nil {
 		responder.RespondWithFailure(err)
 		log.Fatalf("failed to prepare response: %s", err.Error())
@@ -66,6 +115,45 @@ func main() {
 	}
 }
 
+// pushImage pushes the image the executor wrote to the registry of the image
+// reference. The registry is trusted like any other site, not through the
+// CC certificates.
+func pushImage(ctx context.Context) error {
+	imageRef := os.Getenv(eirinistaging.EnvImageReference)
+	if imageRef == "" {
+		return fmt.Errorf("%s is required to push images", eirinistaging.EnvImageReference)
+	}
+
+	imageLocation, ok := os.LookupEnv(eirinistaging.EnvOutputImageLocation)
+	if !ok {
+		imageLocation = eirinistaging.RecipeOutputImageLocation
+	}
+
+	insecure := false
+	if value, ok := os.LookupEnv(eirinistaging.EnvRegistryInsecure); ok {
+		var err error
+		if insecure, err = strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("invalid value for %s: %q", eirinistaging.EnvRegistryInsecure, value)
+		}
+	}
+
+	credentialsPath, ok := os.LookupEnv(eirinistaging.EnvRegistryCredentialsPath)
+	if !ok {
+		credentialsPath = eirinistaging.RegistryCredentialsMountPath
+	}
+	credentials, err := eirinistaging.LoadRegistryCredentials(credentialsPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to load registry credentials")
+	}
+
+	pusher := eirinistaging.ImagePusher{
+		Client:      &http.Client{},
+		Insecure:    insecure,
+		Credentials: credentials,
+	}
+	return pusher.Push(ctx, imageLocation, imageRef)
+}
+
 func createUploaderHTTPClient(certPath string) (*http.Client, error) {
 	cacert := filepath.Join(certPath, eirinistaging.CACertName)
 	cert := filepath.Join(certPath, eirinistaging.CCAPICertName)
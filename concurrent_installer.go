@@ -0,0 +1,49 @@
+package eirinistaging
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+)
+
+type ConcurrentInstaller struct {
+	installers []Installer
+}
+
+func NewConcurrentInstaller(installers ...Installer) Installer {
+	return &ConcurrentInstaller{
+		installers: installers,
+	}
+}
+
+func (c *ConcurrentInstaller) Install(ctx context.Context) error {
+	errs := make([]error, len(c.installers))
+
+	var wg sync.WaitGroup
+	for i, installer := range c.installers {
+		wg.Add(1)
+		go func(i int, installer Installer) {
+			defer wg.Done()
+			errs[i] = installer.Install(ctx)
+		}(i, installer)
+	}
+	wg.Wait()
+
+	return combineErrors(errs)
+}
+
+func combineErrors(errs []error) error {
+	messages := []string{}
+	for _, err := range errs {
+		if err != nil {
+			messages = append(messages, err.Error())
+		}
+	}
+
+	if len(messages) == 0 {
+		return nil
+	}
+
+	return errors.New(strings.Join(messages, "; "))
+}
@@ -0,0 +1,72 @@
+package eirinistaging_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	eirinistaging "code.cloudfoundry.org/eirini-staging"
+	"code.cloudfoundry.org/eirini-staging/eirinistagingfakes"
+)
+
+var _ = Describe("ConcurrentInstaller", func() {
+
+	var (
+		first     *eirinistagingfakes.FakeInstaller
+		second    *eirinistagingfakes.FakeInstaller
+		installer eirinistaging.Installer
+		err       error
+	)
+
+	BeforeEach(func() {
+		first = new(eirinistagingfakes.FakeInstaller)
+		second = new(eirinistagingfakes.FakeInstaller)
+	})
+
+	JustBeforeEach(func() {
+		installer = eirinistaging.NewConcurrentInstaller(first, second)
+		err = installer.Install(context.Background())
+	})
+
+	It("should not fail", func() {
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should run every installer once", func() {
+		Expect(first.InstallCallCount()).To(Equal(1))
+		Expect(second.InstallCallCount()).To(Equal(1))
+	})
+
+	Context("when the installers depend on each other running", func() {
+		BeforeEach(func() {
+			var started sync.WaitGroup
+			started.Add(2)
+
+			waitForOther := func(context.Context) error {
+				started.Done()
+				started.Wait()
+				return nil
+			}
+			first.InstallStub = waitForOther
+			second.InstallStub = waitForOther
+		})
+
+		It("should run them at the same time", func() {
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+
+	Context("when installers fail", func() {
+		BeforeEach(func() {
+			first.InstallReturns(errors.New("buildpacks are broken"))
+			second.InstallReturns(errors.New("app bits are broken"))
+		})
+
+		It("should report all failures in order", func() {
+			Expect(err).To(MatchError("buildpacks are broken; app bits are broken"))
+		})
+	})
+})
@@ -0,0 +1,193 @@
+package eirinistaging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+type StatusCodeError struct {
+	StatusCode int
+}
+
+func (e StatusCodeError) Error() string {
+	return fmt.Sprintf("status code %d", e.StatusCode)
+}
+
+func NewRetryPolicy(maxAttempts int, initialBackoff, maxBackoff time.Duration) RetryPolicy {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	if maxBackoff < initialBackoff {
+		maxBackoff = initialBackoff
+	}
+
+	return RetryPolicy{
+		MaxAttempts:    maxAttempts,
+		InitialBackoff: initialBackoff,
+		MaxBackoff:     maxBackoff,
+	}
+}
+
+// Download writes the body found at downloadURL to destination. Failed
+// attempts are retried with exponential backoff; when the server supports
+// range requests an interrupted transfer is resumed where it stopped. Once
+// ctx is done the transfer is aborted and not retried.
+func (p RetryPolicy) Download(ctx context.Context, client *http.Client, downloadURL string, destination *os.File) error {
+	var (
+		offset    int64
+		resumable bool
+	)
+
+	for attempt := 1; ; attempt++ {
+		var (
+			retry bool
+			err   error
+		)
+		offset, resumable, retry, err = p.attempt(ctx, client, downloadURL, destination, offset, resumable)
+		if err == nil {
+			return nil
+		}
+
+		if !retry || attempt >= p.MaxAttempts || ctx.Err() != nil {
+			return err
+		}
+
+		backoff := p.backoff(attempt)
+		log.Printf("downloading %s failed (attempt %d of %d): %s, retrying in %s", redactURL(downloadURL), attempt, p.MaxAttempts, redactError(err), backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+func (p RetryPolicy) attempt(ctx context.Context, client *http.Client, downloadURL string, destination *os.File, offset int64, resumable bool) (int64, bool, bool, error) {
+	req, err := http.NewRequest("GET", downloadURL, nil)
+	if err != nil {
+		return offset, resumable, false, err
+	}
+	req = req.WithContext(ctx)
+
+	resume := resumable && offset > 0
+	if resume {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return offset, resumable, isTransient(err), err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resume && resp.StatusCode == http.StatusPartialContent:
+		if !rangeStartsAt(resp.Header.Get("Content-Range"), offset) {
+			return offset, false, true, errors.New("server resumed the download at an unexpected offset")
+		}
+	case resp.StatusCode == http.StatusOK:
+		offset = 0
+		if err = destination.Truncate(0); err != nil {
+			return offset, false, false, err
+		}
+	default:
+		return offset, resumable, isRetryableStatus(resp.StatusCode), StatusCodeError{StatusCode: resp.StatusCode}
+	}
+
+	if _, err = destination.Seek(offset, io.SeekStart); err != nil {
+		return offset, false, false, err
+	}
+
+	resumable = resp.StatusCode == http.StatusPartialContent || resp.Header.Get("Accept-Ranges") == "bytes"
+	written, err := io.Copy(destination, resp.Body)
+	offset += written
+	if err != nil {
+		return offset, resumable, true, errors.Wrap(err, "failed to copy content to file")
+	}
+
+	return offset, resumable, false, nil
+}
+
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	backoff := p.InitialBackoff
+	for i := 1; i < attempt && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+
+	half := int64(backoff / 2)
+	if half <= 0 {
+		return backoff
+	}
+
+	// #nosec G404 jitter does not need a secure random source
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+func isTransient(err error) bool {
+	urlErr, ok := err.(*url.Error)
+	if !ok {
+		return false
+	}
+
+	if urlErr.Err == io.EOF || urlErr.Err == io.ErrUnexpectedEOF {
+		return true
+	}
+
+	_, ok = urlErr.Err.(net.Error)
+	return ok
+}
+
+func isRetryableStatus(statusCode int) bool {
+	return statusCode >= http.StatusInternalServerError ||
+		statusCode == http.StatusTooManyRequests ||
+		statusCode == http.StatusRequestTimeout
+}
+
+func rangeStartsAt(contentRange string, offset int64) bool {
+	var start, end int64
+	_, err := fmt.Sscanf(contentRange, "bytes %d-%d", &start, &end)
+	return err == nil && start == offset
+}
+
+// redactURL drops credentials and query parameters, which for signed
+// Cloud Controller URLs are secrets, before a URL is logged.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "<invalid url>"
+	}
+
+	u.User = nil
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String()
+}
+
+func redactError(err error) string {
+	if urlErr, ok := err.(*url.Error); ok {
+		redacted := *urlErr
+		redacted.URL = redactURL(urlErr.URL)
+		return redacted.Error()
+	}
+
+	return err.Error()
+}
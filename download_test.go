@@ -0,0 +1,204 @@
+package eirinistaging_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+
+	eirinistaging "code.cloudfoundry.org/eirini-staging"
+)
+
+var _ = Describe("RetryPolicy", func() {
+
+	var (
+		server      *ghttp.Server
+		destination *os.File
+		retryPolicy eirinistaging.RetryPolicy
+		content     string
+		ctx         context.Context
+		err         error
+	)
+
+	BeforeEach(func() {
+		content = "the quick brown fox jumps over the lazy dog"
+		retryPolicy = eirinistaging.NewRetryPolicy(3, time.Millisecond, 5*time.Millisecond)
+		ctx = context.Background()
+
+		server = ghttp.NewServer()
+
+		destination, err = ioutil.TempFile("", "download")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	JustBeforeEach(func() {
+		err = retryPolicy.Download(ctx, http.DefaultClient, server.URL()+"/file", destination)
+	})
+
+	AfterEach(func() {
+		server.Close()
+		destination.Close()
+		os.Remove(destination.Name())
+	})
+
+	downloadedContent := func() string {
+		bytes, readErr := ioutil.ReadFile(destination.Name())
+		Expect(readErr).NotTo(HaveOccurred())
+		return string(bytes)
+	}
+
+	Context("when the first attempt succeeds", func() {
+		BeforeEach(func() {
+			server.AppendHandlers(ghttp.RespondWith(http.StatusOK, content))
+		})
+
+		It("should download the content", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(downloadedContent()).To(Equal(content))
+			Expect(server.ReceivedRequests()).To(HaveLen(1))
+		})
+	})
+
+	Context("when the server fails temporarily", func() {
+		BeforeEach(func() {
+			server.AppendHandlers(
+				ghttp.RespondWith(http.StatusBadGateway, nil),
+				ghttp.RespondWith(http.StatusServiceUnavailable, nil),
+				ghttp.RespondWith(http.StatusOK, content),
+			)
+		})
+
+		It("should retry until the download succeeds", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(downloadedContent()).To(Equal(content))
+			Expect(server.ReceivedRequests()).To(HaveLen(3))
+		})
+	})
+
+	Context("when the server keeps failing", func() {
+		BeforeEach(func() {
+			server.RouteToHandler("GET", "/file", ghttp.RespondWith(http.StatusInternalServerError, nil))
+		})
+
+		It("should give up after the maximum number of attempts", func() {
+			Expect(err).To(Equal(eirinistaging.StatusCodeError{StatusCode: http.StatusInternalServerError}))
+			Expect(server.ReceivedRequests()).To(HaveLen(3))
+		})
+	})
+
+	Context("when the server responds with a client error", func() {
+		BeforeEach(func() {
+			server.RouteToHandler("GET", "/file", ghttp.RespondWith(http.StatusNotFound, nil))
+		})
+
+		It("should not retry", func() {
+			Expect(err).To(Equal(eirinistaging.StatusCodeError{StatusCode: http.StatusNotFound}))
+			Expect(server.ReceivedRequests()).To(HaveLen(1))
+		})
+	})
+
+	Context("when the transfer is interrupted", func() {
+		var half int
+
+		BeforeEach(func() {
+			half = len(content) / 2
+		})
+
+		interruptedHandler := func(acceptRanges string) http.HandlerFunc {
+			return func(w http.ResponseWriter, r *http.Request) {
+				defer GinkgoRecover()
+
+				if acceptRanges != "" {
+					w.Header().Set("Accept-Ranges", acceptRanges)
+				}
+				w.Header().Set("Content-Length", fmt.Sprintf("%d", len(content)))
+				_, writeErr := w.Write([]byte(content[:half]))
+				Expect(writeErr).NotTo(HaveOccurred())
+			}
+		}
+
+		Context("and the server supports range requests", func() {
+			BeforeEach(func() {
+				server.AppendHandlers(
+					interruptedHandler("bytes"),
+					ghttp.CombineHandlers(
+						ghttp.VerifyHeaderKV("Range", fmt.Sprintf("bytes=%d-", half)),
+						func(w http.ResponseWriter, r *http.Request) {
+							w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", half, len(content)-1, len(content)))
+							w.WriteHeader(http.StatusPartialContent)
+							_, writeErr := w.Write([]byte(content[half:]))
+							Expect(writeErr).NotTo(HaveOccurred())
+						},
+					),
+				)
+			})
+
+			It("should resume the download", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(downloadedContent()).To(Equal(content))
+			})
+		})
+
+		Context("and the server does not support range requests", func() {
+			BeforeEach(func() {
+				server.AppendHandlers(
+					interruptedHandler(""),
+					ghttp.CombineHandlers(
+						func(w http.ResponseWriter, r *http.Request) {
+							Expect(r.Header.Get("Range")).To(BeEmpty())
+						},
+						ghttp.RespondWith(http.StatusOK, content),
+					),
+				)
+			})
+
+			It("should download the content from the start", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(downloadedContent()).To(Equal(content))
+			})
+		})
+
+		Context("and the server ignores the range request", func() {
+			BeforeEach(func() {
+				server.AppendHandlers(
+					interruptedHandler("bytes"),
+					ghttp.RespondWith(http.StatusOK, content),
+				)
+			})
+
+			It("should replace the partial content", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(downloadedContent()).To(Equal(content))
+			})
+		})
+	})
+
+	Context("when the download is cancelled", func() {
+		var started time.Time
+
+		BeforeEach(func() {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithCancel(context.Background())
+			time.AfterFunc(200*time.Millisecond, cancel)
+			started = time.Now()
+
+			server.AppendHandlers(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+				w.(http.Flusher).Flush()
+				<-r.Context().Done()
+			})
+		})
+
+		It("should abort the transfer without retrying", func() {
+			Expect(err).To(HaveOccurred())
+			Expect(time.Since(started)).To(BeNumerically("<", 5*time.Second))
+			Expect(server.ReceivedRequests()).To(HaveLen(1))
+		})
+	})
+})
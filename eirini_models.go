@@ -1,5 +1,10 @@
 package eirinistaging
 
+import (
+	"context"
+	"time"
+)
+
 const (
 	//Environment Variable Names
 	EnvDownloadURL               = "DOWNLOAD_URL"
@@ -19,10 +24,45 @@ const (
 	EnvOutputBuildArtifactsCache = "EIRINI_OUTPUT_BUILD_ARTIFACTS_CACHE"
 	EnvOutputMetadataLocation    = "EIRINI_OUTPUT_METADATA_LOCATION"
 	EnvBuildArtifactsCacheDir    = "EIRINI_BUILD_ARTIFACTS_CACHE_DIR"
+	EnvBuildpackInstallWorkers   = "EIRINI_BUILDPACK_INSTALL_WORKERS"
+	EnvDownloadMaxAttempts       = "EIRINI_DOWNLOAD_MAX_ATTEMPTS"
+	EnvDownloadInitialBackoff    = "EIRINI_DOWNLOAD_INITIAL_BACKOFF"
+	EnvDownloadMaxBackoff        = "EIRINI_DOWNLOAD_MAX_BACKOFF"
+	EnvUnzipMaxTotalSize         = "EIRINI_UNZIP_MAX_TOTAL_SIZE"
+	EnvUnzipMaxEntries           = "EIRINI_UNZIP_MAX_ENTRIES"
+	EnvUnzipMaxCompressionRatio  = "EIRINI_UNZIP_MAX_COMPRESSION_RATIO"
+	EnvGitCredentialsPath        = "EIRINI_GIT_CREDENTIALS_PATH"
+	EnvCacheDownloadURL          = "BUILD_ARTIFACTS_CACHE_DOWNLOAD_URL"
+	EnvCacheUploadURL            = "BUILD_ARTIFACTS_CACHE_UPLOAD_URL"
+	EnvReproducibleArchives      = "EIRINI_REPRODUCIBLE_ARCHIVES"
+	EnvCompressionLevel          = "EIRINI_COMPRESSION_LEVEL"
+	EnvCacheCompression          = "EIRINI_CACHE_COMPRESSION"
+	EnvStagingTimeout            = "EIRINI_STAGING_TIMEOUT"
+	EnvDetectTimeout             = "EIRINI_DETECT_TIMEOUT"
+	EnvSupplyTimeout             = "EIRINI_SUPPLY_TIMEOUT"
+	EnvFinalizeTimeout           = "EIRINI_FINALIZE_TIMEOUT"
+	EnvCompileTimeout            = "EIRINI_COMPILE_TIMEOUT"
+	EnvReleaseTimeout            = "EIRINI_RELEASE_TIMEOUT"
+	EnvBuildTimeout              = "EIRINI_BUILD_TIMEOUT"
+	EnvShutdownGracePeriod       = "EIRINI_SHUTDOWN_GRACE_PERIOD"
+	EnvStagingEnv                = "EIRINI_STAGING_ENV"
+	EnvStagingEnvPath            = "EIRINI_STAGING_ENV_PATH"
+	EnvServiceBindingRoot        = "SERVICE_BINDING_ROOT"
+	EnvTrustedCertsPath          = "EIRINI_TRUSTED_CERTS_PATH"
+	EnvLifecycleType             = "EIRINI_LIFECYCLE_TYPE"
+	EnvOutputFormat              = "EIRINI_OUTPUT_FORMAT"
+	EnvOutputImageLocation       = "EIRINI_OUTPUT_IMAGE_LOCATION"
+	EnvStackLayer                = "EIRINI_STACK_LAYER"
+	EnvImageReference            = "EIRINI_IMAGE_REFERENCE"
+	EnvRegistryInsecure          = "EIRINI_REGISTRY_INSECURE"
+	EnvRegistryCredentialsPath   = "EIRINI_REGISTRY_CREDENTIALS_PATH"
+	EnvOutputLayersLocation      = "EIRINI_OUTPUT_LAYERS_LOCATION"
+	EnvLayerUploadURL            = "DROPLET_LAYER_UPLOAD_URL"
 
 	RegisteredRoutes = "routes"
 
 	AppBits                         = "app.zip"
+	BuildArtifactsCacheBits         = "build-artifacts-cache.tgz"
 	RecipeBuildPacksDir             = "/var/lib/buildpacks"
 	RecipeBuildPacksName            = "recipe-buildpacks"
 	RecipeWorkspaceDir              = "/recipe_workspace"
@@ -30,9 +70,20 @@ const (
 	RecipeOutputName                = "staging-output"
 	RecipeOutputLocation            = "/out"
 	RecipeOutputDropletLocation     = "/out/droplet.tgz"
+	RecipeOutputImageLocation       = "/out/image"
+	RecipeOutputLayersLocation      = "/out/layers"
 	RecipeOutputBuildArtifactsCache = "/cache/cache.tgz"
+	RecipeOutputZstdCache           = "/cache/cache.tar.zst"
 	RecipeOutputMetadataLocation    = "/out/result.json"
 	BuildArtifactsCacheDir          = "/tmp/cache"
+	BuildpackInstallWorkers         = 4
+	DownloadMaxAttempts             = 5
+	DownloadInitialBackoff          = time.Second
+	DownloadMaxBackoff              = 30 * time.Second
+	UnzipMaxTotalSize               = 8 << 30
+	UnzipMaxEntries                 = 500000
+	UnzipMaxCompressionRatio        = 200
+	ShutdownGracePeriod             = 10 * time.Second
 
 	CCUploaderInternalURL = "cc-uploader.service.cf.internal"
 
@@ -44,9 +95,14 @@ const (
 
 	EiriniClientCert = "eirini-client-crt"
 	EiriniClientKey  = "eirini-client-crt-key"
+
+	GitCredentialsMountPath      = "/etc/config/git-credentials"
+	StagingEnvMountPath          = "/etc/config/staging-env/staging-env.json"
+	TrustedCertsMountPath        = "/etc/config/trusted-certs"
+	RegistryCredentialsMountPath = "/etc/config/registry-credentials"
 )
 
 //go:generate counterfeiter . Extractor
 type Extractor interface {
-	Extract(src, targetDir string) error
+	Extract(ctx context.Context, src, targetDir string) error
 }
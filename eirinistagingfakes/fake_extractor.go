@@ -2,15 +2,17 @@
 package eirinistagingfakes
 
 import (
+	"context"
 	"sync"
 
 	eirinistaging "code.cloudfoundry.org/eirini-staging"
 )
 
 type FakeExtractor struct {
-	ExtractStub        func(src, targetDir string) error
+	ExtractStub        func(ctx context.Context, src, targetDir string) error
 	extractMutex       sync.RWMutex
 	extractArgsForCall []struct {
+		ctx       context.Context
 		src       string
 		targetDir string
 	}
@@ -24,17 +26,18 @@ type FakeExtractor struct {
 	invocationsMutex sync.RWMutex
 }
 
-func (fake *FakeExtractor) Extract(src string, targetDir string) error {
+func (fake *FakeExtractor) Extract(ctx context.Context, src string, targetDir string) error {
 	fake.extractMutex.Lock()
 	ret, specificReturn := fake.extractReturnsOnCall[len(fake.extractArgsForCall)]
 	fake.extractArgsForCall = append(fake.extractArgsForCall, struct {
+		ctx       context.Context
 		src       string
 		targetDir string
-	}{src, targetDir})
-	fake.recordInvocation("Extract", []interface{}{src, targetDir})
+	}{ctx, src, targetDir})
+	fake.recordInvocation("Extract", []interface{}{ctx, src, targetDir})
 	fake.extractMutex.Unlock()
 	if fake.ExtractStub != nil {
-		return fake.ExtractStub(src, targetDir)
+		return fake.ExtractStub(ctx, src, targetDir)
 	}
 	if specificReturn {
 		return ret.result1
@@ -48,10 +51,10 @@ func (fake *FakeExtractor) ExtractCallCount() int {
 	return len(fake.extractArgsForCall)
 }
 
-func (fake *FakeExtractor) ExtractArgsForCall(i int) (string, string) {
+func (fake *FakeExtractor) ExtractArgsForCall(i int) (context.Context, string, string) {
 	fake.extractMutex.RLock()
 	defer fake.extractMutex.RUnlock()
-	return fake.extractArgsForCall[i].src, fake.extractArgsForCall[i].targetDir
+	return fake.extractArgsForCall[i].ctx, fake.extractArgsForCall[i].src, fake.extractArgsForCall[i].targetDir
 }
 
 func (fake *FakeExtractor) ExtractReturns(result1 error) {
@@ -2,16 +2,19 @@
 package eirinistagingfakes
 
 import (
+	"context"
 	"sync"
 
 	eirinistaging "code.cloudfoundry.org/eirini-staging"
 )
 
 type FakeInstaller struct {
-	InstallStub        func() error
+	InstallStub        func(ctx context.Context) error
 	installMutex       sync.RWMutex
-	installArgsForCall []struct{}
-	installReturns     struct {
+	installArgsForCall []struct {
+		ctx context.Context
+	}
+	installReturns struct {
 		result1 error
 	}
 	installReturnsOnCall map[int]struct {
@@ -21,14 +24,16 @@ type FakeInstaller struct {
 	invocationsMutex sync.RWMutex
 }
 
-func (fake *FakeInstaller) Install() error {
+func (fake *FakeInstaller) Install(ctx context.Context) error {
 	fake.installMutex.Lock()
 	ret, specificReturn := fake.installReturnsOnCall[len(fake.installArgsForCall)]
-	fake.installArgsForCall = append(fake.installArgsForCall, struct{}{})
-	fake.recordInvocation("Install", []interface{}{})
+	fake.installArgsForCall = append(fake.installArgsForCall, struct {
+		ctx context.Context
+	}{ctx})
+	fake.recordInvocation("Install", []interface{}{ctx})
 	fake.installMutex.Unlock()
 	if fake.InstallStub != nil {
-		return fake.InstallStub()
+		return fake.InstallStub(ctx)
 	}
 	if specificReturn {
 		return ret.result1
@@ -42,6 +47,12 @@ func (fake *FakeInstaller) InstallCallCount() int {
 	return len(fake.installArgsForCall)
 }
 
+func (fake *FakeInstaller) InstallArgsForCall(i int) context.Context {
+	fake.installMutex.RLock()
+	defer fake.installMutex.RUnlock()
+	return fake.installArgsForCall[i].ctx
+}
+
 func (fake *FakeInstaller) InstallReturns(result1 error) {
 	fake.InstallStub = nil
 	fake.installReturns = struct {
@@ -2,15 +2,17 @@
 package eirinistagingfakes
 
 import (
+	"context"
 	"sync"
 
 	eirinistaging "code.cloudfoundry.org/eirini-staging"
 )
 
 type FakeUploader struct {
-	UploadStub        func(path, url string) error
+	UploadStub        func(ctx context.Context, path, url string) error
 	uploadMutex       sync.RWMutex
 	uploadArgsForCall []struct {
+		ctx  context.Context
 		path string
 		url  string
 	}
@@ -24,17 +26,18 @@ type FakeUploader struct {
 	invocationsMutex sync.RWMutex
 }
 
-func (fake *FakeUploader) Upload(path string, url string) error {
+func (fake *FakeUploader) Upload(ctx context.Context, path string, url string) error {
 	fake.uploadMutex.Lock()
 	ret, specificReturn := fake.uploadReturnsOnCall[len(fake.uploadArgsForCall)]
 	fake.uploadArgsForCall = append(fake.uploadArgsForCall, struct {
+		ctx  context.Context
 		path string
 		url  string
-	}{path, url})
-	fake.recordInvocation("Upload", []interface{}{path, url})
+	}{ctx, path, url})
+	fake.recordInvocation("Upload", []interface{}{ctx, path, url})
 	fake.uploadMutex.Unlock()
 	if fake.UploadStub != nil {
-		return fake.UploadStub(path, url)
+		return fake.UploadStub(ctx, path, url)
 	}
 	if specificReturn {
 		return ret.result1
@@ -48,10 +51,10 @@ func (fake *FakeUploader) UploadCallCount() int {
 	return len(fake.uploadArgsForCall)
 }
 
-func (fake *FakeUploader) UploadArgsForCall(i int) (string, string) {
+func (fake *FakeUploader) UploadArgsForCall(i int) (context.Context, string, string) {
 	fake.uploadMutex.RLock()
 	defer fake.uploadMutex.RUnlock()
-	return fake.uploadArgsForCall[i].path, fake.uploadArgsForCall[i].url
+	return fake.uploadArgsForCall[i].ctx, fake.uploadArgsForCall[i].path, fake.uploadArgsForCall[i].url
 }
 
 func (fake *FakeUploader) UploadReturns(result1 error) {
@@ -1,6 +1,8 @@
 package eirinistaging_test
 
 import (
+	"context"
+	"encoding/pem"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -9,6 +11,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	eirinistaging "code.cloudfoundry.org/eirini-staging"
 	. "github.com/onsi/ginkgo"
@@ -96,7 +99,7 @@ var _ = Describe("GitBuildpack", func() {
 
 		Context("With a Git transport that doesn't support `--depth`", func() {
 			It("clones a URL", func() {
-				err := eirinistaging.GitClone(gitURL, cloneTarget)
+				_, err := eirinistaging.GitClone(context.Background(), gitURL, cloneTarget, eirinistaging.GitCredentials{})
 				Expect(err).NotTo(HaveOccurred())
 				Expect(currentBranch(cloneTarget)).To(Equal("master"))
 			})
@@ -104,7 +107,7 @@ var _ = Describe("GitBuildpack", func() {
 			It("clones a URL with a branch", func() {
 				branchURL := gitURL
 				branchURL.Fragment = "a_branch"
-				err := eirinistaging.GitClone(branchURL, cloneTarget)
+				_, err := eirinistaging.GitClone(context.Background(), branchURL, cloneTarget, eirinistaging.GitCredentials{})
 				Expect(err).NotTo(HaveOccurred())
 				Expect(currentBranch(cloneTarget)).To(Equal("a_branch"))
 			})
@@ -112,7 +115,7 @@ var _ = Describe("GitBuildpack", func() {
 			It("clones a URL with a lightweight tag", func() {
 				branchURL := gitURL
 				branchURL.Fragment = "a_lightweight_tag"
-				err := eirinistaging.GitClone(branchURL, cloneTarget)
+				_, err := eirinistaging.GitClone(context.Background(), branchURL, cloneTarget, eirinistaging.GitCredentials{})
 				Expect(err).NotTo(HaveOccurred())
 				Expect(currentBranch(cloneTarget)).To(Equal("a_lightweight_tag"))
 			})
@@ -121,7 +124,7 @@ var _ = Describe("GitBuildpack", func() {
 				It("updates the submodules for the branch", func() {
 					branchURL := gitURL
 					branchURL.Fragment = "a_branch"
-					err := eirinistaging.GitClone(branchURL, cloneTarget)
+					_, err := eirinistaging.GitClone(context.Background(), branchURL, cloneTarget, eirinistaging.GitCredentials{})
 					Expect(err).NotTo(HaveOccurred())
 
 					fileContents, _ := ioutil.ReadFile(cloneTarget + "/sub/README")
@@ -134,23 +137,143 @@ var _ = Describe("GitBuildpack", func() {
 					By("passing an invalid path", func() {
 						badURL := gitURL
 						badURL.Path = "/a/bad/path"
-						err := eirinistaging.GitClone(badURL, cloneTarget)
+						_, err := eirinistaging.GitClone(context.Background(), badURL, cloneTarget, eirinistaging.GitCredentials{})
 						Expect(err).To(HaveOccurred())
 					})
 
 					By("passing a bad tag/branch", func() {
 						badURL := gitURL
 						badURL.Fragment = "notfound"
-						err := eirinistaging.GitClone(badURL, cloneTarget)
+						_, err := eirinistaging.GitClone(context.Background(), badURL, cloneTarget, eirinistaging.GitCredentials{})
 						Expect(err).To(HaveOccurred())
 					})
 				})
 			})
 		})
 
+		Context("With a private repository", func() {
+			var (
+				privateServer  *httptest.Server
+				privateURL     url.URL
+				credentialsDir string
+				credentials    eirinistaging.GitCredentials
+				passwordsMutex sync.Mutex
+				passwords      []string
+			)
+
+			requireBasicAuth := func(handler http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					username, password, ok := r.BasicAuth()
+					if ok {
+						passwordsMutex.Lock()
+						passwords = append(passwords, password)
+						passwordsMutex.Unlock()
+					}
+					if !ok || username != "x-access-token" || password != "s3cr3t-t0ken" {
+						w.Header().Set("WWW-Authenticate", `Basic realm="buildpacks"`)
+						w.WriteHeader(http.StatusUnauthorized)
+						return
+					}
+					handler.ServeHTTP(w, r)
+				})
+			}
+
+			BeforeEach(func() {
+				var err error
+				credentialsDir, err = ioutil.TempDir(tmpDir, "credentials")
+				Expect(err).NotTo(HaveOccurred())
+				writeFile(filepath.Join(credentialsDir, eirinistaging.GitPasswordFileName), "s3cr3t-t0ken\n")
+				passwords = nil
+			})
+
+			JustBeforeEach(func() {
+				var err error
+				credentials, err = eirinistaging.LoadGitCredentials(credentialsDir)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			AfterEach(func() {
+				privateServer.Close()
+			})
+
+			Context("over http with a token", func() {
+				BeforeEach(func() {
+					privateServer = httptest.NewServer(requireBasicAuth(http.FileServer(http.Dir(tmpDir))))
+					privateURL = url.URL{
+						Scheme: "http",
+						Host:   privateServer.Listener.Addr().String(),
+						Path:   "/fake-buildpack/.git",
+					}
+					writeFile(filepath.Join(credentialsDir, eirinistaging.GitHostsFileName), "http://"+privateURL.Host)
+				})
+
+				It("clones the repository", func() {
+					_, err := eirinistaging.GitClone(context.Background(), privateURL, cloneTarget, credentials)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(currentBranch(cloneTarget)).To(Equal("master"))
+				})
+
+				Context("when the token is for another host", func() {
+					BeforeEach(func() {
+						writeFile(filepath.Join(credentialsDir, eirinistaging.GitHostsFileName), "http://git.example.com\nhttps://"+privateURL.Host)
+					})
+
+					It("does not send it", func() {
+						_, err := eirinistaging.GitClone(context.Background(), privateURL, cloneTarget, credentials)
+						Expect(err).To(MatchError(ContainSubstring("Failed to clone git repository")))
+
+						passwordsMutex.Lock()
+						defer passwordsMutex.Unlock()
+						Expect(passwords).To(BeEmpty())
+					})
+				})
+
+				It("fails without credentials", func() {
+					_, err := eirinistaging.GitClone(context.Background(), privateURL, cloneTarget, eirinistaging.GitCredentials{})
+					Expect(err).To(MatchError(ContainSubstring("Failed to clone git repository")))
+				})
+
+				It("does not leak credentials embedded in the URL", func() {
+					leakyURL := privateURL
+					leakyURL.User = url.UserPassword("someone", "hunter2")
+					_, err := eirinistaging.GitClone(context.Background(), leakyURL, cloneTarget, eirinistaging.GitCredentials{})
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).NotTo(ContainSubstring("hunter2"))
+				})
+			})
+
+			Context("over https with a custom CA", func() {
+				BeforeEach(func() {
+					privateServer = httptest.NewTLSServer(requireBasicAuth(http.FileServer(http.Dir(tmpDir))))
+					privateURL = url.URL{
+						Scheme: "https",
+						Host:   privateServer.Listener.Addr().String(),
+						Path:   "/fake-buildpack/.git",
+					}
+
+					writeFile(filepath.Join(credentialsDir, eirinistaging.GitHostsFileName), privateURL.Host)
+
+					caBundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: privateServer.Certificate().Raw})
+					writeFile(filepath.Join(credentialsDir, eirinistaging.GitCABundleFileName), string(caBundle))
+				})
+
+				It("clones the repository", func() {
+					_, err := eirinistaging.GitClone(context.Background(), privateURL, cloneTarget, credentials)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(currentBranch(cloneTarget)).To(Equal("master"))
+				})
+
+				It("fails when the CA is not trusted", func() {
+					credentials.CABundlePath = ""
+					_, err := eirinistaging.GitClone(context.Background(), privateURL, cloneTarget, credentials)
+					Expect(err).To(HaveOccurred())
+				})
+			})
+		})
+
 		Context("With a Git transport that supports `--depth`", func() {
 			It("clones a URL", func() {
-				err := eirinistaging.GitClone(fileGitURL, cloneTarget)
+				_, err := eirinistaging.GitClone(context.Background(), fileGitURL, cloneTarget, eirinistaging.GitCredentials{})
 				Expect(err).NotTo(HaveOccurred())
 				Expect(currentBranch(cloneTarget)).To(Equal("master"))
 			})
@@ -158,7 +281,7 @@ var _ = Describe("GitBuildpack", func() {
 			It("clones a URL with a branch", func() {
 				branchURL := fileGitURL
 				branchURL.Fragment = "a_branch"
-				err := eirinistaging.GitClone(branchURL, cloneTarget)
+				_, err := eirinistaging.GitClone(context.Background(), branchURL, cloneTarget, eirinistaging.GitCredentials{})
 				Expect(err).NotTo(HaveOccurred())
 				Expect(currentBranch(cloneTarget)).To(Equal("a_branch"))
 			})
@@ -166,11 +289,59 @@ var _ = Describe("GitBuildpack", func() {
 			It("clones a URL with a lightweight tag", func() {
 				branchURL := fileGitURL
 				branchURL.Fragment = "a_lightweight_tag"
-				err := eirinistaging.GitClone(branchURL, cloneTarget)
+				_, err := eirinistaging.GitClone(context.Background(), branchURL, cloneTarget, eirinistaging.GitCredentials{})
 				Expect(err).NotTo(HaveOccurred())
 				Expect(currentBranch(cloneTarget)).To(Equal("a_lightweight_tag"))
 			})
 
+			It("returns the commit it checked out", func() {
+				revision, err := eirinistaging.GitClone(context.Background(), fileGitURL, cloneTarget, eirinistaging.GitCredentials{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(revision).To(Equal(headOf(filepath.Join(tmpDir, "fake-buildpack"), "master")))
+			})
+
+			Context("when the fragment is a commit SHA", func() {
+				var pinned string
+
+				BeforeEach(func() {
+					pinned = headOf(filepath.Join(tmpDir, "fake-buildpack"), "a_branch^")
+				})
+
+				It("checks out the full SHA", func() {
+					shaURL := fileGitURL
+					shaURL.Fragment = pinned
+					revision, err := eirinistaging.GitClone(context.Background(), shaURL, cloneTarget, eirinistaging.GitCredentials{})
+					Expect(err).NotTo(HaveOccurred())
+					Expect(revision).To(Equal(pinned))
+					Expect(headOf(cloneTarget, "HEAD")).To(Equal(pinned))
+				})
+
+				It("checks out an abbreviated SHA", func() {
+					shaURL := fileGitURL
+					shaURL.Fragment = pinned[:10]
+					revision, err := eirinistaging.GitClone(context.Background(), shaURL, cloneTarget, eirinistaging.GitCredentials{})
+					Expect(err).NotTo(HaveOccurred())
+					Expect(revision).To(Equal(pinned))
+				})
+
+				It("updates the submodules for the commit", func() {
+					shaURL := fileGitURL
+					shaURL.Fragment = pinned
+					_, err := eirinistaging.GitClone(context.Background(), shaURL, cloneTarget, eirinistaging.GitCredentials{})
+					Expect(err).NotTo(HaveOccurred())
+
+					fileContents, _ := ioutil.ReadFile(cloneTarget + "/sub/README")
+					Expect(string(fileContents)).To(Equal("1st commit"))
+				})
+
+				It("returns an error when the commit does not exist", func() {
+					shaURL := fileGitURL
+					shaURL.Fragment = "0123456789abcdef0123456789abcdef01234567"
+					_, err := eirinistaging.GitClone(context.Background(), shaURL, cloneTarget, eirinistaging.GitCredentials{})
+					Expect(err).To(MatchError(ContainSubstring("revision 0123456789abcdef0123456789abcdef01234567 not found")))
+				})
+			})
+
 			It("does a shallow clone of the repo", func() {
 				gitPath, err := exec.LookPath("git")
 				Expect(err).NotTo(HaveOccurred())
@@ -180,7 +351,7 @@ var _ = Describe("GitBuildpack", func() {
 					Skip("shallow clone not support with submodules for git 2.9.0")
 				}
 
-				err = eirinistaging.GitClone(fileGitURL, cloneTarget)
+				_, err = eirinistaging.GitClone(context.Background(), fileGitURL, cloneTarget, eirinistaging.GitCredentials{})
 				Expect(err).NotTo(HaveOccurred())
 
 				cmd := exec.Command("git", "rev-list", "HEAD", "--count")
@@ -209,6 +380,14 @@ func currentBranch(gitDir string) string {
 	return strings.TrimSpace(string(bytes))
 }
 
+func headOf(gitDir, revision string) string {
+	cmd := exec.Command("git", "rev-parse", revision)
+	cmd.Dir = gitDir
+	bytes, err := cmd.Output()
+	Expect(err).NotTo(HaveOccurred())
+	return strings.TrimSpace(string(bytes))
+}
+
 func execute(dir string, execCmd string, args ...string) {
 	cmd := exec.Command(execCmd, args...)
 	cmd.Dir = dir
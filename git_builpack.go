@@ -1,55 +1,158 @@
 package eirinistaging
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 	"os"
 	"os/exec"
+	"regexp"
+	"strings"
 )
 
-func GitClone(repo url.URL, destination string) error {
+var commitSHA = regexp.MustCompile(`^[0-9a-fA-F]{7,40}$`)
+
+// GitClone clones the repository into destination and returns the commit
+// that was checked out. The URL fragment selects a branch, a tag or a
+// (possibly abbreviated) commit SHA.
+func GitClone(ctx context.Context, repo url.URL, destination string, credentials GitCredentials) (string, error) {
 	gitPath, err := exec.LookPath("git")
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	env, cleanup, err := credentials.environment()
+	if err != nil {
+		return "", err
 	}
+	defer cleanup()
+
+	git := gitRunner{ctx: ctx, path: gitPath, env: env}
 
-	branch := repo.Fragment
+	revision := repo.Fragment
 	repo.Fragment = ""
 	gitURL := repo.String()
+	displayURL := redactURL(gitURL)
 
-	err = performGitClone(gitPath,
+	var commitErr error
+	if commitSHA.MatchString(revision) {
+		var resolved string
+		resolved, commitErr = cloneCommit(git, gitURL, destination, revision)
+		if commitErr == nil {
+			return resolved, nil
+		}
+
+		// it might still be a branch or tag that merely looks like a SHA
+		os.RemoveAll(destination)
+	}
+
+	err = performGitClone(git,
 		[]string{
 			"--depth",
 			"1",
 			"--recursive",
 			gitURL,
 			destination,
-		}, branch)
+		}, revision)
 
 	if err != nil {
 		os.RemoveAll(destination)
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
 
-		err = performGitClone(gitPath,
+		err = performGitClone(git,
 			[]string{
 				"--recursive",
 				gitURL,
 				destination,
-			}, branch)
+			}, revision)
 
+		if err != nil && commitErr != nil {
+			return "", commitErr
+		}
 		if err != nil {
-			return fmt.Errorf("Failed to clone git repository at %s", gitURL)
+			return "", fmt.Errorf("Failed to clone git repository at %s", displayURL)
 		}
 	}
 
-	return nil
+	resolved, err := git.output(destination, "rev-parse", "HEAD")
+	if err != nil {
+		return "", fmt.Errorf("Failed to resolve the revision of git repository at %s", displayURL)
+	}
+
+	return resolved, nil
 }
 
-func performGitClone(gitPath string, args []string, branch string) error {
+func performGitClone(git gitRunner, args []string, branch string) error {
 	args = append([]string{"clone"}, args...)
 
 	if branch != "" {
 		args = append(args, "-b", branch)
 	}
-	cmd := exec.Command(gitPath, args...)
-	return cmd.Run()
+	return git.run("", args...)
+}
+
+// cloneCommit checks out an exact commit. Commits that no branch or tag
+// points to are fetched explicitly, which only works when the server allows
+// it.
+func cloneCommit(git gitRunner, gitURL, destination, sha string) (string, error) {
+	displayURL := redactURL(gitURL)
+
+	if err := git.run("", "clone", "--no-checkout", gitURL, destination); err != nil {
+		return "", fmt.Errorf("Failed to clone git repository at %s", displayURL)
+	}
+
+	if err := git.run(destination, "checkout", "--detach", sha); err != nil {
+		if fetchErr := git.run(destination, "fetch", "origin", sha); fetchErr != nil {
+			return "", fmt.Errorf("revision %s not found in git repository at %s", sha, displayURL)
+		}
+		if err = git.run(destination, "checkout", "--detach", "FETCH_HEAD"); err != nil {
+			return "", fmt.Errorf("revision %s not found in git repository at %s", sha, displayURL)
+		}
+	}
+
+	resolved, err := git.output(destination, "rev-parse", "HEAD")
+	if err != nil {
+		return "", err
+	}
+
+	if !strings.HasPrefix(resolved, strings.ToLower(sha)) {
+		return "", fmt.Errorf("revision %s not found in git repository at %s", sha, displayURL)
+	}
+
+	if err := git.run(destination, "submodule", "update", "--init", "--recursive"); err != nil {
+		return "", fmt.Errorf("Failed to update submodules of git repository at %s", displayURL)
+	}
+
+	return resolved, nil
+}
+
+// gitRunner runs git with the environment that carries the credentials,
+// killing it once ctx is done. The output of git is discarded as it may echo
+// the repository URL.
+type gitRunner struct {
+	ctx  context.Context
+	path string
+	env  []string
+}
+
+func (g gitRunner) command(dir string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(g.ctx, g.path, args...)
+	cmd.Dir = dir
+	cmd.Env = g.env
+	return cmd
+}
+
+func (g gitRunner) run(dir string, args ...string) error {
+	return g.command(dir, args...).Run()
+}
+
+func (g gitRunner) output(dir string, args ...string) (string, error) {
+	output, err := g.command(dir, args...).Output()
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(output)), nil
 }
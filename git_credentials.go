@@ -0,0 +1,248 @@
+package eirinistaging
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"code.cloudfoundry.org/eirini-staging/builder"
+)
+
+const (
+	GitUsernameFileName   = "username"
+	GitPasswordFileName   = "password"
+	GitSSHKeyFileName     = "ssh-privatekey"
+	GitKnownHostsFileName = "known_hosts"
+	GitCABundleFileName   = "ca.crt"
+	GitHostsFileName      = "hosts"
+
+	// defaultGitUsername is accepted together with an access token by the
+	// common git hosting services.
+	defaultGitUsername = "x-access-token"
+)
+
+// GitCredentials points to the files of a mounted secret. Only paths are kept
+// so that the secrets themselves cannot end up in logs or error messages.
+type GitCredentials struct {
+	Username       string
+	Hosts          []string
+	PasswordPath   string
+	SSHKeyPath     string
+	KnownHostsPath string
+	CABundlePath   string
+}
+
+// LoadGitCredentials looks up the credential files in dir. Every file is
+// optional and a missing directory means no credentials at all.
+func LoadGitCredentials(dir string) (GitCredentials, error) {
+	var credentials GitCredentials
+
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return credentials, nil
+	}
+
+	username, err := ioutil.ReadFile(filepath.Join(dir, GitUsernameFileName))
+	switch {
+	case err == nil:
+		credentials.Username = strings.TrimSpace(string(username))
+	case !os.IsNotExist(err):
+		return GitCredentials{}, err
+	}
+
+	credentials.PasswordPath = existingFile(dir, GitPasswordFileName)
+	credentials.SSHKeyPath = existingFile(dir, GitSSHKeyFileName)
+	credentials.KnownHostsPath = existingFile(dir, GitKnownHostsFileName)
+	credentials.CABundlePath = existingFile(dir, GitCABundleFileName)
+
+	if credentials.SSHKeyPath != "" && credentials.KnownHostsPath == "" {
+		return GitCredentials{}, fmt.Errorf("git credentials in %s contain an ssh key but no %s file", dir, GitKnownHostsFileName)
+	}
+
+	if credentials.PasswordPath != "" {
+		credentials.Hosts, err = readGitHosts(filepath.Join(dir, GitHostsFileName))
+		if err != nil {
+			return GitCredentials{}, err
+		}
+	}
+
+	return credentials, nil
+}
+
+// readGitHosts reads the hosts the password may be sent to, one per line.
+// Hosts without a scheme are only trusted over https.
+func readGitHosts(path string) ([]string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("git credentials contain a password but no %s file naming the hosts it is for", GitHostsFileName)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var hosts []string
+	for _, line := range strings.Split(string(contents), "\n") {
+		host := strings.TrimSpace(line)
+		if host == "" {
+			continue
+		}
+		if !strings.Contains(host, "://") {
+			host = "https://" + host
+		}
+
+		hostURL, err := url.Parse(host)
+		if err != nil || hostURL.Host == "" || strings.Trim(hostURL.Path, "/") != "" {
+			return nil, fmt.Errorf("invalid git host %q in %s", line, path)
+		}
+		hosts = append(hosts, hostURL.Scheme+"://"+hostURL.Host)
+	}
+
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("no git hosts in %s", path)
+	}
+
+	return hosts, nil
+}
+
+func existingFile(dir, name string) string {
+	path := filepath.Join(dir, name)
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+// environment returns the environment git has to run with to use the
+// credentials. The returned cleanup function removes the helper files.
+func (c GitCredentials) environment() ([]string, func(), error) {
+	env := append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	noop := func() {}
+
+	if c.PasswordPath == "" && c.SSHKeyPath == "" && c.KnownHostsPath == "" && c.CABundlePath == "" {
+		return env, noop, nil
+	}
+
+	helperDir, err := ioutil.TempDir("", "git-credentials")
+	if err != nil {
+		return nil, noop, err
+	}
+	cleanup := func() { os.RemoveAll(helperDir) }
+
+	if c.CABundlePath != "" {
+		caBundle, err := c.writeCABundle(helperDir)
+		if err != nil {
+			cleanup()
+			return nil, noop, err
+		}
+		env = append(env, "GIT_SSL_CAINFO="+caBundle)
+	}
+
+	if c.PasswordPath != "" {
+		helper, err := c.writeCredentialHelper(helperDir)
+		if err != nil {
+			cleanup()
+			return nil, noop, err
+		}
+
+		config := map[string]string{}
+		for _, host := range c.Hosts {
+			config["credential."+host+".helper"] = helper
+		}
+		env = withGitConfig(env, config)
+	}
+
+	if c.SSHKeyPath != "" || c.KnownHostsPath != "" {
+		sshCommand, err := c.sshCommand(helperDir)
+		if err != nil {
+			cleanup()
+			return nil, noop, err
+		}
+		env = append(env, "GIT_SSH_COMMAND="+sshCommand)
+	}
+
+	return env, cleanup, nil
+}
+
+// writeCABundle adds the CA to the system bundle, as GIT_SSL_CAINFO replaces
+// the certificates git trusts instead of adding to them.
+func (c GitCredentials) writeCABundle(helperDir string) (string, error) {
+	ca, err := ioutil.ReadFile(c.CABundlePath)
+	if err != nil {
+		return "", err
+	}
+
+	bundle, err := builder.WithSystemCertBundle(ca)
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(helperDir, GitCABundleFileName)
+	return path, ioutil.WriteFile(path, bundle, 0644)
+}
+
+// writeCredentialHelper writes a git credential helper that answers with the
+// secret files, so the password is never passed as an argument or
+// environment variable. Git only asks it for the configured hosts.
+func (c GitCredentials) writeCredentialHelper(helperDir string) (string, error) {
+	username := c.Username
+	if username == "" {
+		username = defaultGitUsername
+	}
+
+	script := fmt.Sprintf(`#!/bin/sh
+test "$1" = get || exit 0
+printf 'username=%%s\n' %s
+printf 'password=%%s\n' "$(cat %s)"
+`, shellQuote(username), shellQuote(c.PasswordPath))
+
+	path := filepath.Join(helperDir, "credential-helper")
+	return path, ioutil.WriteFile(path, []byte(script), 0700)
+}
+
+// withGitConfig passes config to git through the environment, after the
+// config that the environment may carry already.
+func withGitConfig(env []string, config map[string]string) []string {
+	count, _ := strconv.Atoi(os.Getenv("GIT_CONFIG_COUNT"))
+	for key, value := range config {
+		env = append(env,
+			fmt.Sprintf("GIT_CONFIG_KEY_%d=%s", count, key),
+			fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", count, value),
+		)
+		count++
+	}
+
+	return append(env, fmt.Sprintf("GIT_CONFIG_COUNT=%d", count))
+}
+
+// sshCommand enforces host key checking against the provided known_hosts.
+// The key is copied as ssh refuses keys that others can read, which is how
+// secrets are usually mounted.
+func (c GitCredentials) sshCommand(helperDir string) (string, error) {
+	args := []string{"ssh", "-o", "StrictHostKeyChecking=yes", "-o", "BatchMode=yes"}
+
+	if c.KnownHostsPath != "" {
+		args = append(args, "-o", shellQuote("UserKnownHostsFile="+c.KnownHostsPath))
+	}
+
+	if c.SSHKeyPath != "" {
+		key, err := ioutil.ReadFile(c.SSHKeyPath)
+		if err != nil {
+			return "", err
+		}
+
+		keyPath := filepath.Join(helperDir, "ssh-key")
+		if err := ioutil.WriteFile(keyPath, key, 0600); err != nil {
+			return "", err
+		}
+		args = append(args, "-o", "IdentitiesOnly=yes", "-i", shellQuote(keyPath))
+	}
+
+	return strings.Join(args, " "), nil
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,97 @@
+package eirinistaging_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	eirinistaging "code.cloudfoundry.org/eirini-staging"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("GitCredentials", func() {
+	var (
+		credentialsDir string
+		credentials    eirinistaging.GitCredentials
+		err            error
+	)
+
+	BeforeEach(func() {
+		credentialsDir, err = ioutil.TempDir("", "git-credentials")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	JustBeforeEach(func() {
+		credentials, err = eirinistaging.LoadGitCredentials(credentialsDir)
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(credentialsDir)).To(Succeed())
+	})
+
+	Context("when the directory does not exist", func() {
+		BeforeEach(func() {
+			Expect(os.RemoveAll(credentialsDir)).To(Succeed())
+		})
+
+		It("returns no credentials", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(credentials).To(Equal(eirinistaging.GitCredentials{}))
+		})
+	})
+
+	Context("when all files are present", func() {
+		BeforeEach(func() {
+			writeFile(filepath.Join(credentialsDir, eirinistaging.GitUsernameFileName), "deployer\n")
+			writeFile(filepath.Join(credentialsDir, eirinistaging.GitPasswordFileName), "token")
+			writeFile(filepath.Join(credentialsDir, eirinistaging.GitSSHKeyFileName), "key")
+			writeFile(filepath.Join(credentialsDir, eirinistaging.GitKnownHostsFileName), "hosts")
+			writeFile(filepath.Join(credentialsDir, eirinistaging.GitCABundleFileName), "ca")
+			writeFile(filepath.Join(credentialsDir, eirinistaging.GitHostsFileName), "github.com\nhttp://git.example.com:8080/\n\n")
+		})
+
+		It("refers to the files without reading the secrets", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(credentials).To(Equal(eirinistaging.GitCredentials{
+				Username:       "deployer",
+				Hosts:          []string{"https://github.com", "http://git.example.com:8080"},
+				PasswordPath:   filepath.Join(credentialsDir, eirinistaging.GitPasswordFileName),
+				SSHKeyPath:     filepath.Join(credentialsDir, eirinistaging.GitSSHKeyFileName),
+				KnownHostsPath: filepath.Join(credentialsDir, eirinistaging.GitKnownHostsFileName),
+				CABundlePath:   filepath.Join(credentialsDir, eirinistaging.GitCABundleFileName),
+			}))
+		})
+	})
+
+	Context("when a password is provided without hosts", func() {
+		BeforeEach(func() {
+			writeFile(filepath.Join(credentialsDir, eirinistaging.GitPasswordFileName), "token")
+		})
+
+		It("refuses to send it to any host", func() {
+			Expect(err).To(MatchError(ContainSubstring("no hosts file")))
+		})
+	})
+
+	Context("when a host is not a bare host", func() {
+		BeforeEach(func() {
+			writeFile(filepath.Join(credentialsDir, eirinistaging.GitPasswordFileName), "token")
+			writeFile(filepath.Join(credentialsDir, eirinistaging.GitHostsFileName), "github.com/org/repo.git")
+		})
+
+		It("fails", func() {
+			Expect(err).To(MatchError(ContainSubstring(`invalid git host "github.com/org/repo.git"`)))
+		})
+	})
+
+	Context("when an ssh key is provided without known_hosts", func() {
+		BeforeEach(func() {
+			writeFile(filepath.Join(credentialsDir, eirinistaging.GitSSHKeyFileName), "key")
+		})
+
+		It("refuses to skip host key checking", func() {
+			Expect(err).To(MatchError(ContainSubstring("no known_hosts file")))
+		})
+	})
+})
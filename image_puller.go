@@ -0,0 +1,125 @@
+package eirinistaging
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/eirini-staging/builder"
+	"github.com/pkg/errors"
+)
+
+// maxManifestSize bounds what is read of a manifest, which is small JSON.
+const maxManifestSize = 4 << 20
+
+// ImagePuller pulls an image from a registry into an OCI image layout, so
+// that it can be changed and pushed again. Layers that may not be
+// distributed, like the layers of some stacks, are left in the registry.
+type ImagePuller struct {
+	Client      *http.Client
+	Insecure    bool
+	Credentials RegistryCredentials
+}
+
+func (p *ImagePuller) Pull(ctx context.Context, imageRef, layoutDir string) error {
+	registry, repository, tag, err := ParseImageReference(imageRef)
+	if err != nil {
+		return err
+	}
+
+	client := &registryClient{ctx: ctx, client: p.Client, registry: registry, credentials: p.Credentials}
+	repositoryURL := client.repositoryURL(repository, p.Insecure)
+
+	layout, err := builder.CreateOCILayout(layoutDir)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest("GET", fmt.Sprintf("%s/manifests/%s", repositoryURL, tag), nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", builder.MediaTypeOCIManifest)
+
+	response, err := client.open(request)
+	if err != nil {
+		return errors.Wrap(err, "failed to pull manifest")
+	}
+	contents, err := ioutil.ReadAll(io.LimitReader(response.Body, maxManifestSize))
+	response.Body.Close()
+	if err != nil {
+		return errors.Wrap(err, "failed to pull manifest")
+	}
+
+	if mediaType := response.Header.Get("Content-Type"); mediaType != builder.MediaTypeOCIManifest {
+		return fmt.Errorf("image %s has a manifest of type %q, not an OCI image manifest", imageRef, mediaType)
+	}
+
+	var manifest builder.OCIManifest
+	if err = json.Unmarshal(contents, &manifest); err != nil {
+		return errors.Wrap(err, "failed to decode manifest")
+	}
+
+	manifestDescriptor, err := layout.WriteBlob(builder.MediaTypeOCIManifest, contents)
+	if err != nil {
+		return err
+	}
+
+	for _, blob := range append([]builder.OCIDescriptor{manifest.Config}, manifest.Layers...) {
+		if blob.MediaType == builder.MediaTypeOCIForeignLayer {
+			continue
+		}
+		if err = pullBlob(client, layout, repositoryURL, blob); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("failed to pull blob %s", blob.Digest))
+		}
+	}
+
+	return layout.WriteIndex(manifestDescriptor, tag)
+}
+
+// pullBlob downloads the blob into the layout, once its digest is verified.
+func pullBlob(client *registryClient, layout builder.OCILayout, repositoryURL string, blob builder.OCIDescriptor) error {
+	if !strings.HasPrefix(blob.Digest, "sha256:") {
+		return fmt.Errorf("unsupported digest algorithm in %s", blob.Digest)
+	}
+
+	request, err := http.NewRequest("GET", fmt.Sprintf("%s/blobs/%s", repositoryURL, blob.Digest), nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := client.open(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	file, err := ioutil.TempFile(filepath.Join(layout.Dir, "blobs"), "blob")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(file, hash), response.Body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if digest := "sha256:" + hex.EncodeToString(hash.Sum(nil)); digest != blob.Digest {
+		return fmt.Errorf("the registry sent a blob with digest %s", digest)
+	}
+
+	return os.Rename(file.Name(), layout.BlobPath(blob.Digest))
+}
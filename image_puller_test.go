@@ -0,0 +1,128 @@
+package eirinistaging_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "code.cloudfoundry.org/eirini-staging"
+	"code.cloudfoundry.org/eirini-staging/builder"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("ImagePuller", func() {
+	var (
+		server       *ghttp.Server
+		layoutDir    string
+		config       []byte
+		layer        []byte
+		servedLayer  []byte
+		stack        builder.OCIDescriptor
+		manifest     []byte
+		manifestType string
+		err          error
+	)
+
+	descriptor := func(mediaType string, contents []byte) builder.OCIDescriptor {
+		scratch, scratchErr := ioutil.TempDir("", "scratch-layout")
+		Expect(scratchErr).NotTo(HaveOccurred())
+		defer os.RemoveAll(scratch)
+
+		layout, scratchErr := builder.CreateOCILayout(scratch)
+		Expect(scratchErr).NotTo(HaveOccurred())
+		desc, scratchErr := layout.WriteBlob(mediaType, contents)
+		Expect(scratchErr).NotTo(HaveOccurred())
+		return desc
+	}
+
+	BeforeEach(func() {
+		layoutDir, err = ioutil.TempDir("", "image-layout")
+		Expect(err).NotTo(HaveOccurred())
+
+		config = []byte(`{"os":"linux"}`)
+		layer = []byte("not really a layer")
+		servedLayer = layer
+		stack = builder.OCIDescriptor{
+			MediaType: builder.MediaTypeOCIForeignLayer,
+			Digest:    "sha256:aaaa",
+			Size:      42,
+		}
+		manifestType = builder.MediaTypeOCIManifest
+
+		server = ghttp.NewServer()
+	})
+
+	JustBeforeEach(func() {
+		configDescriptor := descriptor(builder.MediaTypeOCIConfig, config)
+		layerDescriptor := descriptor(builder.MediaTypeOCILayer, layer)
+		manifest = []byte(`{"schemaVersion":2,"mediaType":"` + builder.MediaTypeOCIManifest + `",` +
+			`"config":{"mediaType":"` + builder.MediaTypeOCIConfig + `","digest":"` + configDescriptor.Digest + `","size":14},` +
+			`"layers":[{"mediaType":"` + stack.MediaType + `","digest":"` + stack.Digest + `","size":42},` +
+			`{"mediaType":"` + builder.MediaTypeOCILayer + `","digest":"` + layerDescriptor.Digest + `","size":18}]}`)
+
+		server.RouteToHandler("GET", "/v2/org/app/manifests/v1", ghttp.CombineHandlers(
+			ghttp.VerifyHeaderKV("Accept", builder.MediaTypeOCIManifest),
+			ghttp.RespondWith(http.StatusOK, manifest, http.Header{"Content-Type": []string{manifestType}}),
+		))
+		server.RouteToHandler("GET", "/v2/org/app/blobs/"+configDescriptor.Digest, ghttp.RespondWith(http.StatusOK, config))
+		server.RouteToHandler("GET", "/v2/org/app/blobs/"+layerDescriptor.Digest, ghttp.RespondWith(http.StatusOK, servedLayer))
+
+		puller := ImagePuller{Client: &http.Client{}, Insecure: true}
+		err = puller.Pull(context.Background(), strings.TrimPrefix(server.URL(), "http://")+"/org/app:v1", layoutDir)
+	})
+
+	AfterEach(func() {
+		server.Close()
+		Expect(os.RemoveAll(layoutDir)).To(Succeed())
+	})
+
+	It("writes the image into the layout", func() {
+		Expect(err).NotTo(HaveOccurred())
+
+		layout := builder.OCILayout{Dir: layoutDir}
+		pulledManifest, manifestDescriptor, manifestErr := layout.Manifest()
+		Expect(manifestErr).NotTo(HaveOccurred())
+		Expect(manifestDescriptor.Annotations[builder.RefNameAnnotation]).To(Equal("v1"))
+		Expect(ioutil.ReadFile(layout.BlobPath(manifestDescriptor.Digest))).To(Equal(manifest))
+
+		Expect(ioutil.ReadFile(layout.BlobPath(pulledManifest.Config.Digest))).To(Equal(config))
+		Expect(ioutil.ReadFile(layout.BlobPath(pulledManifest.Layers[1].Digest))).To(Equal(layer))
+	})
+
+	It("does not pull nondistributable layers", func() {
+		for _, request := range server.ReceivedRequests() {
+			Expect(request.URL.Path).NotTo(ContainSubstring(stack.Digest))
+		}
+	})
+
+	Context("when a blob does not match its digest", func() {
+		BeforeEach(func() {
+			servedLayer = []byte("tampered with")
+		})
+
+		It("fails without keeping it", func() {
+			Expect(err).To(MatchError(ContainSubstring("the registry sent a blob with digest")))
+
+			blobs, readErr := ioutil.ReadDir(filepath.Join(layoutDir, "blobs"))
+			Expect(readErr).NotTo(HaveOccurred())
+			for _, blob := range blobs {
+				Expect(blob.IsDir()).To(BeTrue())
+			}
+		})
+	})
+
+	Context("when the image is not an OCI image", func() {
+		BeforeEach(func() {
+			manifestType = "application/vnd.docker.distribution.manifest.v2+json"
+		})
+
+		It("fails", func() {
+			Expect(err).To(MatchError(ContainSubstring("not an OCI image manifest")))
+		})
+	})
+})
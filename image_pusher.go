@@ -0,0 +1,341 @@
+package eirinistaging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"code.cloudfoundry.org/eirini-staging/builder"
+	"github.com/pkg/errors"
+)
+
+const (
+	RegistryUsernameFileName = "username"
+	RegistryPasswordFileName = "password"
+)
+
+type RegistryCredentials struct {
+	Username string
+	Password string
+}
+
+// LoadRegistryCredentials reads the basic auth credentials of a mounted
+// secret. A missing directory means the registry needs no credentials.
+func LoadRegistryCredentials(dir string) (RegistryCredentials, error) {
+	var credentials RegistryCredentials
+
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return credentials, nil
+	}
+
+	for name, value := range map[string]*string{
+		RegistryUsernameFileName: &credentials.Username,
+		RegistryPasswordFileName: &credentials.Password,
+	} {
+		contents, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return RegistryCredentials{}, err
+		}
+		*value = strings.TrimSpace(string(contents))
+	}
+
+	return credentials, nil
+}
+
+// ImagePusher pushes the image of an OCI image layout to a registry through
+// the OCI distribution API.
+type ImagePusher struct {
+	Client      *http.Client
+	Insecure    bool
+	Credentials RegistryCredentials
+}
+
+func (p *ImagePusher) Push(ctx context.Context, layoutDir, imageRef string) error {
+	registry, repository, tag, err := ParseImageReference(imageRef)
+	if err != nil {
+		return err
+	}
+
+	client := &registryClient{ctx: ctx, client: p.Client, registry: registry, credentials: p.Credentials}
+	repositoryURL := client.repositoryURL(repository, p.Insecure)
+
+	layout := builder.OCILayout{Dir: layoutDir}
+	manifest, manifestDescriptor, err := layout.Manifest()
+	if err != nil {
+		return err
+	}
+
+	for _, blob := range append([]builder.OCIDescriptor{manifest.Config}, manifest.Layers...) {
+		if err = pushBlob(client, layout, repositoryURL, blob); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("failed to push blob %s", blob.Digest))
+		}
+	}
+
+	contents, err := ioutil.ReadFile(layout.BlobPath(manifestDescriptor.Digest))
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest("PUT", fmt.Sprintf("%s/manifests/%s", repositoryURL, tag), bytes.NewReader(contents))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", manifest.MediaType)
+
+	_, err = client.do(request)
+	return errors.Wrap(err, "failed to push manifest")
+}
+
+// pushBlob uploads the blob unless the registry already has it. Layers that
+// may not be distributed, like the layers of some stacks, are never pushed.
+func pushBlob(client *registryClient, layout builder.OCILayout, repositoryURL string, blob builder.OCIDescriptor) error {
+	if blob.MediaType == builder.MediaTypeOCIForeignLayer {
+		return nil
+	}
+
+	exists, err := client.blobExists(repositoryURL, blob.Digest)
+	if err != nil || exists {
+		return err
+	}
+
+	if !layout.HasBlob(blob.Digest) {
+		return errors.New("the blob is neither in the image layout nor in the registry")
+	}
+
+	request, err := http.NewRequest("POST", repositoryURL+"/blobs/uploads/", nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := client.do(request)
+	if err != nil {
+		return err
+	}
+
+	uploadURL, err := request.URL.Parse(response.Header.Get("Location"))
+	if err != nil {
+		return err
+	}
+	query := uploadURL.Query()
+	query.Set("digest", blob.Digest)
+	uploadURL.RawQuery = query.Encode()
+
+	file, err := os.Open(layout.BlobPath(blob.Digest))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	request, err = http.NewRequest("PUT", uploadURL.String(), ioutil.NopCloser(file))
+	if err != nil {
+		return err
+	}
+	request.ContentLength = blob.Size
+	request.Header.Set("Content-Type", "application/octet-stream")
+	request.GetBody = func() (io.ReadCloser, error) {
+		_, seekErr := file.Seek(0, io.SeekStart)
+		return ioutil.NopCloser(file), seekErr
+	}
+
+	_, err = client.do(request)
+	return err
+}
+
+// registryClient sends requests to a registry. The credentials are used for
+// basic authentication or, when the registry asks for a bearer token, to get
+// one from its token server. They are never sent to other hosts, like the
+// storage a registry may redirect uploads to. Requests are sent with ctx, so
+// that they are aborted once it is done.
+type registryClient struct {
+	ctx         context.Context
+	client      *http.Client
+	registry    string
+	credentials RegistryCredentials
+	token       string
+}
+
+func (c *registryClient) repositoryURL(repository string, insecure bool) string {
+	scheme := "https"
+	if insecure {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s/v2/%s", scheme, c.registry, repository)
+}
+
+func (c *registryClient) blobExists(repositoryURL, digest string) (bool, error) {
+	request, err := http.NewRequest("HEAD", fmt.Sprintf("%s/blobs/%s", repositoryURL, digest), nil)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = c.do(request)
+	if statusErr, ok := err.(RegistryStatusError); ok && statusErr.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// do sends the request and fails on error statuses. The body of the response
+// is closed, use open for the responses whose body is needed.
+func (c *registryClient) do(request *http.Request) (*http.Response, error) {
+	response, err := c.open(request)
+	if err != nil {
+		return nil, err
+	}
+	response.Body.Close()
+	return response, nil
+}
+
+// open sends the request and fails on error statuses. A request the registry
+// refuses with a bearer challenge is sent again with a token, which is kept
+// for later requests.
+func (c *registryClient) open(request *http.Request) (*http.Response, error) {
+	response, err := c.send(request)
+	if err != nil {
+		return nil, err
+	}
+
+	challenge := response.Header.Get("WWW-Authenticate")
+	if response.StatusCode == http.StatusUnauthorized && strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+		response.Body.Close()
+
+		if c.token, err = c.fetchToken(challenge); err != nil {
+			return nil, errors.Wrap(err, "failed to get a registry token")
+		}
+
+		if request.Body != nil {
+			if request.GetBody == nil {
+				return nil, errors.New("cannot send the request again with a token")
+			}
+			if request.Body, err = request.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+
+		if response, err = c.send(request); err != nil {
+			return nil, err
+		}
+	}
+
+	if response.StatusCode >= 400 {
+		response.Body.Close()
+		return nil, RegistryStatusError{Method: request.Method, URL: request.URL, StatusCode: response.StatusCode}
+	}
+	return response, nil
+}
+
+func (c *registryClient) send(request *http.Request) (*http.Response, error) {
+	request.Header.Del("Authorization")
+	if request.URL.Host == c.registry {
+		switch {
+		case c.token != "":
+			request.Header.Set("Authorization", "Bearer "+c.token)
+		case c.credentials.Username != "":
+			request.SetBasicAuth(c.credentials.Username, c.credentials.Password)
+		}
+	}
+
+	return c.client.Do(request.WithContext(c.ctx))
+}
+
+var challengeParameter = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// fetchToken gets a token from the server the bearer challenge of the
+// registry names, as described by the docker token authentication spec.
+func (c *registryClient) fetchToken(challenge string) (string, error) {
+	parameters := map[string]string{}
+	for _, match := range challengeParameter.FindAllStringSubmatch(challenge, -1) {
+		parameters[strings.ToLower(match[1])] = match[2]
+	}
+
+	tokenURL, err := url.Parse(parameters["realm"])
+	if err != nil || tokenURL.Host == "" {
+		return "", fmt.Errorf("invalid realm %q in the challenge of the registry", parameters["realm"])
+	}
+
+	query := tokenURL.Query()
+	for _, name := range []string{"service", "scope"} {
+		if parameters[name] != "" {
+			query.Set(name, parameters[name])
+		}
+	}
+	tokenURL.RawQuery = query.Encode()
+
+	request, err := http.NewRequest("GET", tokenURL.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if c.credentials.Username != "" {
+		request.SetBasicAuth(c.credentials.Username, c.credentials.Password)
+	}
+
+	response, err := c.client.Do(request.WithContext(c.ctx))
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", RegistryStatusError{Method: request.Method, URL: request.URL, StatusCode: response.StatusCode}
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err = json.NewDecoder(response.Body).Decode(&token); err != nil {
+		return "", errors.Wrap(err, "failed to decode the token")
+	}
+
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	if token.Token == "" {
+		return "", errors.New("the token server returned no token")
+	}
+	return token.Token, nil
+}
+
+type RegistryStatusError struct {
+	Method     string
+	URL        *url.URL
+	StatusCode int
+}
+
+func (r RegistryStatusError) Error() string {
+	return fmt.Sprintf("Registry request failed: %s %s: Status code %d", r.Method, r.URL.Path, r.StatusCode)
+}
+
+// ParseImageReference splits a reference like registry.example.com/org/app:tag.
+// The registry cannot be omitted and the tag defaults to latest.
+func ParseImageReference(imageRef string) (registry, repository, tag string, err error) {
+	if strings.Contains(imageRef, "@") {
+		return "", "", "", fmt.Errorf("image reference %q: pushing by digest is not supported", imageRef)
+	}
+
+	slash := strings.Index(imageRef, "/")
+	if slash <= 0 || slash == len(imageRef)-1 {
+		return "", "", "", fmt.Errorf("image reference %q does not name a registry and a repository", imageRef)
+	}
+	registry, repository = imageRef[:slash], imageRef[slash+1:]
+
+	tag = "latest"
+	if colon := strings.LastIndex(repository, ":"); colon > strings.LastIndex(repository, "/") {
+		repository, tag = repository[:colon], repository[colon+1:]
+	}
+	if repository == "" || tag == "" {
+		return "", "", "", fmt.Errorf("image reference %q is malformed", imageRef)
+	}
+
+	return registry, repository, tag, nil
+}
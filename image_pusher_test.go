@@ -0,0 +1,289 @@
+package eirinistaging_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "code.cloudfoundry.org/eirini-staging"
+	"code.cloudfoundry.org/eirini-staging/builder"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("ImagePusher", func() {
+	var (
+		server      *ghttp.Server
+		layoutDir   string
+		config      builder.OCIDescriptor
+		layer       builder.OCIDescriptor
+		stack       builder.OCIDescriptor
+		manifest    []byte
+		credentials RegistryCredentials
+		imageRef    string
+		err         error
+	)
+
+	BeforeEach(func() {
+		layoutDir, err = ioutil.TempDir("", "image-layout")
+		Expect(err).NotTo(HaveOccurred())
+
+		layout, err := builder.CreateOCILayout(layoutDir)
+		Expect(err).NotTo(HaveOccurred())
+
+		config, err = layout.WriteBlob(builder.MediaTypeOCIConfig, []byte(`{"os":"linux"}`))
+		Expect(err).NotTo(HaveOccurred())
+		layer, err = layout.WriteBlob(builder.MediaTypeOCILayer, []byte("not really a layer"))
+		Expect(err).NotTo(HaveOccurred())
+		stack = builder.OCIDescriptor{
+			MediaType: builder.MediaTypeOCIForeignLayer,
+			Digest:    "sha256:aaaa",
+			Size:      42,
+		}
+
+		manifestDescriptor, err := layout.WriteJSONBlob(builder.MediaTypeOCIManifest, builder.OCIManifest{
+			SchemaVersion: 2,
+			MediaType:     builder.MediaTypeOCIManifest,
+			Config:        config,
+			Layers:        []builder.OCIDescriptor{stack, layer},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(layout.WriteIndex(manifestDescriptor, "latest")).To(Succeed())
+		manifest, err = ioutil.ReadFile(layout.BlobPath(manifestDescriptor.Digest))
+		Expect(err).NotTo(HaveOccurred())
+
+		server = ghttp.NewServer()
+		imageRef = strings.TrimPrefix(server.URL(), "http://") + "/org/app:v1"
+		credentials = RegistryCredentials{}
+
+		server.RouteToHandler("HEAD", "/v2/org/app/blobs/"+config.Digest, ghttp.RespondWith(http.StatusNotFound, nil))
+		server.RouteToHandler("HEAD", "/v2/org/app/blobs/"+layer.Digest, ghttp.RespondWith(http.StatusNotFound, nil))
+		server.RouteToHandler("POST", "/v2/org/app/blobs/uploads/", ghttp.RespondWith(http.StatusAccepted, nil, http.Header{
+			"Location": []string{"/v2/org/app/blobs/uploads/some-session?state=abc"},
+		}))
+		server.RouteToHandler("PUT", "/v2/org/app/blobs/uploads/some-session", ghttp.RespondWith(http.StatusCreated, nil))
+		server.RouteToHandler("PUT", "/v2/org/app/manifests/v1", ghttp.CombineHandlers(
+			ghttp.VerifyContentType(builder.MediaTypeOCIManifest),
+			func(w http.ResponseWriter, r *http.Request) {
+				body, readErr := ioutil.ReadAll(r.Body)
+				Expect(readErr).NotTo(HaveOccurred())
+				Expect(body).To(Equal(manifest))
+			},
+			ghttp.RespondWith(http.StatusCreated, nil),
+		))
+	})
+
+	JustBeforeEach(func() {
+		pusher := ImagePusher{
+			Client:      &http.Client{},
+			Insecure:    true,
+			Credentials: credentials,
+		}
+		err = pusher.Push(context.Background(), layoutDir, imageRef)
+	})
+
+	AfterEach(func() {
+		server.Close()
+		Expect(os.RemoveAll(layoutDir)).To(Succeed())
+	})
+
+	uploads := func() map[string]string {
+		uploaded := map[string]string{}
+		for _, request := range server.ReceivedRequests() {
+			if request.Method == "PUT" && strings.HasPrefix(request.URL.Path, "/v2/org/app/blobs/uploads/") {
+				Expect(request.URL.Query().Get("state")).To(Equal("abc"))
+				uploaded[request.URL.Query().Get("digest")] = request.Header.Get("Content-Length")
+			}
+		}
+		return uploaded
+	}
+
+	It("pushes the blobs and then the manifest", func() {
+		Expect(err).NotTo(HaveOccurred())
+		Expect(uploads()).To(Equal(map[string]string{
+			config.Digest: "14",
+			layer.Digest:  "18",
+		}))
+
+		requests := server.ReceivedRequests()
+		Expect(requests[len(requests)-1].URL.Path).To(Equal("/v2/org/app/manifests/v1"))
+	})
+
+	It("does not push nondistributable layers", func() {
+		for _, request := range server.ReceivedRequests() {
+			Expect(request.URL.Path).NotTo(ContainSubstring(stack.Digest))
+		}
+	})
+
+	Context("when the registry has a blob already", func() {
+		BeforeEach(func() {
+			server.RouteToHandler("HEAD", "/v2/org/app/blobs/"+layer.Digest, ghttp.RespondWith(http.StatusOK, nil))
+		})
+
+		It("does not push it again", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(uploads()).To(HaveLen(1))
+			Expect(uploads()).To(HaveKey(config.Digest))
+		})
+	})
+
+	Context("when a blob is neither in the layout nor in the registry", func() {
+		BeforeEach(func() {
+			Expect(os.Remove(filepath.Join(layoutDir, "blobs", "sha256", strings.TrimPrefix(layer.Digest, "sha256:")))).To(Succeed())
+		})
+
+		It("fails", func() {
+			Expect(err).To(MatchError(ContainSubstring("neither in the image layout nor in the registry")))
+		})
+	})
+
+	Context("with credentials", func() {
+		BeforeEach(func() {
+			credentials = RegistryCredentials{Username: "user", Password: "secret"}
+		})
+
+		It("authenticates every request", func() {
+			Expect(err).NotTo(HaveOccurred())
+			for _, request := range server.ReceivedRequests() {
+				username, password, ok := request.BasicAuth()
+				Expect(ok).To(BeTrue())
+				Expect(username).To(Equal("user"))
+				Expect(password).To(Equal("secret"))
+			}
+		})
+	})
+
+	Context("when the registry uploads blobs to another host", func() {
+		var storage *ghttp.Server
+
+		BeforeEach(func() {
+			credentials = RegistryCredentials{Username: "user", Password: "secret"}
+
+			storage = ghttp.NewServer()
+			storage.RouteToHandler("PUT", "/upload", ghttp.CombineHandlers(
+				func(w http.ResponseWriter, r *http.Request) {
+					Expect(r.Header.Get("Authorization")).To(BeEmpty())
+				},
+				ghttp.RespondWith(http.StatusCreated, nil),
+			))
+			server.RouteToHandler("POST", "/v2/org/app/blobs/uploads/", ghttp.RespondWith(http.StatusAccepted, nil, http.Header{
+				"Location": []string{storage.URL() + "/upload?state=abc"},
+			}))
+		})
+
+		AfterEach(func() {
+			storage.Close()
+		})
+
+		It("does not send it the credentials", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(storage.ReceivedRequests()).To(HaveLen(2))
+		})
+	})
+
+	Context("when the registry requires a bearer token", func() {
+		var (
+			registry    *httptest.Server
+			tokenScopes []string
+		)
+
+		BeforeEach(func() {
+			credentials = RegistryCredentials{Username: "user", Password: "secret"}
+			tokenScopes = nil
+
+			registry = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer GinkgoRecover()
+
+				if r.URL.Path == "/token" {
+					username, password, ok := r.BasicAuth()
+					Expect(ok).To(BeTrue())
+					Expect([]string{username, password}).To(Equal([]string{"user", "secret"}))
+					Expect(r.URL.Query().Get("service")).To(Equal("registry.example.com"))
+					tokenScopes = append(tokenScopes, r.URL.Query().Get("scope"))
+					fmt.Fprint(w, `{"token":"t0ken"}`)
+					return
+				}
+
+				if r.Header.Get("Authorization") != "Bearer t0ken" {
+					w.Header().Set("WWW-Authenticate", fmt.Sprintf(
+						`Bearer realm="http://%s/token",service="registry.example.com",scope="repository:org/app:pull,push"`, r.Host))
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				server.ServeHTTP(w, r)
+			}))
+			imageRef = strings.TrimPrefix(registry.URL, "http://") + "/org/app:v1"
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		It("gets a token and pushes with it", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tokenScopes).To(Equal([]string{"repository:org/app:pull,push"}))
+			Expect(uploads()).To(HaveLen(2))
+		})
+	})
+
+	Context("when the registry rejects the manifest", func() {
+		BeforeEach(func() {
+			server.RouteToHandler("PUT", "/v2/org/app/manifests/v1", ghttp.RespondWith(http.StatusBadRequest, nil))
+		})
+
+		It("fails with the status code", func() {
+			Expect(err).To(MatchError(ContainSubstring("Status code 400")))
+		})
+	})
+})
+
+var _ = Describe("ParseImageReference", func() {
+	It("splits the registry, the repository and the tag", func() {
+		registry, repository, tag, err := ParseImageReference("registry.example.com:5000/org/app:v1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect([]string{registry, repository, tag}).To(Equal([]string{"registry.example.com:5000", "org/app", "v1"}))
+	})
+
+	It("defaults the tag to latest", func() {
+		_, repository, tag, err := ParseImageReference("registry.example.com:5000/org/app")
+		Expect(err).NotTo(HaveOccurred())
+		Expect([]string{repository, tag}).To(Equal([]string{"org/app", "latest"}))
+	})
+
+	It("requires a registry", func() {
+		_, _, _, err := ParseImageReference("app:v1")
+		Expect(err).To(MatchError(ContainSubstring("does not name a registry")))
+	})
+
+	It("does not push by digest", func() {
+		_, _, _, err := ParseImageReference("registry.example.com/app@sha256:aaaa")
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("LoadRegistryCredentials", func() {
+	It("returns no credentials when the secret is not mounted", func() {
+		credentials, err := LoadRegistryCredentials("/does/not/exist")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(credentials).To(Equal(RegistryCredentials{}))
+	})
+
+	It("reads the username and the password", func() {
+		dir, err := ioutil.TempDir("", "registry-credentials")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		Expect(ioutil.WriteFile(filepath.Join(dir, RegistryUsernameFileName), []byte("user\n"), 0600)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, RegistryPasswordFileName), []byte("secret\n"), 0600)).To(Succeed())
+
+		credentials, err := LoadRegistryCredentials(dir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(credentials).To(Equal(RegistryCredentials{Username: "user", Password: "secret"}))
+	})
+})
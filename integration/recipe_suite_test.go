@@ -26,6 +26,7 @@ type BinaryPaths struct {
 	DownloaderPath string `json:"downloader_path"`
 	ExecutorPath   string `json:"executor_path"`
 	UploaderPath   string `json:"uploader_path"`
+	StagePath      string `json:"stage_path"`
 }
 
 var _ = SynchronizedBeforeSuite(func() []byte {
@@ -42,10 +43,14 @@ var _ = SynchronizedBeforeSuite(func() []byte {
 	uploaderPath, err := gexec.Build(filepath.Join(sourcePath, "cmd/uploader"))
 	Expect(err).NotTo(HaveOccurred())
 
+	stagePath, err := gexec.Build(filepath.Join(sourcePath, "cmd/stage"))
+	Expect(err).NotTo(HaveOccurred())
+
 	b := BinaryPaths{
 		DownloaderPath: downloaderPath,
 		ExecutorPath:   executorPath,
 		UploaderPath:   uploaderPath,
+		StagePath:      stagePath,
 	}
 
 	bytes, err := json.Marshal(b)
@@ -65,4 +70,6 @@ var _ = AfterSuite(func() {
 	Expect(err).NotTo(HaveOccurred())
 	err = os.RemoveAll(binaries.UploaderPath)
 	Expect(err).NotTo(HaveOccurred())
+	err = os.RemoveAll(binaries.StagePath)
+	Expect(err).NotTo(HaveOccurred())
 })
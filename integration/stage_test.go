@@ -0,0 +1,99 @@
+package recipe_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"code.cloudfoundry.org/eirini-staging/builder"
+	"github.com/onsi/gomega/gexec"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Staging locally", func() {
+	var (
+		outputDir  string
+		args       []string
+		session    *gexec.Session
+		buildpacks = filepath.Join("..", "builder", "fixtures", "buildpacks", "unix")
+	)
+
+	BeforeEach(func() {
+		var err error
+		outputDir, err = ioutil.TempDir("", "stage-output")
+		Expect(err).NotTo(HaveOccurred())
+
+		args = []string{
+			"-app", filepath.Join("..", "builder", "fixtures", "apps", "bash-app"),
+			"-buildpack", filepath.Join(buildpacks, "always-detects"),
+			"-output", outputDir,
+		}
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		session, err = gexec.Start(exec.Command(binaries.StagePath, args...), GinkgoWriter, GinkgoWriter)
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(session, 60).Should(gexec.Exit())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(outputDir)).To(Succeed())
+	})
+
+	It("writes the droplet and the staging result", func() {
+		Expect(session.ExitCode()).To(BeZero())
+		Expect(filepath.Join(outputDir, "droplet.tgz")).To(BeARegularFile())
+
+		contents, err := ioutil.ReadFile(filepath.Join(outputDir, "result.json"))
+		Expect(err).NotTo(HaveOccurred())
+		var result builder.StagingResult
+		Expect(json.Unmarshal(contents, &result)).To(Succeed())
+		Expect(result.ProcessTypes).To(Equal(builder.ProcessTypes{"web": "the start command"}))
+	})
+
+	Context("with a zipped app and an archived buildpack", func() {
+		BeforeEach(func() {
+			archive := filepath.Join(outputDir, "buildpack.tgz")
+			Expect(exec.Command("tar", "-C", filepath.Join(buildpacks, "always-detects"), "-czf", archive, ".").Run()).To(Succeed())
+
+			args = []string{
+				"-app", filepath.Join("testdata", "dora.zip"),
+				"-buildpack", archive,
+				"-output", outputDir,
+			}
+		})
+
+		It("extracts both", func() {
+			Expect(session.ExitCode()).To(BeZero())
+			Expect(filepath.Join(outputDir, "droplet.tgz")).To(BeARegularFile())
+		})
+	})
+
+	Context("with a cache dir", func() {
+		BeforeEach(func() {
+			Expect(ioutil.WriteFile(filepath.Join(outputDir, "notes.txt"), []byte("mine"), 0644)).To(Succeed())
+			args = append(args, "-cache-dir", outputDir)
+		})
+
+		It("keeps the cache in a directory of its own", func() {
+			Expect(session.ExitCode()).To(BeZero())
+			Expect(filepath.Join(outputDir, "eirini-stage-cache")).To(BeADirectory())
+			Expect(filepath.Join(outputDir, "notes.txt")).To(BeARegularFile())
+		})
+	})
+
+	Context("when no buildpack detects", func() {
+		BeforeEach(func() {
+			args[3] = filepath.Join(buildpacks, "always-fails-detect")
+		})
+
+		It("exits with the detect failure code", func() {
+			Expect(session.ExitCode()).To(Equal(builder.DetectFailCode))
+		})
+	})
+})
@@ -1,15 +1,68 @@
 package eirinistaging
 
 import (
+	"context"
+	"fmt"
+
 	"code.cloudfoundry.org/eirini-staging/builder"
 )
 
-type NotZipFileError struct {
-	err error
+type UnsupportedArchiveError struct{}
+
+func (u UnsupportedArchiveError) Error() string {
+	return "not a supported archive: expected zip, tar.gz, tar.bz2, tar.xz or tar.zst"
+}
+
+type ChecksumMismatchError struct {
+	Buildpack string
+	Expected  string
+	Actual    string
+}
+
+func (c ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("checksum mismatch for buildpack %s: expected sha256 %s, got %s", c.Buildpack, c.Expected, c.Actual)
+}
+
+type PathTraversalError struct {
+	Entry string
+}
+
+func (p PathTraversalError) Error() string {
+	return fmt.Sprintf("archive entry %s escapes the target directory", p.Entry)
+}
+
+type SymlinkEscapeError struct {
+	Entry  string
+	Target string
+}
+
+func (s SymlinkEscapeError) Error() string {
+	return fmt.Sprintf("archive symlink %s points to %s outside the target directory", s.Entry, s.Target)
+}
+
+type ArchiveTooLargeError struct {
+	Limit int64
+}
+
+func (a ArchiveTooLargeError) Error() string {
+	return fmt.Sprintf("archive exceeds the maximum uncompressed size of %d bytes", a.Limit)
+}
+
+type TooManyEntriesError struct {
+	Limit int
+}
+
+func (t TooManyEntriesError) Error() string {
+	return fmt.Sprintf("archive exceeds the maximum of %d entries", t.Limit)
+}
+
+type CompressionRatioError struct {
+	Entry string
+	Limit float64
 }
 
-func (z NotZipFileError) Error() string {
-	return z.err.Error()
+func (c CompressionRatioError) Error() string {
+	return fmt.Sprintf("archive entry %s exceeds the maximum compression ratio of %g", c.Entry, c.Limit)
 }
 
 type Executor interface {
@@ -23,12 +76,12 @@ type StagingResultModifier interface {
 
 //go:generate counterfeiter . Uploader
 type Uploader interface {
-	Upload(path, url string) error
+	Upload(ctx context.Context, path, url string) error
 }
 
 //go:generate counterfeiter . Installer
 type Installer interface {
-	Install() error
+	Install(ctx context.Context) error
 }
 
 //go:generate counterfeiter . Commander
@@ -1,8 +1,8 @@
 package eirinistaging
 
 import (
+	"context"
 	"fmt"
-	"io"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -14,17 +14,19 @@ type PackageInstaller struct {
 	client      *http.Client
 	downloadURL string
 	downloadDir string
+	retryPolicy RetryPolicy
 }
 
-func NewPackageManager(client *http.Client, downloadURL, downloadDir string) Installer {
+func NewPackageManager(client *http.Client, downloadURL, downloadDir string, retryPolicy RetryPolicy) Installer {
 	return &PackageInstaller{
 		client:      client,
 		downloadURL: downloadURL,
 		downloadDir: downloadDir,
+		retryPolicy: retryPolicy,
 	}
 }
 
-func (d *PackageInstaller) Install() error {
+func (d *PackageInstaller) Install(ctx context.Context) error {
 	if d.downloadURL == "" {
 		return errors.New("empty downloadURL provided")
 	}
@@ -34,7 +36,7 @@ func (d *PackageInstaller) Install() error {
 	}
 
 	downloadPath := filepath.Join(d.downloadDir, AppBits)
-	err := d.download(d.downloadURL, downloadPath)
+	err := d.download(ctx, d.downloadURL, downloadPath)
 	if err != nil {
 		return err
 	}
@@ -42,26 +44,19 @@ func (d *PackageInstaller) Install() error {
 	return nil
 }
 
-func (d *PackageInstaller) download(downloadURL string, filepath string) error {
+func (d *PackageInstaller) download(ctx context.Context, downloadURL string, filepath string) error {
 	file, err := os.Create(filepath)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	resp, err := d.client.Get(downloadURL)
-	if err != nil {
-		return errors.Wrap(err, fmt.Sprintf("failed to perform get request on: %s", downloadURL))
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return errors.New(fmt.Sprintf("download failed. status code %d", resp.StatusCode))
+	err = d.retryPolicy.Download(ctx, d.client, downloadURL, file)
+	if statusErr, ok := err.(StatusCodeError); ok {
+		return errors.New(fmt.Sprintf("download failed. status code %d", statusErr.StatusCode))
 	}
-
-	_, err = io.Copy(file, resp.Body)
 	if err != nil {
-		return errors.Wrap(err, "failed to copy content to file")
+		return errors.Wrap(err, fmt.Sprintf("failed to perform get request on: %s", downloadURL))
 	}
 
 	return nil
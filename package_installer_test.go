@@ -3,6 +3,7 @@ package eirinistaging_test
 import (
 	"archive/zip"
 	"bytes"
+	"context"
 	"io/ioutil"
 	"net/http"
 
@@ -41,8 +42,8 @@ var _ = Describe("PackageInstaller", func() {
 	})
 
 	JustBeforeEach(func() {
-		installer = NewPackageManager(&http.Client{}, downloadURL, downloadDir)
-		err = installer.Install()
+		installer = NewPackageManager(&http.Client{}, downloadURL, downloadDir, NewRetryPolicy(1, 0, 0))
+		err = installer.Install(context.Background())
 	})
 
 	AfterEach(func() {
@@ -0,0 +1,148 @@
+package eirinistaging
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const maxSymlinkHops = 40
+
+// errUnstablePath is returned for paths whose ".." follows a component that
+// does not exist yet: where it leads depends on what later becomes of that
+// component, which might be a symlink.
+var errUnstablePath = errors.New("path goes up through a component that does not exist")
+
+func isWithin(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// resolvesWithin reports whether path, once every symlink on the way is
+// followed, ends up inside dir. Lexical checks are not enough: a link to "."
+// followed by ".." leaves the directory even though the path looks contained.
+func resolvesWithin(dir, path string) (bool, error) {
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return false, err
+	}
+
+	hops := 0
+	resolved, err := resolvePath(path, &hops)
+	if err != nil {
+		return false, err
+	}
+
+	return isWithin(realDir, resolved), nil
+}
+
+// resolvePath walks an absolute, possibly unclean path one component at a
+// time, following symlinks as the kernel would. Components that do not
+// exist yet are resolved lexically, unless a ".." follows them.
+func resolvePath(path string, hops *int) (string, error) {
+	current := string(filepath.Separator)
+	components := strings.Split(path, string(filepath.Separator))
+
+	for i, component := range components {
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			current = filepath.Dir(current)
+			continue
+		}
+
+		next := filepath.Join(current, component)
+		info, err := os.Lstat(next)
+		if err != nil {
+			if os.IsNotExist(err) {
+				for _, later := range components[i+1:] {
+					if later == ".." {
+						return "", errUnstablePath
+					}
+				}
+				rest := strings.Join(components[i+1:], string(filepath.Separator))
+				return filepath.Join(next, rest), nil
+			}
+			return "", err
+		}
+
+		if info.Mode()&os.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+
+		*hops++
+		if *hops > maxSymlinkHops {
+			return "", errors.New("too many levels of symbolic links")
+		}
+
+		target, err := os.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(target) {
+			target = current + string(filepath.Separator) + target
+		}
+
+		if current, err = resolvePath(target, hops); err != nil {
+			return "", err
+		}
+	}
+
+	return current, nil
+}
+
+// checkDestination makes sure an archive entry is written inside targetDir,
+// also when earlier entries created symlinks along its path.
+func checkDestination(targetDir, entry, destPath string) error {
+	if !isWithin(targetDir, destPath) {
+		return PathTraversalError{Entry: entry}
+	}
+
+	within, err := resolvesWithin(targetDir, destPath)
+	if err != nil {
+		return err
+	}
+	if !within {
+		return PathTraversalError{Entry: entry}
+	}
+
+	return nil
+}
+
+// createSymlink creates the symlink for an archive entry, as long as the
+// link resolves to a location inside targetDir. Targets that go up through
+// paths later entries could still create are refused, as the link would be
+// checked against a layout that does not last.
+func createSymlink(targetDir, entry, linkTarget, destPath string) error {
+	parentDir := filepath.Dir(destPath)
+	if err := os.MkdirAll(parentDir, 0755); err != nil {
+		return err
+	}
+
+	resolvedTarget := linkTarget
+	if !filepath.IsAbs(linkTarget) {
+		hops := 0
+		realParentDir, err := resolvePath(parentDir, &hops)
+		if err != nil {
+			return err
+		}
+		resolvedTarget = realParentDir + string(filepath.Separator) + linkTarget
+	}
+
+	within, err := resolvesWithin(targetDir, resolvedTarget)
+	if err != nil && err != errUnstablePath {
+		return err
+	}
+	if !within {
+		return SymlinkEscapeError{Entry: entry, Target: linkTarget}
+	}
+
+	return os.Symlink(linkTarget, destPath)
+}
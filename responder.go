@@ -49,8 +49,11 @@ func (r Responder) RespondWithFailure(failure error) {
 	}
 }
 
-func (r Responder) PrepareSuccessResponse(outputLocation, buildpackCfg string) (*models.TaskCallbackResponse, error) {
-	resp, err := r.createSuccessResponse(outputLocation, buildpackCfg)
+// PrepareSuccessResponse passes the staging result on to Eirini. Steps taken
+// after the result was written, like uploading the droplet, are added to its
+// staging report.
+func (r Responder) PrepareSuccessResponse(outputLocation, buildpackCfg string, steps ...builder.StepReport) (*models.TaskCallbackResponse, error) {
+	resp, err := r.createSuccessResponse(outputLocation, buildpackCfg, steps)
 	if err != nil {
 		return nil, err
 	}
@@ -62,12 +65,19 @@ func (r Responder) RespondWithSuccess(resp *models.TaskCallbackResponse) error {
 	return r.sendCompleteResponse(resp)
 }
 
-func (r Responder) createSuccessResponse(outputMetadataLocation string, buildpackJSON string) (*models.TaskCallbackResponse, error) {
+func (r Responder) createSuccessResponse(outputMetadataLocation string, buildpackJSON string, steps []builder.StepReport) (*models.TaskCallbackResponse, error) {
 	stagingResult, err := r.getStagingResult(outputMetadataLocation)
 	if err != nil {
 		return nil, err
 	}
 
+	if len(steps) > 0 {
+		if stagingResult.StagingReport == nil {
+			stagingResult.StagingReport = &builder.StagingReport{}
+		}
+		stagingResult.StagingReport.Steps = append(stagingResult.StagingReport.Steps, steps...)
+	}
+
 	modifier := &BuildpacksKeyModifier{CCBuildpacksJSON: buildpackJSON}
 	stagingResult, err = modifier.Modify(stagingResult)
 	if err != nil {
@@ -8,9 +8,11 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"time"
 
 	"code.cloudfoundry.org/bbs/models"
 	. "code.cloudfoundry.org/eirini-staging"
+	"code.cloudfoundry.org/eirini-staging/builder"
 	"code.cloudfoundry.org/runtimeschema/cc_messages"
 	"code.cloudfoundry.org/tlsconfig"
 	. "github.com/onsi/ginkgo"
@@ -198,6 +200,32 @@ var _ = Describe("Responder", func() {
 					Expect(err).NotTo(HaveOccurred())
 				})
 			})
+
+			Context("when steps are passed along", func() {
+				BeforeEach(func() {
+					resultContents = `{"lifecycle_type":"buildpack","staging_report":{"steps":[{"step":"tar","wall_time_ms":20}],"phases":[]}}`
+					resultsFilePath = resultsFile(resultContents)
+				})
+
+				AfterEach(func() {
+					Expect(os.Remove(resultsFilePath)).To(Succeed())
+				})
+
+				It("should add them to the staging report", func() {
+					buildpacks, err := json.Marshal([]cc_messages.Buildpack{{}})
+					Expect(err).NotTo(HaveOccurred())
+
+					resp, err := responder.PrepareSuccessResponse(resultsFilePath, string(buildpacks), builder.NewStepReport(builder.StepUpload, 3*time.Second))
+					Expect(err).NotTo(HaveOccurred())
+
+					var result builder.StagingResult
+					Expect(json.Unmarshal([]byte(resp.Result), &result)).To(Succeed())
+					Expect(result.StagingReport.Steps).To(Equal([]builder.StepReport{
+						{Step: "tar", WallTimeMS: 20},
+						{Step: "upload", WallTimeMS: 3000},
+					}))
+				})
+			})
 		})
 
 	})
@@ -0,0 +1,150 @@
+package eirinistaging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/eirini-staging/builder"
+	"github.com/pkg/errors"
+)
+
+const (
+	ServiceBindingTypeFileName     = "type"
+	ServiceBindingProviderFileName = "provider"
+)
+
+// ServiceBinding is a binding the way it is listed in VCAP_SERVICES.
+type ServiceBinding struct {
+	Name         string            `json:"name"`
+	InstanceName string            `json:"instance_name"`
+	BindingName  string            `json:"binding_name"`
+	Label        string            `json:"label"`
+	Provider     string            `json:"provider,omitempty"`
+	Plan         string            `json:"plan"`
+	Tags         []string          `json:"tags"`
+	Credentials  map[string]string `json:"credentials"`
+}
+
+// LoadServiceBindings reads the bindings in root, which follows the
+// servicebinding.io layout: a directory per binding holding a type file, an
+// optional provider file and a file per credential. Bindings are labelled
+// with their type. Malformed bindings are skipped with a warning.
+func LoadServiceBindings(root string) ([]ServiceBinding, error) {
+	entries, err := ioutil.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read service bindings")
+	}
+
+	var bindings []ServiceBinding
+	for _, entry := range entries {
+		if isHidden(entry.Name()) {
+			continue
+		}
+
+		binding, err := loadServiceBinding(filepath.Join(root, entry.Name()))
+		if err != nil {
+			log.Printf("warning: ignoring service binding %q: %s", entry.Name(), err.Error())
+			continue
+		}
+
+		bindings = append(bindings, binding)
+	}
+
+	return bindings, nil
+}
+
+func loadServiceBinding(dir string) (ServiceBinding, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return ServiceBinding{}, err
+	}
+	if !info.IsDir() {
+		return ServiceBinding{}, errors.New("not a directory")
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return ServiceBinding{}, err
+	}
+
+	name := filepath.Base(dir)
+	binding := ServiceBinding{
+		Name:         name,
+		InstanceName: name,
+		BindingName:  name,
+		Tags:         []string{},
+		Credentials:  map[string]string{},
+	}
+
+	for _, entry := range entries {
+		if isHidden(entry.Name()) {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		// mounted secrets link their files to a hidden directory
+		info, err := os.Stat(path)
+		if err != nil {
+			return ServiceBinding{}, err
+		}
+		if info.IsDir() {
+			log.Printf("warning: ignoring directory %q of service binding %q", entry.Name(), name)
+			continue
+		}
+
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return ServiceBinding{}, err
+		}
+
+		switch entry.Name() {
+		case ServiceBindingTypeFileName:
+			binding.Label = strings.TrimSpace(string(contents))
+		case ServiceBindingProviderFileName:
+			binding.Provider = strings.TrimSpace(string(contents))
+		default:
+			binding.Credentials[entry.Name()] = string(contents)
+		}
+	}
+
+	if binding.Label == "" {
+		return ServiceBinding{}, fmt.Errorf("missing or empty %s file", ServiceBindingTypeFileName)
+	}
+
+	return binding, nil
+}
+
+// AddServiceBindings adds the bindings in root to the VCAP_SERVICES of env,
+// grouped by label like Cloud Controller does.
+func AddServiceBindings(env *builder.StagingEnvironment, root string) error {
+	bindings, err := LoadServiceBindings(root)
+	if err != nil || len(bindings) == 0 {
+		return err
+	}
+
+	services := map[string][]interface{}{}
+	if len(env.VcapServices) > 0 {
+		if err = json.Unmarshal(env.VcapServices, &services); err != nil {
+			return errors.Wrap(err, "invalid VCAP_SERVICES in the staging environment")
+		}
+	}
+
+	for _, binding := range bindings {
+		services[binding.Label] = append(services[binding.Label], binding)
+	}
+
+	env.VcapServices, err = json.Marshal(services)
+	return err
+}
+
+func isHidden(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
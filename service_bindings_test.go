@@ -0,0 +1,189 @@
+package eirinistaging_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+
+	eirinistaging "code.cloudfoundry.org/eirini-staging"
+	"code.cloudfoundry.org/eirini-staging/builder"
+)
+
+var _ = Describe("Service bindings", func() {
+	var (
+		logOut *gbytes.Buffer
+		root   string
+		env    builder.StagingEnvironment
+		err    error
+	)
+
+	writeBinding := func(name string, files map[string]string) {
+		dir := filepath.Join(root, name)
+		Expect(os.MkdirAll(dir, 0755)).To(Succeed())
+		for file, contents := range files {
+			Expect(ioutil.WriteFile(filepath.Join(dir, file), []byte(contents), 0644)).To(Succeed())
+		}
+	}
+
+	BeforeEach(func() {
+		logOut = gbytes.NewBuffer()
+		log.SetOutput(logOut)
+
+		root, err = ioutil.TempDir("", "bindings")
+		Expect(err).NotTo(HaveOccurred())
+
+		env = builder.StagingEnvironment{}
+	})
+
+	AfterEach(func() {
+		log.SetOutput(os.Stderr)
+		Expect(os.RemoveAll(root)).To(Succeed())
+	})
+
+	JustBeforeEach(func() {
+		err = eirinistaging.AddServiceBindings(&env, root)
+	})
+
+	Context("when there are bindings", func() {
+		BeforeEach(func() {
+			writeBinding("orders-db", map[string]string{
+				"type":     "postgresql",
+				"provider": "crunchy",
+				"username": "orders",
+				"password": "s3cret",
+			})
+			writeBinding("accounts-db", map[string]string{
+				"type": "postgresql\n",
+				"uri":  "postgres://accounts",
+			})
+			writeBinding("cache", map[string]string{
+				"type": "redis",
+				"host": "redis.local",
+			})
+		})
+
+		It("groups them by type in VCAP_SERVICES", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(env.VcapServices).To(MatchJSON(`{
+				"postgresql": [
+					{
+						"name": "accounts-db",
+						"instance_name": "accounts-db",
+						"binding_name": "accounts-db",
+						"label": "postgresql",
+						"plan": "",
+						"tags": [],
+						"credentials": {"uri": "postgres://accounts"}
+					},
+					{
+						"name": "orders-db",
+						"instance_name": "orders-db",
+						"binding_name": "orders-db",
+						"label": "postgresql",
+						"provider": "crunchy",
+						"plan": "",
+						"tags": [],
+						"credentials": {"username": "orders", "password": "s3cret"}
+					}
+				],
+				"redis": [
+					{
+						"name": "cache",
+						"instance_name": "cache",
+						"binding_name": "cache",
+						"label": "redis",
+						"plan": "",
+						"tags": [],
+						"credentials": {"host": "redis.local"}
+					}
+				]
+			}`))
+		})
+
+		Context("and the staging environment has services already", func() {
+			BeforeEach(func() {
+				env.VcapServices = json.RawMessage(`{"redis": [{"name": "sessions"}]}`)
+			})
+
+			It("adds the bindings to them", func() {
+				Expect(err).NotTo(HaveOccurred())
+
+				var services map[string][]map[string]interface{}
+				Expect(json.Unmarshal(env.VcapServices, &services)).To(Succeed())
+				Expect(services["redis"]).To(HaveLen(2))
+				Expect(services["redis"][0]["name"]).To(Equal("sessions"))
+				Expect(services["redis"][1]["name"]).To(Equal("cache"))
+			})
+		})
+
+		Context("and the staging environment has invalid services", func() {
+			BeforeEach(func() {
+				env.VcapServices = json.RawMessage(`[]`)
+			})
+
+			It("returns an error", func() {
+				Expect(err).To(MatchError(ContainSubstring("invalid VCAP_SERVICES")))
+			})
+		})
+	})
+
+	Context("when the bindings are mounted from a secret", func() {
+		BeforeEach(func() {
+			data := filepath.Join(root, "cache", "..data")
+			Expect(os.MkdirAll(data, 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(data, "type"), []byte("redis"), 0644)).To(Succeed())
+			Expect(os.Symlink(filepath.Join("..data", "type"), filepath.Join(root, "cache", "type"))).To(Succeed())
+		})
+
+		It("follows the links and ignores the hidden directories", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(env.VcapServices)).To(ContainSubstring(`"redis":[{"name":"cache"`))
+			Expect(string(env.VcapServices)).To(ContainSubstring(`"credentials":{}`))
+		})
+	})
+
+	Context("when a binding is malformed", func() {
+		BeforeEach(func() {
+			writeBinding("cache", map[string]string{"type": "redis"})
+			writeBinding("no-type", map[string]string{"host": "example.com"})
+			writeBinding("empty-type", map[string]string{"type": " \n"})
+			Expect(ioutil.WriteFile(filepath.Join(root, "not-a-dir"), []byte("redis"), 0644)).To(Succeed())
+		})
+
+		It("skips it with a warning", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(logOut).To(gbytes.Say(`warning: ignoring service binding "empty-type": missing or empty type file`))
+			Expect(logOut).To(gbytes.Say(`warning: ignoring service binding "no-type": missing or empty type file`))
+			Expect(logOut).To(gbytes.Say(`warning: ignoring service binding "not-a-dir": not a directory`))
+
+			var services map[string][]eirinistaging.ServiceBinding
+			Expect(json.Unmarshal(env.VcapServices, &services)).To(Succeed())
+			Expect(services).To(HaveLen(1))
+			Expect(services["redis"]).To(HaveLen(1))
+		})
+	})
+
+	Context("when there are no bindings", func() {
+		It("leaves VCAP_SERVICES alone", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(env.VcapServices).To(BeEmpty())
+		})
+	})
+
+	Context("when the root does not exist", func() {
+		BeforeEach(func() {
+			Expect(os.RemoveAll(root)).To(Succeed())
+		})
+
+		It("leaves VCAP_SERVICES alone", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(env.VcapServices).To(BeEmpty())
+		})
+	})
+})
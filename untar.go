@@ -0,0 +1,185 @@
+package eirinistaging
+
+import (
+	"archive/tar"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+type TarGzipExtractor struct{}
+
+func (t *TarGzipExtractor) Extract(ctx context.Context, src, targetDir string) error {
+	return untarFile(ctx, src, targetDir, func(compressed io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(compressed)
+	})
+}
+
+type TarBzip2Extractor struct{}
+
+func (t *TarBzip2Extractor) Extract(ctx context.Context, src, targetDir string) error {
+	return untarFile(ctx, src, targetDir, func(compressed io.Reader) (io.ReadCloser, error) {
+		return nopCloser{bzip2.NewReader(compressed)}, nil
+	})
+}
+
+// TarXzExtractor relies on the xz binary, as the standard library has no xz
+// decoder.
+type TarXzExtractor struct{}
+
+func (t *TarXzExtractor) Extract(ctx context.Context, src, targetDir string) error {
+	xzPath, err := exec.LookPath("xz")
+	if err != nil {
+		return err
+	}
+
+	return untarFile(ctx, src, targetDir, func(compressed io.Reader) (io.ReadCloser, error) {
+		return newCommandReader(exec.CommandContext(ctx, xzPath, "--decompress", "--stdout"), compressed)
+	})
+}
+
+// TarZstdExtractor relies on the zstd binary, as the standard library has no
+// zstd decoder.
+type TarZstdExtractor struct{}
+
+func (t *TarZstdExtractor) Extract(ctx context.Context, src, targetDir string) error {
+	zstdPath, err := exec.LookPath("zstd")
+	if err != nil {
+		return err
+	}
+
+	return untarFile(ctx, src, targetDir, func(compressed io.Reader) (io.ReadCloser, error) {
+		return newCommandReader(exec.CommandContext(ctx, zstdPath, "--decompress", "--stdout", "--quiet"), compressed)
+	})
+}
+
+type decompressor func(compressed io.Reader) (io.ReadCloser, error)
+
+// untarFile extracts the archive at src, reading it through ctx so that the
+// extraction stops once ctx is done.
+func untarFile(ctx context.Context, src, targetDir string, decompress decompressor) error {
+	if targetDir == "" {
+		return errors.New("target directory cannot be empty")
+	}
+
+	file, err := os.Open(filepath.Clean(src))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader, err := decompress(contextReader{ctx: ctx, reader: file})
+	if err != nil {
+		return err
+	}
+
+	if err = untar(reader, targetDir); err != nil {
+		reader.Close()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+
+	return reader.Close()
+}
+
+func untar(reader io.Reader, targetDir string) error {
+	targetDir, err := filepath.Abs(targetDir)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(targetDir, 0755); err != nil {
+		return err
+	}
+
+	tarReader := tar.NewReader(reader)
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		destPath := filepath.Join(targetDir, filepath.Clean(header.Name))
+		if err = checkDestination(targetDir, header.Name, destPath); err != nil {
+			return err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(destPath, header.FileInfo().Mode().Perm())
+		case tar.TypeReg, tar.TypeRegA:
+			err = extractTarFile(tarReader, header, destPath)
+		case tar.TypeSymlink:
+			err = createSymlink(targetDir, header.Name, header.Linkname, destPath)
+		default:
+			// devices, fifos and hard links have no place in a buildpack
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func extractTarFile(reader io.Reader, header *tar.Header, destPath string) error {
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return err
+	}
+
+	destFile, err := os.OpenFile(destPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, header.FileInfo().Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer destFile.Close()
+
+	if _, err = io.Copy(destFile, reader); err != nil {
+		return err
+	}
+
+	return destFile.Chmod(header.FileInfo().Mode().Perm())
+}
+
+type nopCloser struct {
+	io.Reader
+}
+
+func (nopCloser) Close() error { return nil }
+
+// commandReader exposes the standard output of a filter command that reads
+// from the given input.
+type commandReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func newCommandReader(cmd *exec.Cmd, input io.Reader) (io.ReadCloser, error) {
+	cmd.Stdin = input
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	return &commandReader{ReadCloser: stdout, cmd: cmd}, nil
+}
+
+func (c *commandReader) Close() error {
+	// drain whatever is left so the command is not blocked writing to us
+	_, _ = io.Copy(ioutil.Discard, c.ReadCloser)
+	return c.cmd.Wait()
+}
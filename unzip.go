@@ -2,15 +2,33 @@ package eirinistaging
 
 import (
 	"archive/zip"
+	"context"
 	"errors"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 )
 
-type Unzipper struct{}
+// the compression ratio is only checked once an entry has inflated past this
+// size, so that small but highly compressible files do not trip it
+const compressionRatioThreshold = 1 << 20
 
-func (u *Unzipper) Extract(src, targetDir string) error {
+// maxSymlinkTargetLength bounds how much of a symlink entry is read as its
+// target.
+const maxSymlinkTargetLength = 4096
+
+// Unzipper extracts zip archives. A zero limit disables the corresponding
+// check.
+type Unzipper struct {
+	MaxTotalSize        int64
+	MaxEntries          int
+	MaxCompressionRatio float64
+}
+
+func (u *Unzipper) Extract(ctx context.Context, src, targetDir string) error {
 	if targetDir == "" {
 		return errors.New("target directory cannot be empty")
 	}
@@ -21,25 +39,98 @@ func (u *Unzipper) Extract(src, targetDir string) error {
 	}
 	defer reader.Close()
 
+	if u.MaxEntries > 0 && len(reader.File) > u.MaxEntries {
+		return TooManyEntriesError{Limit: u.MaxEntries}
+	}
+
+	targetDir, err = filepath.Abs(targetDir)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(targetDir, 0755); err != nil {
+		return err
+	}
+
+	var (
+		totalWritten int64
+		directories  []*zip.File
+	)
 	for _, file := range reader.File {
-		destPath := filepath.Join(filepath.Clean(targetDir), filepath.Clean(file.Name))
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		destPath := filepath.Join(targetDir, filepath.Clean(file.Name))
+		if err = checkDestination(targetDir, file.Name, destPath); err != nil {
+			return err
+		}
+
+		switch {
+		case file.FileInfo().IsDir():
+			// the mode is applied once the directory has been populated, as
+			// it might not allow us to write to it
+			directories = append(directories, file)
+			err = os.MkdirAll(destPath, 0755)
+		case file.Mode()&os.ModeSymlink != 0:
+			err = extractSymlink(file, targetDir, destPath)
+		default:
+			err = u.extractFile(ctx, file, destPath, &totalWritten)
+		}
 
-		if file.FileInfo().IsDir() {
-			if err = os.MkdirAll(destPath, file.Mode()); err != nil {
+		if err != nil {
+			return err
+		}
+	}
+
+	return restoreDirectories(directories, targetDir)
+}
+
+// restoreDirectories applies directory modes and modification times, deepest
+// directories first so that setting them does not touch their parents again.
+func restoreDirectories(directories []*zip.File, targetDir string) error {
+	sort.SliceStable(directories, func(i, j int) bool {
+		return depth(directories[i].Name) > depth(directories[j].Name)
+	})
+
+	for _, dir := range directories {
+		destPath := filepath.Join(targetDir, filepath.Clean(dir.Name))
+		if destPath == targetDir {
+			continue
+		}
+
+		if perm := dir.Mode().Perm(); perm != 0 {
+			if err := os.Chmod(destPath, perm); err != nil {
 				return err
 			}
-			continue
 		}
 
-		if err = extractFile(file, destPath); err != nil {
+		if err := restoreModTime(dir, destPath); err != nil {
 			return err
 		}
 	}
 
-	return err
+	return nil
+}
+
+func depth(name string) int {
+	return strings.Count(strings.Trim(filepath.ToSlash(name), "/"), "/")
+}
+
+// restoreModTime uses the modification time from the extended timestamp or
+// Unix extra fields when present, falling back to the MS-DOS time.
+func restoreModTime(src *zip.File, destPath string) error {
+	modified := src.Modified
+	if modified.IsZero() {
+		modified = src.ModTime()
+	}
+	if modified.IsZero() {
+		return nil
+	}
+
+	return os.Chtimes(destPath, modified, modified)
 }
 
-func extractFile(src *zip.File, destPath string) error {
+func (u *Unzipper) extractFile(ctx context.Context, src *zip.File, destPath string, totalWritten *int64) error {
 	parentDir := filepath.Dir(destPath)
 	if err := os.MkdirAll(parentDir, 0755); err != nil {
 		return err
@@ -57,9 +148,78 @@ func extractFile(src *zip.File, destPath string) error {
 	}
 	defer destFile.Close()
 
-	if _, err = io.Copy(destFile, reader); err != nil {
+	writer := &limitedWriter{
+		writer:       destFile,
+		unzipper:     u,
+		entry:        src.Name,
+		compressed:   int64(src.CompressedSize64),
+		totalWritten: totalWritten,
+	}
+	if _, err = io.Copy(writer, contextReader{ctx: ctx, reader: reader}); err != nil {
+		return err
+	}
+
+	if err = destFile.Chmod(src.Mode()); err != nil {
+		return err
+	}
+
+	if err = destFile.Close(); err != nil {
+		return err
+	}
+
+	return restoreModTime(src, destPath)
+}
+
+func extractSymlink(src *zip.File, targetDir, destPath string) error {
+	reader, err := src.Open()
+	if err != nil {
 		return err
 	}
+	defer reader.Close()
+
+	linkTarget, err := ioutil.ReadAll(io.LimitReader(reader, maxSymlinkTargetLength))
+	if err != nil {
+		return err
+	}
+
+	return createSymlink(targetDir, src.Name, string(linkTarget), destPath)
+}
+
+func (u *Unzipper) checkLimits(entry string, written, compressed, totalWritten int64) error {
+	if u.MaxTotalSize > 0 && totalWritten > u.MaxTotalSize {
+		return ArchiveTooLargeError{Limit: u.MaxTotalSize}
+	}
+
+	if u.MaxCompressionRatio > 0 && written > compressionRatioThreshold {
+		if compressed < 1 {
+			compressed = 1
+		}
+		if float64(written)/float64(compressed) > u.MaxCompressionRatio {
+			return CompressionRatioError{Entry: entry, Limit: u.MaxCompressionRatio}
+		}
+	}
+
+	return nil
+}
+
+// limitedWriter enforces the Unzipper limits on the bytes actually inflated,
+// as the sizes declared in the archive cannot be trusted.
+type limitedWriter struct {
+	writer       io.Writer
+	unzipper     *Unzipper
+	entry        string
+	compressed   int64
+	written      int64
+	totalWritten *int64
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	l.written += int64(len(p))
+	*l.totalWritten += int64(len(p))
+
+	if err := l.unzipper.checkLimits(l.entry, l.written, l.compressed, *l.totalWritten); err != nil {
+		return 0, err
+	}
 
-	return destFile.Chmod(src.Mode())
+	return l.writer.Write(p)
 }
@@ -1,10 +1,13 @@
 package eirinistaging_test
 
 import (
+	"archive/zip"
+	"context"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -19,6 +22,7 @@ var _ = Describe("Unzip function", func() {
 		srcZip    string
 		err       error
 		extractor Extractor
+		unzipper  *Unzipper
 		tmpDir    string
 	)
 
@@ -26,11 +30,12 @@ var _ = Describe("Unzip function", func() {
 		tmpDir, err = ioutil.TempDir("", "example")
 		Expect(err).NotTo(HaveOccurred())
 		targetDir = filepath.Join(tmpDir, "testdata")
+		unzipper = &Unzipper{}
 	})
 
 	JustBeforeEach(func() {
-		extractor = &Unzipper{}
-		err = extractor.Extract(srcZip, targetDir)
+		extractor = unzipper
+		err = extractor.Extract(context.Background(), srcZip, targetDir)
 	})
 
 	AfterEach(func() {
@@ -195,4 +200,256 @@ var _ = Describe("Unzip function", func() {
 		})
 	})
 
+	Context("When extracting real-world archives", func() {
+		var modTime time.Time
+
+		assertModTime := func(file string) {
+			fileInfo, statErr := os.Lstat(filepath.Join(targetDir, file))
+			Expect(statErr).ToNot(HaveOccurred())
+			Expect(fileInfo.ModTime().Equal(modTime)).To(BeTrue(), "%s has mod time %s, expected %s", file, fileInfo.ModTime(), modTime)
+		}
+
+		assertMode := func(file string, expectedMode os.FileMode) {
+			fileInfo, statErr := os.Lstat(filepath.Join(targetDir, file))
+			Expect(statErr).ToNot(HaveOccurred())
+			Expect(fileInfo.Mode()).To(Equal(expectedMode), file)
+		}
+
+		Context("a node app with symlinked node_modules/.bin entries", func() {
+			BeforeEach(func() {
+				srcZip = "testdata/archives/node_app.zip"
+				modTime = time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+			})
+
+			It("should not fail", func() {
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("should restore the symlinks", func() {
+				linkTarget, readErr := os.Readlink(filepath.Join(targetDir, "node_modules/.bin/mocha"))
+				Expect(readErr).ToNot(HaveOccurred())
+				Expect(linkTarget).To(Equal("../mocha/bin/mocha"))
+				assertMode("node_modules/mocha/bin/mocha", 0755)
+			})
+
+			It("should restore the modification times", func() {
+				assertModTime("server.js")
+				assertModTime("node_modules/mocha/bin/mocha")
+				assertModTime("node_modules/mocha/bin")
+				assertModTime("node_modules")
+			})
+		})
+
+		Context("a python app with a vendored virtualenv", func() {
+			BeforeEach(func() {
+				srcZip = "testdata/archives/python_venv.zip"
+				modTime = time.Date(2019, 6, 7, 8, 9, 10, 0, time.UTC)
+			})
+
+			AfterEach(func() {
+				Expect(os.Chmod(filepath.Join(targetDir, "venv/lib/readonly"), 0755)).To(Succeed())
+			})
+
+			It("should not fail", func() {
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("should restore the interpreter symlink", func() {
+				linkTarget, readErr := os.Readlink(filepath.Join(targetDir, "venv/bin/python"))
+				Expect(readErr).ToNot(HaveOccurred())
+				Expect(linkTarget).To(Equal("python3"))
+				assertMode("venv/bin/python3", 0755)
+			})
+
+			It("should restore the directory modes after populating them", func() {
+				assertMode("venv/lib/readonly", os.ModeDir|0555)
+				assertMode("venv/lib/readonly/data.txt", 0444)
+			})
+
+			It("should restore the modification times", func() {
+				assertModTime("app.py")
+				assertModTime("venv/lib/readonly")
+				assertModTime("venv/lib/readonly/data.txt")
+			})
+		})
+
+		Context("an archive created on windows", func() {
+			BeforeEach(func() {
+				srcZip = "testdata/archives/windows_app.zip"
+				modTime = time.Date(2019, 1, 2, 3, 4, 6, 0, time.UTC)
+			})
+
+			It("should not fail", func() {
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("should extract files without unix attributes as regular files", func() {
+				assertMode("App/web.config", 0666)
+				assertMode("App/bin/app.dll", 0666)
+			})
+
+			It("should fall back to the MS-DOS modification time", func() {
+				assertModTime("App/web.config")
+			})
+		})
+	})
+
+	Context("When the archive is malicious", func() {
+		useEntries := func(entries ...zipEntry) {
+			srcZip = filepath.Join(tmpDir, "malicious.zip")
+			writeZip(srcZip, entries)
+		}
+
+		Context("and an entry escapes the target directory", func() {
+			BeforeEach(func() {
+				useEntries(zipEntry{name: "../evil", content: "evil"})
+			})
+
+			It("should fail with a path traversal error", func() {
+				Expect(err).To(Equal(PathTraversalError{Entry: "../evil"}))
+				Expect(filepath.Join(tmpDir, "evil")).NotTo(BeAnExistingFile())
+			})
+		})
+
+		Context("and a symlink points inside the target directory", func() {
+			BeforeEach(func() {
+				useEntries(
+					zipEntry{name: "sub/file", content: "content"},
+					zipEntry{name: "link", content: "sub/file", mode: os.ModeSymlink | 0777},
+					zipEntry{name: "dirlink", content: "sub", mode: os.ModeSymlink | 0777},
+					zipEntry{name: "dirlink/other", content: "other"},
+				)
+			})
+
+			It("should create the symlink", func() {
+				Expect(err).NotTo(HaveOccurred())
+
+				linkTarget, readErr := os.Readlink(filepath.Join(targetDir, "link"))
+				Expect(readErr).NotTo(HaveOccurred())
+				Expect(linkTarget).To(Equal("sub/file"))
+			})
+
+			It("should write entries through the symlink", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(filepath.Join(targetDir, "sub", "other")).To(BeAnExistingFile())
+			})
+		})
+
+		Context("and a symlink points outside the target directory", func() {
+			BeforeEach(func() {
+				useEntries(zipEntry{name: "link", content: "../../etc", mode: os.ModeSymlink | 0777})
+			})
+
+			It("should fail with a symlink escape error", func() {
+				Expect(err).To(Equal(SymlinkEscapeError{Entry: "link", Target: "../../etc"}))
+			})
+		})
+
+		Context("and a symlink has an absolute target", func() {
+			BeforeEach(func() {
+				useEntries(zipEntry{name: "link", content: "/etc/passwd", mode: os.ModeSymlink | 0777})
+			})
+
+			It("should fail with a symlink escape error", func() {
+				Expect(err).To(Equal(SymlinkEscapeError{Entry: "link", Target: "/etc/passwd"}))
+			})
+		})
+
+		Context("and a symlink escapes through another symlink", func() {
+			BeforeEach(func() {
+				useEntries(
+					zipEntry{name: "here", content: ".", mode: os.ModeSymlink | 0777},
+					zipEntry{name: "up", content: "here/..", mode: os.ModeSymlink | 0777},
+				)
+			})
+
+			It("should fail with a symlink escape error", func() {
+				Expect(err).To(Equal(SymlinkEscapeError{Entry: "up", Target: "here/.."}))
+			})
+		})
+
+		Context("and a symlink goes up through a symlink created after it", func() {
+			BeforeEach(func() {
+				useEntries(
+					zipEntry{name: "sub/", mode: os.ModeDir | 0755},
+					zipEntry{name: "l", content: "sub/x/../..", mode: os.ModeSymlink | 0777},
+					zipEntry{name: "sub/x", content: ".", mode: os.ModeSymlink | 0777},
+				)
+			})
+
+			It("should fail with a symlink escape error", func() {
+				Expect(err).To(Equal(SymlinkEscapeError{Entry: "l", Target: "sub/x/../.."}))
+			})
+		})
+
+		Context("and it has more entries than allowed", func() {
+			BeforeEach(func() {
+				unzipper.MaxEntries = 2
+				useEntries(
+					zipEntry{name: "file1", content: "1"},
+					zipEntry{name: "file2", content: "2"},
+					zipEntry{name: "file3", content: "3"},
+				)
+			})
+
+			It("should fail with a too many entries error", func() {
+				Expect(err).To(Equal(TooManyEntriesError{Limit: 2}))
+			})
+		})
+
+		Context("and it inflates beyond the maximum total size", func() {
+			BeforeEach(func() {
+				unzipper.MaxTotalSize = 10
+				useEntries(
+					zipEntry{name: "file1", content: "123456"},
+					zipEntry{name: "file2", content: "123456"},
+				)
+			})
+
+			It("should fail with an archive too large error", func() {
+				Expect(err).To(Equal(ArchiveTooLargeError{Limit: 10}))
+			})
+		})
+
+		Context("and an entry exceeds the maximum compression ratio", func() {
+			BeforeEach(func() {
+				unzipper.MaxCompressionRatio = 100
+				useEntries(
+					zipEntry{name: "bomb", content: strings.Repeat("0", 4<<20)},
+				)
+			})
+
+			It("should fail with a compression ratio error", func() {
+				Expect(err).To(Equal(CompressionRatioError{Entry: "bomb", Limit: 100}))
+			})
+		})
+	})
 })
+
+type zipEntry struct {
+	name    string
+	content string
+	mode    os.FileMode
+}
+
+func writeZip(path string, entries []zipEntry) {
+	file, err := os.Create(path)
+	Expect(err).NotTo(HaveOccurred())
+	defer file.Close()
+
+	writer := zip.NewWriter(file)
+	for _, entry := range entries {
+		header := &zip.FileHeader{Name: entry.name, Method: zip.Deflate}
+		mode := entry.mode
+		if mode == 0 {
+			mode = 0644
+		}
+		header.SetMode(mode)
+
+		entryWriter, err := writer.CreateHeader(header)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = entryWriter.Write([]byte(entry.content))
+		Expect(err).NotTo(HaveOccurred())
+	}
+	Expect(writer.Close()).To(Succeed())
+}
@@ -1,12 +1,17 @@
 package eirinistaging
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 
+	"code.cloudfoundry.org/eirini-staging/builder"
 	"github.com/pkg/errors"
 )
 
@@ -15,6 +20,7 @@ type DropletUploader struct {
 }
 
 func (u *DropletUploader) Upload(
+	ctx context.Context,
 	dropletUploadURL string,
 	dropletLocation string,
 ) error {
@@ -26,14 +32,73 @@ func (u *DropletUploader) Upload(
 		return errors.New("empty url parameter")
 	}
 
-	return u.uploadFile(dropletLocation, dropletUploadURL)
+	return u.uploadFile(ctx, dropletLocation, dropletUploadURL)
 }
 
-func (u *DropletUploader) uploadFile(fileLocation, url string) error {
+// UploadLayers uploads the layers of a layered droplet the destination does
+// not have yet, then the manifest listing them in place of the droplet.
+func (u *DropletUploader) UploadLayers(
+	ctx context.Context,
+	dropletUploadURL string,
+	layerUploadURL string,
+	manifestLocation string,
+	layersDir string,
+) error {
+
+	if dropletUploadURL == "" || layerUploadURL == "" {
+		return errors.New("empty url parameter")
+	}
+
+	manifest, err := builder.ReadDropletManifest(manifestLocation)
+	if err != nil {
+		return errors.Wrap(err, "failed to read droplet manifest")
+	}
+
+	for _, layer := range manifest.Layers {
+		layerURL := strings.TrimSuffix(layerUploadURL, "/") + "/" + layer.Digest
+		exists, err := u.exists(ctx, layerURL)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+
+		if err = u.uploadFile(ctx, filepath.Join(layersDir, layer.FileName()), layerURL); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("failed to upload layer %s", layer.Path))
+		}
+	}
+
+	return u.uploadFile(ctx, manifestLocation, dropletUploadURL)
+}
+
+func (u *DropletUploader) exists(ctx context.Context, url string) (bool, error) {
+	request, err := http.NewRequest("HEAD", url, nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := u.Client.Do(request.WithContext(ctx))
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("Upload failed: Status code %d", resp.StatusCode)
+}
+
+func (u *DropletUploader) uploadFile(ctx context.Context, fileLocation, url string) error {
 	sourceFile, err := os.Open(filepath.Clean(fileLocation))
 	if err != nil {
 		return err
 	}
+	defer sourceFile.Close()
 
 	body := ioutil.NopCloser(sourceFile)
 	request, err := http.NewRequest("POST", url, body)
@@ -46,9 +111,34 @@ func (u *DropletUploader) uploadFile(fileLocation, url string) error {
 		return err
 	}
 
+	contentType, err := detectContentType(sourceFile)
+	if err != nil {
+		return err
+	}
+
 	request.ContentLength = contentLength
-	request.Header.Set("Content-Type", "application/octet-stream")
-	return u.do(request)
+	request.Header.Set("Content-Type", contentType)
+	return u.do(request.WithContext(ctx))
+}
+
+// detectContentType tells zstd compressed build artifacts caches apart, so
+// that the receiver does not need to know how the cache was configured.
+func detectContentType(file *os.File) (string, error) {
+	header := make([]byte, len(zstdMagic))
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	if bytes.Equal(header[:n], zstdMagic) {
+		return "application/zstd", nil
+	}
+
+	return "application/octet-stream", nil
 }
 
 func fileSize(file *os.File) (int64, error) {
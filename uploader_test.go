@@ -1,10 +1,16 @@
 package eirinistaging_test
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
 
 	. "code.cloudfoundry.org/eirini-staging"
+	"code.cloudfoundry.org/eirini-staging/builder"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/ghttp"
@@ -39,6 +45,7 @@ var _ = Describe("Uploader", func() {
 		}
 
 		err = uploader.Upload(
+			context.Background(),
 			url,
 			testFilePath,
 		)
@@ -87,6 +94,21 @@ var _ = Describe("Uploader", func() {
 			})
 		})
 
+		Context("When the file is zstd compressed", func() {
+			BeforeEach(func() {
+				testFilePath = "testdata/untar_me.tar.zst"
+
+				server.RouteToHandler("POST", "/dog/pictures/upload",
+					ghttp.VerifyContentType("application/zstd"),
+				)
+			})
+
+			It("should post it as zstd", func() {
+				Expect(err).ToNot(HaveOccurred())
+				Expect(server.ReceivedRequests()).To(HaveLen(1))
+			})
+		})
+
 		Context("When the response is 400", func() {
 
 			BeforeEach(func() {
@@ -107,3 +129,72 @@ var _ = Describe("Uploader", func() {
 
 	})
 })
+
+var _ = Describe("Uploading a layered droplet", func() {
+	var (
+		server    *ghttp.Server
+		layersDir string
+		manifest  string
+		layers    []builder.DropletLayer
+		err       error
+	)
+
+	BeforeEach(func() {
+		layersDir, err = ioutil.TempDir("", "layers")
+		Expect(err).NotTo(HaveOccurred())
+
+		layers = []builder.DropletLayer{
+			{Path: ".", Digest: "sha256:aaaa", Size: 4},
+			{Path: "deps/0", Digest: "sha256:bbbb", Size: 4},
+		}
+		for _, layer := range layers {
+			Expect(ioutil.WriteFile(filepath.Join(layersDir, layer.FileName()), []byte(layer.Digest[7:]), 0644)).To(Succeed())
+		}
+
+		contents, marshalErr := json.Marshal(builder.DropletManifest{Layers: layers})
+		Expect(marshalErr).NotTo(HaveOccurred())
+		manifest = filepath.Join(layersDir, builder.DropletManifestName)
+		Expect(ioutil.WriteFile(manifest, contents, 0644)).To(Succeed())
+
+		server = ghttp.NewServer()
+		server.RouteToHandler("HEAD", "/layers/sha256:aaaa", ghttp.RespondWith(http.StatusNotFound, nil))
+		server.RouteToHandler("HEAD", "/layers/sha256:bbbb", ghttp.RespondWith(http.StatusOK, nil))
+		server.RouteToHandler("POST", "/layers/sha256:aaaa", ghttp.VerifyBody([]byte("aaaa")))
+		server.RouteToHandler("POST", "/droplet", ghttp.VerifyBody(contents))
+	})
+
+	JustBeforeEach(func() {
+		uploader := &DropletUploader{Client: &http.Client{}}
+		err = uploader.UploadLayers(context.Background(), server.URL()+"/droplet", server.URL()+"/layers/", manifest, layersDir)
+	})
+
+	AfterEach(func() {
+		server.Close()
+		Expect(os.RemoveAll(layersDir)).To(Succeed())
+	})
+
+	It("uploads only the layers the destination does not have, then the manifest", func() {
+		Expect(err).NotTo(HaveOccurred())
+
+		var posted []string
+		for _, request := range server.ReceivedRequests() {
+			if request.Method == "POST" {
+				posted = append(posted, request.URL.Path)
+			}
+		}
+		Expect(posted).To(Equal([]string{"/layers/sha256:aaaa", "/droplet"}))
+	})
+
+	Context("when the destination fails to tell whether it has a layer", func() {
+		BeforeEach(func() {
+			server.RouteToHandler("HEAD", "/layers/sha256:bbbb", ghttp.RespondWith(http.StatusInternalServerError, nil))
+		})
+
+		It("fails without uploading the manifest", func() {
+			Expect(err).To(MatchError(ContainSubstring("Status code 500")))
+			for _, request := range server.ReceivedRequests() {
+				Expect(request.URL.Path).NotTo(Equal("/droplet"))
+			}
+		})
+	})
+})